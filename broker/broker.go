@@ -0,0 +1,63 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoResponders is returned by Request when nothing is subscribed to the subject.
+	ErrNoResponders = errors.New("broker: no responders")
+	ErrTimeout      = errors.New("broker: request timed out")
+	ErrClosed       = errors.New("broker: closed")
+)
+
+// Msg is a message delivered to a subscription.
+type Msg struct {
+	Subject string
+	Data    []byte
+
+	respond func([]byte) error
+}
+
+// Respond answers a message sent with Request. It is a no-op for published messages.
+func (m *Msg) Respond(data []byte) error {
+	if m.respond == nil {
+		return nil
+	}
+	return m.respond(data)
+}
+
+// Handler is called for every message on a subscription. Handlers for one
+// subscription are called in order, so they must not block for long.
+type Handler func(msg *Msg)
+
+// Subscription stops delivery when unsubscribed.
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// Broker routes messages between server nodes by subject. Subjects are
+// dot-separated and matched exactly.
+type Broker interface {
+	Publish(subject string, data []byte) error
+	// Request sends data and waits for the first response.
+	Request(subject string, data []byte, timeout time.Duration) ([]byte, error)
+	Subscribe(subject string, handler Handler) (Subscription, error)
+	Close() error
+}
+
+// Open returns the broker for url: "" or "memory" for a single node,
+// nats://host:port for a NATS server shared by every node.
+func Open(url string) (Broker, error) {
+	switch {
+	case url == "" || url == "memory":
+		return NewMemory(), nil
+	case strings.HasPrefix(url, "nats://") || strings.HasPrefix(url, "tls://"):
+		return DialNATS(url)
+	default:
+		return nil, fmt.Errorf("broker: unsupported url %q", url)
+	}
+}
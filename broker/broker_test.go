@@ -0,0 +1,179 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const testWait = 2 * time.Second
+
+// testBroker runs the behaviour every Broker must share against the broker
+// newBroker returns.
+func testBroker(t *testing.T, newBroker func(t *testing.T) Broker) {
+	t.Run("PublishSubscribe", func(t *testing.T) {
+		b := newBroker(t)
+		got := make(chan string, 4)
+		sub, err := b.Subscribe("miniworld.control.a.send", func(msg *Msg) {
+			got <- msg.Subject + " " + string(msg.Data)
+		})
+		if err != nil {
+			t.Fatalf("Subscribe: %v", err)
+		}
+		defer sub.Unsubscribe()
+		settle(t, b)
+
+		for _, data := range []string{"one", "two"} {
+			if err := b.Publish("miniworld.control.a.send", []byte(data)); err != nil {
+				t.Fatalf("Publish: %v", err)
+			}
+		}
+		if err := b.Publish("miniworld.control.b.send", []byte("other")); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+		for _, want := range []string{"miniworld.control.a.send one", "miniworld.control.a.send two"} {
+			if msg := receive(t, got); msg != want {
+				t.Errorf("got %q, want %q", msg, want)
+			}
+		}
+		expectNothing(t, got)
+	})
+
+	t.Run("EverySubscriberReceives", func(t *testing.T) {
+		b := newBroker(t)
+		got := make(chan string, 4)
+		for _, name := range []string{"first", "second"} {
+			sub, err := b.Subscribe("miniworld.events", func(msg *Msg) { got <- name })
+			if err != nil {
+				t.Fatalf("Subscribe: %v", err)
+			}
+			defer sub.Unsubscribe()
+		}
+		settle(t, b)
+
+		if err := b.Publish("miniworld.events", []byte("{}")); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+		seen := map[string]bool{receive(t, got): true, receive(t, got): true}
+		if !seen["first"] || !seen["second"] {
+			t.Errorf("delivered to %v, want both subscribers", seen)
+		}
+	})
+
+	t.Run("Unsubscribe", func(t *testing.T) {
+		b := newBroker(t)
+		got := make(chan string, 4)
+		sub, err := b.Subscribe("miniworld.control.a.user", func(msg *Msg) { got <- string(msg.Data) })
+		if err != nil {
+			t.Fatalf("Subscribe: %v", err)
+		}
+		settle(t, b)
+		if err := sub.Unsubscribe(); err != nil {
+			t.Fatalf("Unsubscribe: %v", err)
+		}
+		settle(t, b)
+
+		if err := b.Publish("miniworld.control.a.user", []byte("late")); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+		expectNothing(t, got)
+		if _, err := b.Request("miniworld.control.a.user", nil, testWait); !errors.Is(err, ErrNoResponders) {
+			t.Errorf("Request after Unsubscribe err = %v, want ErrNoResponders", err)
+		}
+	})
+
+	t.Run("Request", func(t *testing.T) {
+		b := newBroker(t)
+		sub, err := b.Subscribe("miniworld.control.a.alive", func(msg *Msg) {
+			msg.Respond(append([]byte("re: "), msg.Data...))
+		})
+		if err != nil {
+			t.Fatalf("Subscribe: %v", err)
+		}
+		defer sub.Unsubscribe()
+		settle(t, b)
+
+		reply, err := b.Request("miniworld.control.a.alive", []byte("ping"), testWait)
+		if err != nil {
+			t.Fatalf("Request: %v", err)
+		}
+		if string(reply) != "re: ping" {
+			t.Errorf("reply = %q, want %q", reply, "re: ping")
+		}
+	})
+
+	t.Run("RequestWithoutResponders", func(t *testing.T) {
+		b := newBroker(t)
+		if _, err := b.Request("miniworld.control.nobody.alive", nil, testWait); !errors.Is(err, ErrNoResponders) {
+			t.Errorf("err = %v, want ErrNoResponders", err)
+		}
+	})
+
+	t.Run("RequestTimeout", func(t *testing.T) {
+		b := newBroker(t)
+		sub, err := b.Subscribe("miniworld.control.a.alive", func(msg *Msg) {})
+		if err != nil {
+			t.Fatalf("Subscribe: %v", err)
+		}
+		defer sub.Unsubscribe()
+		settle(t, b)
+
+		if _, err := b.Request("miniworld.control.a.alive", nil, 50*time.Millisecond); !errors.Is(err, ErrTimeout) {
+			t.Errorf("err = %v, want ErrTimeout", err)
+		}
+	})
+
+	t.Run("PublishedMessagesIgnoreRespond", func(t *testing.T) {
+		b := newBroker(t)
+		errs := make(chan error, 1)
+		sub, err := b.Subscribe("miniworld.events", func(msg *Msg) { errs <- msg.Respond([]byte("x")) })
+		if err != nil {
+			t.Fatalf("Subscribe: %v", err)
+		}
+		defer sub.Unsubscribe()
+		settle(t, b)
+
+		if err := b.Publish("miniworld.events", nil); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Errorf("Respond on a published message: %v", err)
+			}
+		case <-time.After(testWait):
+			t.Fatal("message not delivered")
+		}
+	})
+}
+
+// settle waits until subscription changes have reached the broker, so a
+// following publish sees them.
+func settle(t *testing.T, b Broker) {
+	t.Helper()
+	if f, ok := b.(interface{ flush() error }); ok {
+		if err := f.flush(); err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+	}
+}
+
+func receive(t *testing.T, ch <-chan string) string {
+	t.Helper()
+	select {
+	case s := <-ch:
+		return s
+	case <-time.After(testWait):
+		t.Fatal("timed out waiting for a message")
+		return ""
+	}
+}
+
+func expectNothing(t *testing.T, ch <-chan string) {
+	t.Helper()
+	select {
+	case s := <-ch:
+		t.Errorf("unexpected message %q", s)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,124 @@
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+// Memory is an in-process broker for a single node.
+type Memory struct {
+	mu     sync.RWMutex
+	subs   map[string]map[*memorySub]struct{}
+	closed bool
+}
+
+type memorySub struct {
+	m       *Memory
+	subject string
+	queue   chan *Msg
+	once    sync.Once
+}
+
+// memoryQueueSize bounds how far a subscriber may fall behind before
+// published messages to it are dropped, as a network broker would.
+const memoryQueueSize = 1024
+
+func NewMemory() *Memory {
+	return &Memory{subs: make(map[string]map[*memorySub]struct{})}
+}
+
+func (m *Memory) Publish(subject string, data []byte) error {
+	m.deliver(&Msg{Subject: subject, Data: data})
+	return nil
+}
+
+// deliver hands msg to every subscriber and reports how many took it.
+func (m *Memory) deliver(msg *Msg) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n := 0
+	for s := range m.subs[msg.Subject] {
+		select {
+		case s.queue <- msg:
+			n++
+		default:
+		}
+	}
+	return n
+}
+
+func (m *Memory) Request(subject string, data []byte, timeout time.Duration) ([]byte, error) {
+	reply := make(chan []byte, 1)
+	msg := &Msg{Subject: subject, Data: data, respond: func(b []byte) error {
+		select {
+		case reply <- b:
+		default:
+		}
+		return nil
+	}}
+	if m.deliver(msg) == 0 {
+		return nil, ErrNoResponders
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case b := <-reply:
+		return b, nil
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+}
+
+func (m *Memory) Subscribe(subject string, handler Handler) (Subscription, error) {
+	s := &memorySub{m: m, subject: subject, queue: make(chan *Msg, memoryQueueSize)}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if m.subs[subject] == nil {
+		m.subs[subject] = make(map[*memorySub]struct{})
+	}
+	m.subs[subject][s] = struct{}{}
+	m.mu.Unlock()
+
+	go func() {
+		for msg := range s.queue {
+			handler(msg)
+		}
+	}()
+	return s, nil
+}
+
+func (s *memorySub) Unsubscribe() error {
+	s.once.Do(func() {
+		m := s.m
+		m.mu.Lock()
+		delete(m.subs[s.subject], s)
+		if len(m.subs[s.subject]) == 0 {
+			delete(m.subs, s.subject)
+		}
+		m.mu.Unlock()
+		close(s.queue)
+	})
+	return nil
+}
+
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	var all []*memorySub
+	for _, subs := range m.subs {
+		for s := range subs {
+			all = append(all, s)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, s := range all {
+		s.Unsubscribe()
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	testBroker(t, func(t *testing.T) Broker {
+		m := NewMemory()
+		t.Cleanup(func() { m.Close() })
+		return m
+	})
+}
+
+func TestMemoryClose(t *testing.T) {
+	m := NewMemory()
+	got := make(chan string, 1)
+	if _, err := m.Subscribe("miniworld.events", func(msg *Msg) { got <- string(msg.Data) }); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if err := m.Publish("miniworld.events", []byte("after close")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	expectNothing(t, got)
+	if _, err := m.Subscribe("miniworld.events", func(*Msg) {}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Subscribe after Close err = %v, want ErrClosed", err)
+	}
+}
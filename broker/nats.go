@@ -0,0 +1,71 @@
+package broker
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATS routes messages through a NATS server shared by every node.
+type NATS struct {
+	nc *nats.Conn
+}
+
+// DialNATS connects to the server at url and keeps reconnecting if it drops.
+func DialNATS(url string) (*NATS, error) {
+	nc, err := nats.Connect(url,
+		nats.Name("miniworld"),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(time.Second),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Printf("Broker disconnected: %v", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Printf("Broker reconnected to %s", nc.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &NATS{nc: nc}, nil
+}
+
+func (n *NATS) Publish(subject string, data []byte) error {
+	return n.nc.Publish(subject, data)
+}
+
+func (n *NATS) Request(subject string, data []byte, timeout time.Duration) ([]byte, error) {
+	msg, err := n.nc.Request(subject, data, timeout)
+	switch {
+	case errors.Is(err, nats.ErrNoResponders):
+		return nil, ErrNoResponders
+	case errors.Is(err, nats.ErrTimeout):
+		return nil, ErrTimeout
+	case errors.Is(err, nats.ErrConnectionClosed):
+		return nil, ErrClosed
+	case err != nil:
+		return nil, err
+	}
+	return msg.Data, nil
+}
+
+func (n *NATS) Subscribe(subject string, handler Handler) (Subscription, error) {
+	return n.nc.Subscribe(subject, func(m *nats.Msg) {
+		msg := &Msg{Subject: m.Subject, Data: m.Data}
+		if m.Reply != "" {
+			msg.respond = m.Respond
+		}
+		handler(msg)
+	})
+}
+
+// Close flushes pending messages before disconnecting.
+func (n *NATS) Close() error {
+	err := n.nc.Drain()
+	if errors.Is(err, nats.ErrConnectionClosed) {
+		return nil
+	}
+	return err
+}
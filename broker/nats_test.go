@@ -0,0 +1,89 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// flush waits for the server to process everything sent so far.
+func (n *NATS) flush() error {
+	return n.nc.Flush()
+}
+
+func runNATSServer(t *testing.T) *server.Server {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		s.Shutdown()
+		t.Fatal("nats server did not start")
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func TestNATS(t *testing.T) {
+	s := runNATSServer(t)
+	testBroker(t, func(t *testing.T) Broker {
+		n, err := DialNATS(s.ClientURL())
+		if err != nil {
+			t.Fatalf("DialNATS: %v", err)
+		}
+		t.Cleanup(func() { n.Close() })
+		return n
+	})
+}
+
+// Nodes only see each other through the server.
+func TestNATSBetweenNodes(t *testing.T) {
+	s := runNATSServer(t)
+	nodes := make([]*NATS, 2)
+	for i := range nodes {
+		n, err := DialNATS(s.ClientURL())
+		if err != nil {
+			t.Fatalf("DialNATS: %v", err)
+		}
+		defer n.Close()
+		nodes[i] = n
+	}
+
+	sub, err := nodes[0].Subscribe("miniworld.control.a.user", func(msg *Msg) {
+		msg.Respond([]byte{1})
+	})
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+	if err := nodes[0].flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	reply, err := nodes[1].Request("miniworld.control.a.user", []byte("frame"), testWait)
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	if len(reply) != 1 || reply[0] != 1 {
+		t.Errorf("reply = %v, want [1]", reply)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	for _, url := range []string{"", "memory"} {
+		b, err := Open(url)
+		if err != nil {
+			t.Fatalf("Open(%q): %v", url, err)
+		}
+		if _, ok := b.(*Memory); !ok {
+			t.Errorf("Open(%q) = %T, want *Memory", url, b)
+		}
+		b.Close()
+	}
+	if _, err := Open("redis://localhost"); err == nil {
+		t.Error("Open accepted an unsupported url")
+	}
+}
@@ -0,0 +1,72 @@
+// Command migrate applies or lists the database migrations without starting
+// the server. It reads the same settings as the server.
+//
+//	migrate [up]    apply pending migrations
+//	migrate status  list every migration and when it was applied
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	"github.com/chtan/miniworld/database"
+	"github.com/chtan/miniworld/migrations"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	command := "up"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+	if command != "up" && command != "status" {
+		fmt.Fprintf(os.Stderr, "usage: %s [up|status]\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	if err := godotenv.Load(); err != nil {
+		log.Printf("Warning: Could not load .env file: %v", err)
+	}
+	settings, err := config.LoadSettings()
+	if err != nil {
+		log.Fatalf("Invalid settings: %v", err)
+	}
+	client, err := database.DatabaseSetup(settings.Mongo.URI, settings.Mongo.ConnectTimeout.Std())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Disconnect(context.Background())
+	db := client.Database("miniworld")
+
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Mongo.MigrateTimeout.Std())
+	defer cancel()
+
+	switch command {
+	case "up":
+		applied, err := migrations.Run(ctx, db)
+		if err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		log.Printf("Database schema up to date (%d migrations applied)", len(applied))
+	case "status":
+		statuses, err := migrations.Statuses(ctx, db)
+		if err != nil {
+			log.Fatalf("Failed to read migrations: %v", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, s := range statuses {
+			applied := "pending"
+			if s.Applied != nil {
+				applied = s.Applied.AppliedAt.Local().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", s.Migration.Version, s.Migration.Name, applied)
+		}
+		w.Flush()
+	}
+}
@@ -1,24 +1,72 @@
 package config
 
 import (
-	"context"
-	"fmt"
+	"crypto/ed25519"
 	"log"
-	"os"
 	"time"
 
+	"github.com/chtan/miniworld/database"
+	"github.com/chtan/miniworld/ratelimit"
+	"github.com/chtan/miniworld/repository"
 	"github.com/go-playground/validator/v10"
 	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // AppConfig holds application-wide configuration
 type AppConfig struct {
+	// Settings is the validated configuration the fields below derive from;
+	// sections without a field of their own are read from it directly
+	Settings *Settings
+
 	Client         *mongo.Client
 	SecretKey      []byte
 	RequireDBCheck bool
 	Validator      *validator.Validate
+
+	// Repos wraps the users, devices, clans, sessions and temp signups
+	// collections of Client
+	Repos *repository.Repositories
+
+	// DeviceAuthMode is "token" (default), "mtls" or "both"
+	DeviceAuthMode string
+	TLSCertFile    string
+	TLSKeyFile     string
+
+	TelemetryRetention time.Duration
+
+	// FirmwarePublicKey verifies uploaded firmware; uploads are refused when unset
+	FirmwarePublicKey ed25519.PublicKey
+
+	// ICE servers handed to both peers of a WebRTC session; TURN entries use
+	// the shared username and credential
+	ICEServers     []string
+	TURNUsername   string
+	TURNCredential string
+
+	// BrokerURL connects the nodes of a cluster (e.g. nats://localhost:4222);
+	// empty runs a single node. NodeID must be unique per node and is
+	// generated when empty.
+	BrokerURL string
+	NodeID    string
+
+	// RelayLimits caps what drivers may send to their cars over the control socket
+	RelayLimits RelayLimits
+
+	// RateLimits holds the auth endpoints' buckets and lockouts: in memory,
+	// or in Mongo when RATE_LIMIT_STORE=mongo so every node shares them
+	RateLimits ratelimit.Store
+
+	CORS CORS
+}
+
+// RelayLimits are per-second rates for the control relay; a burst of two
+// seconds' worth is allowed. Zero disables a limit.
+type RelayLimits struct {
+	SessionMessages float64 `json:"session_messages" env:"CONTROL_SESSION_MSG_RATE"`
+	SessionBytes    float64 `json:"session_bytes" env:"CONTROL_SESSION_BYTE_RATE"`
+	DeviceMessages  float64 `json:"device_messages" env:"CONTROL_DEVICE_MSG_RATE"`
+	DeviceBytes     float64 `json:"device_bytes" env:"CONTROL_DEVICE_BYTE_RATE"`
 }
 
 // Init initializes the application configuration
@@ -28,36 +76,63 @@ func Init() (*AppConfig, error) {
 		log.Printf("Warning: Could not load .env file: %v", err)
 	}
 
-	// Connect to MongoDB
-	mongoURI := os.Getenv("MONGODB_URI")
-	if mongoURI == "" {
-		mongoURI = "mongodb://localhost:27017"
-	}
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(mongoURI))
+	// Read and validate the settings before touching anything external
+	settings, err := LoadSettings()
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to MongoDB: %v", err)
+		return nil, err
 	}
 
-	// Verify connection with a ping
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := client.Ping(ctx, nil); err != nil {
-		return nil, fmt.Errorf("MongoDB ping failed: %v", err)
+	// Connect to MongoDB
+	client, err := database.DatabaseSetup(settings.Mongo.URI, settings.Mongo.ConnectTimeout.Std())
+	if err != nil {
+		return nil, err
 	}
 
-	// Load secret key
-	secretKey := os.Getenv("SECRET_KEY")
-	if secretKey == "" {
-		return nil, fmt.Errorf("SECRET_KEY not set in environment")
+	// Auth rate limit store
+	var rateLimits ratelimit.Store
+	switch settings.RateLimit.Store {
+	case "memory":
+		rateLimits = ratelimit.NewMemoryStore()
+	case "mongo":
+		rateLimits = ratelimit.NewMongoStore(client.Database("miniworld").Collection("rateLimits"))
 	}
 
+	// validated above
+	firmwarePublicKey, _ := settings.Firmware.Key()
+
 	// Initialize validator
 	validate := validator.New()
 
 	return &AppConfig{
+		Settings:       settings,
 		Client:         client,
-		SecretKey:      []byte(secretKey),
-		RequireDBCheck: os.Getenv("REQUIRE_DB_CHECK") == "true",
+		Repos:          repository.NewMongo(client.Database("miniworld")),
+		SecretKey:      []byte(settings.JWT.Secret),
+		RequireDBCheck: settings.JWT.RequireDBCheck,
 		Validator:      validate,
+		DeviceAuthMode: settings.Server.DeviceAuthMode,
+		TLSCertFile:    settings.Server.TLSCertFile,
+		TLSKeyFile:     settings.Server.TLSKeyFile,
+
+		TelemetryRetention: time.Duration(settings.Telemetry.RetentionDays) * 24 * time.Hour,
+		FirmwarePublicKey:  firmwarePublicKey,
+
+		ICEServers:     settings.WebSocket.ICEServers,
+		TURNUsername:   settings.WebSocket.TURNUsername,
+		TURNCredential: settings.WebSocket.TURNCredential,
+
+		BrokerURL: settings.WebSocket.BrokerURL,
+		NodeID:    settings.WebSocket.NodeID,
+
+		RelayLimits: settings.RateLimit.Relay,
+		RateLimits:  rateLimits,
+
+		CORS: CORS{
+			AllowedOrigins:   settings.CORS.AllowedOrigins,
+			AllowedMethods:   settings.CORS.AllowedMethods,
+			AllowedHeaders:   settings.CORS.AllowedHeaders,
+			AllowCredentials: settings.CORS.AllowCredentials,
+			MaxAge:           settings.CORS.MaxAge.Std(),
+		},
 	}, nil
 }
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CORS is the cross-origin policy for browser clients, applied to the REST
+// API and to every websocket upgrade.
+type CORS struct {
+	// AllowedOrigins are scheme://host[:port] values; "*" allows any origin
+	// and "https://*.example.com" any subdomain
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// AllowsOrigin reports whether a browser page at origin may call the server.
+func (c CORS) AllowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range c.AllowedOrigins {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		scheme, host, ok := strings.Cut(allowed, "://*.")
+		if ok && strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(origin, "."+host) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOrigin is a websocket.Upgrader CheckOrigin. Requests without an
+// Origin header come from cars and native apps rather than browsers and
+// are allowed, as are same-origin pages.
+func (c CORS) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return c.AllowsOrigin(origin)
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
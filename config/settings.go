@@ -0,0 +1,462 @@
+package config
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings is the server's configuration. It starts from DefaultSettings,
+// is read from the JSON file named by CONFIG_FILE if set, and is then
+// overridden field by field by the environment variables in the env tags.
+type Settings struct {
+	Server    ServerSettings    `json:"server"`
+	Mongo     MongoSettings     `json:"mongo"`
+	JWT       JWTSettings       `json:"jwt"`
+	Storage   StorageSettings   `json:"storage"`
+	Mail      MailSettings      `json:"mail"`
+	WebSocket WebSocketSettings `json:"websocket"`
+	RateLimit RateLimitSettings `json:"rate_limit"`
+	CORS      CORSSettings      `json:"cors"`
+	Telemetry TelemetrySettings `json:"telemetry"`
+	Firmware  FirmwareSettings  `json:"firmware"`
+}
+
+type ServerSettings struct {
+	Port string `json:"port" env:"PORT"`
+	// Mode is gin's mode: debug, release or test
+	Mode string `json:"mode" env:"GIN_MODE"`
+	// DeviceAuthMode is "token", "mtls" or "both"; the TLS files are
+	// required unless it is "token"
+	DeviceAuthMode  string   `json:"device_auth_mode" env:"DEVICE_AUTH_MODE"`
+	TLSCertFile     string   `json:"tls_cert_file" env:"TLS_CERT_FILE"`
+	TLSKeyFile      string   `json:"tls_key_file" env:"TLS_KEY_FILE"`
+	ShutdownTimeout Duration `json:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	// DeviceCAKey is a base64 32-byte key that encrypts the device CA's
+	// private key at rest; required unless DeviceAuthMode is "token"
+	DeviceCAKey string `json:"-" env:"DEVICE_CA_KEY"`
+	// TrustedProxies are the IPs or CIDRs whose X-Forwarded-For is believed
+	// when finding the client IP; none by default, so the peer address is used
+	TrustedProxies []string `json:"trusted_proxies" env:"TRUSTED_PROXIES"`
+	// AdminAddr is the host:port of the operator listener that serves
+	// /debug/vars; keep it off the public network. Empty turns it off.
+	AdminAddr string `json:"admin_addr" env:"ADMIN_ADDR"`
+}
+
+type MongoSettings struct {
+	URI            string   `json:"uri" env:"MONGODB_URI"`
+	ConnectTimeout Duration `json:"connect_timeout" env:"MONGODB_CONNECT_TIMEOUT"`
+	// MigrateOnStart applies pending migrations before serving; turn it off
+	// to run cmd/migrate as a separate deploy step
+	MigrateOnStart bool     `json:"migrate_on_start" env:"MIGRATE_ON_START"`
+	MigrateTimeout Duration `json:"migrate_timeout" env:"MIGRATE_TIMEOUT"`
+}
+
+type JWTSettings struct {
+	Secret     string   `json:"-" env:"SECRET_KEY"`
+	AccessTTL  Duration `json:"access_ttl" env:"JWT_ACCESS_TTL"`
+	RefreshTTL Duration `json:"refresh_ttl" env:"JWT_REFRESH_TTL"`
+	// RequireDBCheck makes the auth middleware look the token up in Mongo
+	RequireDBCheck bool `json:"require_db_check" env:"REQUIRE_DB_CHECK"`
+}
+
+// StorageSettings locate the S3 bucket for uploads, firmware and recordings.
+type StorageSettings struct {
+	Region    string `json:"region" env:"AWS_REGION"`
+	Bucket    string `json:"bucket" env:"AWS_BUCKET"`
+	AccessKey string `json:"-" env:"AWS_ACCESS_KEY"`
+	SecretKey string `json:"-" env:"AWS_SECRET_KEY"`
+}
+
+// MailSettings configure the SMTP relay for OTP mail. A host is required
+// unless LogOnly is set.
+type MailSettings struct {
+	Host     string `json:"host" env:"SMTP_HOST"`
+	Port     int    `json:"port" env:"SMTP_PORT"`
+	Username string `json:"username" env:"SMTP_USERNAME"`
+	Password string `json:"-" env:"SMTP_PASSWORD"`
+	From     string `json:"from" env:"MAIL_FROM"`
+	// LogOnly writes mail, OTPs included, to the server log instead of
+	// sending it; for development, and refused in release mode
+	LogOnly bool `json:"log_only" env:"MAIL_LOG_ONLY"`
+}
+
+type WebSocketSettings struct {
+	// BrokerURL connects the nodes of a cluster (e.g. nats://localhost:4222);
+	// empty runs a single node. NodeID must be unique per node and is
+	// generated when empty.
+	BrokerURL string `json:"broker_url" env:"BROKER_URL"`
+	NodeID    string `json:"node_id" env:"NODE_ID"`
+
+	// ICE servers handed to both peers of a WebRTC session; TURN entries use
+	// the shared username and credential
+	ICEServers     []string `json:"ice_servers" env:"WEBRTC_ICE_SERVERS"`
+	TURNUsername   string   `json:"turn_username" env:"WEBRTC_TURN_USERNAME"`
+	TURNCredential string   `json:"-" env:"WEBRTC_TURN_CREDENTIAL"`
+}
+
+type RateLimitSettings struct {
+	// Store is "memory" or "mongo"; mongo shares auth limits between nodes
+	Store string      `json:"store" env:"RATE_LIMIT_STORE"`
+	Relay RelayLimits `json:"relay"`
+}
+
+type CORSSettings struct {
+	// AllowedOrigins defaults to * outside release mode; set it empty to
+	// allow no cross-origin callers
+	AllowedOrigins   []string `json:"allowed_origins" env:"CORS_ALLOWED_ORIGINS,allowempty"`
+	AllowedMethods   []string `json:"allowed_methods" env:"CORS_ALLOWED_METHODS"`
+	AllowedHeaders   []string `json:"allowed_headers" env:"CORS_ALLOWED_HEADERS"`
+	AllowCredentials bool     `json:"allow_credentials" env:"CORS_ALLOW_CREDENTIALS"`
+	MaxAge           Duration `json:"max_age" env:"CORS_MAX_AGE"`
+}
+
+type TelemetrySettings struct {
+	RetentionDays int `json:"retention_days" env:"TELEMETRY_RETENTION_DAYS"`
+}
+
+type FirmwareSettings struct {
+	// PublicKey is a base64 ed25519 key; firmware uploads are refused when unset
+	PublicKey string `json:"public_key" env:"FIRMWARE_PUBLIC_KEY"`
+}
+
+// Duration is a time.Duration written as "30s" or "15m" in the file and
+// the environment.
+type Duration time.Duration
+
+func (d Duration) Std() time.Duration { return time.Duration(d) }
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations are strings such as \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// DefaultSettings are the values used for anything the file and the
+// environment leave out.
+func DefaultSettings() *Settings {
+	return &Settings{
+		Server: ServerSettings{
+			Port:            "8000",
+			Mode:            "debug",
+			DeviceAuthMode:  "token",
+			ShutdownTimeout: Duration(10 * time.Second),
+			AdminAddr:       "127.0.0.1:8001",
+		},
+		Mongo: MongoSettings{
+			URI:            "mongodb://localhost:27017",
+			ConnectTimeout: Duration(10 * time.Second),
+			MigrateOnStart: true,
+			MigrateTimeout: Duration(5 * time.Minute),
+		},
+		JWT: JWTSettings{
+			AccessTTL:  Duration(60 * time.Minute),
+			RefreshTTL: Duration(30 * 24 * time.Hour),
+		},
+		Storage: StorageSettings{
+			Region: "eu-north-1",
+		},
+		Mail: MailSettings{
+			Port: 587,
+		},
+		WebSocket: WebSocketSettings{
+			ICEServers: []string{"stun:stun.l.google.com:19302"},
+		},
+		RateLimit: RateLimitSettings{
+			Store: "memory",
+			Relay: RelayLimits{
+				SessionMessages: 50,
+				SessionBytes:    64 << 10,
+				DeviceMessages:  100,
+				DeviceBytes:     128 << 10,
+			},
+		},
+		CORS: CORSSettings{
+			AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+			AllowedHeaders: []string{"Authorization", "Content-Type"},
+			MaxAge:         Duration(10 * time.Minute),
+		},
+		Telemetry: TelemetrySettings{
+			RetentionDays: 30,
+		},
+	}
+}
+
+// LoadSettings reads the defaults, the CONFIG_FILE and the environment, in
+// that order, and validates the result.
+func LoadSettings() (*Settings, error) {
+	s := DefaultSettings()
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := s.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(s).Elem()); err != nil {
+		return nil, err
+	}
+	if s.CORS.AllowedOrigins == nil && s.Server.Mode != "release" {
+		s.CORS.AllowedOrigins = []string{"*"}
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Settings) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(s); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// applyEnv overrides the fields of v that have an env tag and a non-empty
+// environment variable. Fields tagged allowempty are also overridden by a
+// variable that is set but empty.
+func applyEnv(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+		tag := field.Tag.Get("env")
+		if tag == "" {
+			if value.Kind() == reflect.Struct && field.Type != durationType {
+				if err := applyEnv(value); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		name, opt, _ := strings.Cut(tag, ",")
+		raw, ok := os.LookupEnv(name)
+		if !ok || (raw == "" && opt != "allowempty") {
+			continue
+		}
+		if err := setFromEnv(value, raw); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setFromEnv(v reflect.Value, raw string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("must be a duration such as 30s, got %q", raw)
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(raw)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("must be true or false, got %q", raw)
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("must be an integer, got %q", raw)
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Float64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("must be a number, got %q", raw)
+		}
+		v.SetFloat(n)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		list := splitList(raw)
+		if list == nil {
+			list = []string{}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once, each named by its
+// environment variable.
+func (s *Settings) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if n, err := strconv.Atoi(s.Server.Port); err != nil || n <= 0 || n > 65535 {
+		fail("PORT must be a port number, got %q", s.Server.Port)
+	}
+	if !slices.Contains([]string{"debug", "release", "test"}, s.Server.Mode) {
+		fail("GIN_MODE must be debug, release or test, got %q", s.Server.Mode)
+	}
+	switch s.Server.DeviceAuthMode {
+	case "token":
+	case "mtls", "both":
+		if s.Server.TLSCertFile == "" || s.Server.TLSKeyFile == "" {
+			fail("TLS_CERT_FILE and TLS_KEY_FILE are required when DEVICE_AUTH_MODE is %s", s.Server.DeviceAuthMode)
+		}
+		if s.Server.DeviceCAKey == "" {
+			fail("DEVICE_CA_KEY is required when DEVICE_AUTH_MODE is %s", s.Server.DeviceAuthMode)
+		}
+	default:
+		fail("DEVICE_AUTH_MODE must be token, mtls or both, got %q", s.Server.DeviceAuthMode)
+	}
+	if _, err := s.Server.CAKey(); err != nil {
+		fail("%v", err)
+	}
+	if s.Server.ShutdownTimeout <= 0 {
+		fail("SHUTDOWN_TIMEOUT must be positive")
+	}
+	for _, proxy := range s.Server.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				fail("TRUSTED_PROXIES entries must be IPs or CIDRs, got %q", proxy)
+			}
+		}
+	}
+	if s.Server.AdminAddr != "" {
+		if _, port, err := net.SplitHostPort(s.Server.AdminAddr); err != nil || port == "" {
+			fail("ADMIN_ADDR must be host:port, got %q", s.Server.AdminAddr)
+		}
+	}
+
+	if !strings.HasPrefix(s.Mongo.URI, "mongodb://") && !strings.HasPrefix(s.Mongo.URI, "mongodb+srv://") {
+		fail("MONGODB_URI must be a mongodb:// or mongodb+srv:// URI")
+	}
+	if s.Mongo.ConnectTimeout <= 0 {
+		fail("MONGODB_CONNECT_TIMEOUT must be positive")
+	}
+	if s.Mongo.MigrateTimeout <= 0 {
+		fail("MIGRATE_TIMEOUT must be positive")
+	}
+
+	if s.JWT.Secret == "" {
+		fail("SECRET_KEY not set in environment")
+	}
+	if s.JWT.AccessTTL <= 0 || s.JWT.RefreshTTL <= 0 {
+		fail("JWT_ACCESS_TTL and JWT_REFRESH_TTL must be positive")
+	} else if s.JWT.RefreshTTL <= s.JWT.AccessTTL {
+		fail("JWT_REFRESH_TTL must be longer than JWT_ACCESS_TTL")
+	}
+
+	if s.Storage.Region == "" {
+		fail("AWS_REGION must be set")
+	}
+	if s.Storage.Bucket == "" {
+		fail("AWS_BUCKET must be set")
+	}
+
+	switch {
+	case s.Mail.LogOnly:
+		if s.Server.Mode == "release" {
+			fail("MAIL_LOG_ONLY would log OTPs; it can't be used when GIN_MODE is release")
+		}
+	case s.Mail.Host == "":
+		fail("SMTP_HOST must be set, or MAIL_LOG_ONLY for development")
+	default:
+		if s.Mail.Port <= 0 || s.Mail.Port > 65535 {
+			fail("SMTP_PORT must be a port number, got %d", s.Mail.Port)
+		}
+		if s.Mail.From == "" {
+			fail("MAIL_FROM is required when SMTP_HOST is set")
+		}
+	}
+
+	for _, url := range s.WebSocket.ICEServers {
+		if !strings.HasPrefix(url, "stun:") && !strings.HasPrefix(url, "turn:") && !strings.HasPrefix(url, "turns:") {
+			fail("WEBRTC_ICE_SERVERS entries must be stun:, turn: or turns: URLs, got %q", url)
+		}
+	}
+
+	if s.RateLimit.Store != "memory" && s.RateLimit.Store != "mongo" {
+		fail("RATE_LIMIT_STORE must be memory or mongo, got %q", s.RateLimit.Store)
+	}
+	relay := s.RateLimit.Relay
+	for env, limit := range map[string]float64{
+		"CONTROL_SESSION_MSG_RATE":  relay.SessionMessages,
+		"CONTROL_SESSION_BYTE_RATE": relay.SessionBytes,
+		"CONTROL_DEVICE_MSG_RATE":   relay.DeviceMessages,
+		"CONTROL_DEVICE_BYTE_RATE":  relay.DeviceBytes,
+	} {
+		if limit < 0 {
+			fail("%s must be a non-negative number, got %v", env, limit)
+		}
+	}
+
+	for _, origin := range s.CORS.AllowedOrigins {
+		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			fail("CORS_ALLOWED_ORIGINS entries must be http:// or https:// origins or *, got %q", origin)
+		}
+	}
+	if s.CORS.AllowCredentials && slices.Contains(s.CORS.AllowedOrigins, "*") {
+		fail("CORS_ALLOW_CREDENTIALS can't be combined with a * origin")
+	}
+
+	if s.Telemetry.RetentionDays <= 0 {
+		fail("TELEMETRY_RETENTION_DAYS must be a positive integer, got %d", s.Telemetry.RetentionDays)
+	}
+	if _, err := s.Firmware.Key(); err != nil {
+		fail("%v", err)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// CAKey decodes the device CA encryption key, returning nil when unset.
+func (s ServerSettings) CAKey() ([]byte, error) {
+	if s.DeviceCAKey == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(s.DeviceCAKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("DEVICE_CA_KEY must be 32 bytes of base64")
+	}
+	return key, nil
+}
+
+// Key decodes the firmware signing key; it is nil when none is configured.
+func (f FirmwareSettings) Key() (ed25519.PublicKey, error) {
+	if f.PublicKey == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(f.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("FIRMWARE_PUBLIC_KEY must be a base64 ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
@@ -10,9 +10,9 @@ import (
 	device_controllers "github.com/chtan/miniworld/controllers/device"
 	clan_models "github.com/chtan/miniworld/models/clan"
 	device_models "github.com/chtan/miniworld/models/device"
+	"github.com/chtan/miniworld/repository"
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func CreateClan(app *config.AppConfig) gin.HandlerFunc {
@@ -44,13 +44,11 @@ func CreateClan(app *config.AppConfig) gin.HandlerFunc {
 		}
 
 		// Insert into MongoDB
-		result, err := app.Client.Database("miniworld").
-			Collection("clans").
-			InsertOne(mctx, clan)
+		err = app.Repos.Clans.Create(mctx, clan)
 
 		if err != nil {
 			// Most important: handle duplicate clan name/tag properly!
-			if mongo.IsDuplicateKeyError(err) {
+			if err == repository.ErrDuplicate {
 				common_controllers.ErrorResponse(ctx, http.StatusConflict, "Clan already exists (name or tag taken)", err.Error())
 				return
 			}
@@ -60,7 +58,7 @@ func CreateClan(app *config.AppConfig) gin.HandlerFunc {
 			return
 		}
 
-		common_controllers.SuccessResponse(ctx, "Clan created successfully", result)
+		common_controllers.SuccessResponse(ctx, "Clan created successfully", gin.H{"InsertedID": clan.ID})
 	}
 }
 
@@ -98,3 +96,192 @@ func AddDevice(app *config.AppConfig) gin.HandlerFunc {
 	}
 
 }
+
+// CreatePairingCode issues a short-lived code a car can exchange at /dpair
+// to join one of the admin's clans without a hand-typed password.
+func CreatePairingCode(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req device_models.PairingRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid request body", err.Error())
+			return
+		}
+
+		userDetails, err := common_controllers.GetMyId(mctx, ctx, app)
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		if _, err := GetMyClan(mctx, app, req.ClanID, userDetails.ID); err != nil {
+			if err == repository.ErrNotFound {
+				common_controllers.ErrorResponse(ctx, http.StatusForbidden, "Clan not found", "You are not the admin of this clan")
+				return
+			}
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load clan", err.Error())
+			return
+		}
+
+		pairing, err := device_controllers.CreatePairingCode(mctx, app, userDetails.ID, req.ClanID, req.Color)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to create pairing code", err.Error())
+			return
+		}
+
+		common_controllers.SuccessResponse(ctx, "Pairing code created", gin.H{
+			"code":       pairing.Code,
+			"clan_id":    pairing.ClanID.Hex(),
+			"expires_at": pairing.ExpiresAt,
+		})
+	}
+}
+
+// UpdateMembers lets a clan admin add and remove members, who can watch
+// the clan's devices in the lobby.
+// POST /api/clanmembers {"clan_id": "...", "add": ["email"], "remove": ["email"]}
+func UpdateMembers(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req clan_models.MembersRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid request body", err.Error())
+			return
+		}
+
+		userDetails, err := common_controllers.GetMyId(mctx, ctx, app)
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		add, ok := lookupMembers(mctx, ctx, app, req.Add)
+		if !ok {
+			return
+		}
+		remove, ok := lookupMembers(mctx, ctx, app, req.Remove)
+		if !ok {
+			return
+		}
+
+		if len(add) > 0 {
+			err = app.Repos.Clans.AddMembers(mctx, req.ClanID, userDetails.ID, add)
+		}
+		if err == nil && len(remove) > 0 {
+			err = app.Repos.Clans.RemoveMembers(mctx, req.ClanID, userDetails.ID, remove)
+		}
+		if err == repository.ErrNotFound {
+			common_controllers.ErrorResponse(ctx, http.StatusForbidden, "Clan not found", "You are not the admin of this clan")
+			return
+		}
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to update members", err.Error())
+			return
+		}
+
+		common_controllers.SuccessResponse(ctx, "Members updated", gin.H{"clan_id": req.ClanID.Hex()})
+	}
+}
+
+// lookupMembers resolves emails to user IDs, writing the error response itself.
+func lookupMembers(mctx context.Context, ctx *gin.Context, app *config.AppConfig, emails []string) ([]primitive.ObjectID, bool) {
+	ids := make([]primitive.ObjectID, 0, len(emails))
+	for _, email := range emails {
+		user, err := app.Repos.Users.ByEmail(mctx, email)
+		if err == repository.ErrNotFound {
+			common_controllers.ErrorResponse(ctx, http.StatusNotFound, "User not found", email)
+			return nil, false
+		}
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load user", err.Error())
+			return nil, false
+		}
+		ids = append(ids, user.ID)
+	}
+	return ids, true
+}
+
+// GetMyClan loads a clan only if the user is its admin.
+func GetMyClan(mctx context.Context, app *config.AppConfig, clanID, adminID primitive.ObjectID) (*clan_models.Clan, error) {
+	clan, err := app.Repos.Clans.GetOwned(mctx, clanID, adminID)
+	if err != nil {
+		return nil, err
+	}
+	return &clan, nil
+}
+
+// IsMyClanDevice reports whether the device belongs to a clan the user administers.
+func IsMyClanDevice(mctx context.Context, app *config.AppConfig, userID, deviceID primitive.ObjectID) (bool, error) {
+	device, err := app.Repos.Devices.Get(mctx, deviceID)
+	if err == repository.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, err = GetMyClan(mctx, app, device.ClanID, userID)
+	if err == repository.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RequireMyClanDevice resolves a device id from the request for a handler,
+// writing the error response itself when the user may not access the device.
+func RequireMyClanDevice(mctx context.Context, ctx *gin.Context, app *config.AppConfig, deviceHex string) (primitive.ObjectID, bool) {
+	deviceID, err := primitive.ObjectIDFromHex(deviceHex)
+	if err != nil {
+		common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid device id", err.Error())
+		return primitive.NilObjectID, false
+	}
+
+	userDetails, err := common_controllers.GetMyId(mctx, ctx, app)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return primitive.NilObjectID, false
+	}
+
+	ok, err := IsMyClanDevice(mctx, app, userDetails.ID, deviceID)
+	if err != nil {
+		common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load device", err.Error())
+		return primitive.NilObjectID, false
+	}
+	if !ok {
+		common_controllers.ErrorResponse(ctx, http.StatusNotFound, "Device not found", "Device is not in any of your clans")
+		return primitive.NilObjectID, false
+	}
+	return deviceID, true
+}
+
+// GetMyClanDeviceIDs returns the hex IDs of every device in the clans the
+// user administers or is a member of.
+func GetMyClanDeviceIDs(mctx context.Context, app *config.AppConfig, userID primitive.ObjectID) ([]string, error) {
+	clans, err := app.Repos.Clans.ListForUser(mctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(clans) == 0 {
+		return []string{}, nil
+	}
+
+	clanIDs := make([]primitive.ObjectID, 0, len(clans))
+	for _, c := range clans {
+		clanIDs = append(clanIDs, c.ID)
+	}
+
+	devices, err := app.Repos.Devices.ListByClans(mctx, clanIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(devices))
+	for _, d := range devices {
+		ids = append(ids, d.ID.Hex())
+	}
+	return ids, nil
+}
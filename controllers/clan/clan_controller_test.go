@@ -0,0 +1,155 @@
+package clan_controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/chtan/miniworld/config"
+	auth_models "github.com/chtan/miniworld/models/auth"
+	clan_models "github.com/chtan/miniworld/models/clan"
+	device_models "github.com/chtan/miniworld/models/device"
+	"github.com/chtan/miniworld/repository"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fixture is an admin with one clan and one device in it, and a second user.
+type fixture struct {
+	app    *config.AppConfig
+	admin  auth_models.SetSignUpModel
+	other  auth_models.SetSignUpModel
+	clan   clan_models.Clan
+	device device_models.Device
+}
+
+func newFixture(t *testing.T) fixture {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	repos := repository.NewMemory()
+
+	f := fixture{
+		app:   &config.AppConfig{Settings: config.DefaultSettings(), Repos: repos},
+		admin: auth_models.SetSignUpModel{ID: primitive.NewObjectID(), Email: "admin@example.com", Access_Token: "admin-token"},
+		other: auth_models.SetSignUpModel{ID: primitive.NewObjectID(), Email: "other@example.com", Access_Token: "other-token"},
+	}
+	f.clan = clan_models.Clan{ID: primitive.NewObjectID(), AdminID: f.admin.ID, ClanDetails: &clan_models.ClanDetails{Name: "Racers", Tag: "RCR"}}
+	f.device = device_models.Device{ID: primitive.NewObjectID(), ClanID: f.clan.ID, AdminID: f.admin.ID}
+
+	for _, u := range []auth_models.SetSignUpModel{f.admin, f.other} {
+		if err := repos.Users.Create(ctx, u); err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+	}
+	if err := repos.Clans.Create(ctx, f.clan); err != nil {
+		t.Fatalf("create clan: %v", err)
+	}
+	if err := repos.Devices.Create(ctx, f.device); err != nil {
+		t.Fatalf("create device: %v", err)
+	}
+	return f
+}
+
+func (f fixture) updateMembers(t *testing.T, token string, req clan_models.MembersRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(req)
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/api/clanmembers", bytes.NewReader(body))
+	ctx.Request.Header.Set("Authorization", "Bearer "+token)
+	ctx.Request.Header.Set("Content-Type", "application/json")
+	UpdateMembers(f.app)(ctx)
+	return w
+}
+
+func TestIsMyClanDevice(t *testing.T) {
+	f := newFixture(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		user   primitive.ObjectID
+		device primitive.ObjectID
+		want   bool
+	}{
+		{"admin", f.admin.ID, f.device.ID, true},
+		{"other user", f.other.ID, f.device.ID, false},
+		{"unknown device", f.admin.ID, primitive.NewObjectID(), false},
+	}
+	for _, tt := range tests {
+		got, err := IsMyClanDevice(ctx, f.app, tt.user, tt.device)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: IsMyClanDevice = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateMembers(t *testing.T) {
+	f := newFixture(t)
+	ctx := context.Background()
+
+	ids, err := GetMyClanDeviceIDs(ctx, f.app, f.other.ID)
+	if err != nil {
+		t.Fatalf("GetMyClanDeviceIDs: %v", err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("non-member sees devices %v", ids)
+	}
+
+	w := f.updateMembers(t, f.admin.Access_Token, clan_models.MembersRequest{ClanID: f.clan.ID, Add: []string{f.other.Email}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("add member: status %d: %s", w.Code, w.Body)
+	}
+	ids, err = GetMyClanDeviceIDs(ctx, f.app, f.other.ID)
+	if err != nil {
+		t.Fatalf("GetMyClanDeviceIDs: %v", err)
+	}
+	if !slices.Equal(ids, []string{f.device.ID.Hex()}) {
+		t.Errorf("member sees %v, want the clan's device", ids)
+	}
+
+	w = f.updateMembers(t, f.admin.Access_Token, clan_models.MembersRequest{ClanID: f.clan.ID, Remove: []string{f.other.Email}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("remove member: status %d: %s", w.Code, w.Body)
+	}
+	ids, _ = GetMyClanDeviceIDs(ctx, f.app, f.other.ID)
+	if len(ids) != 0 {
+		t.Errorf("removed member still sees %v", ids)
+	}
+}
+
+func TestUpdateMembersRejects(t *testing.T) {
+	f := newFixture(t)
+
+	tests := []struct {
+		name  string
+		token string
+		req   clan_models.MembersRequest
+		want  int
+	}{
+		{"not the admin", f.other.Access_Token, clan_models.MembersRequest{ClanID: f.clan.ID, Add: []string{f.other.Email}}, http.StatusForbidden},
+		{"unknown email", f.admin.Access_Token, clan_models.MembersRequest{ClanID: f.clan.ID, Add: []string{"nobody@example.com"}}, http.StatusNotFound},
+		{"bad token", "stale", clan_models.MembersRequest{ClanID: f.clan.ID, Add: []string{f.other.Email}}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if w := f.updateMembers(t, tt.token, tt.req); w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.want, w.Body)
+		}
+	}
+
+	clan, err := f.app.Repos.Clans.GetOwned(context.Background(), f.clan.ID, f.admin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clan.MemberIDs) != 0 {
+		t.Errorf("rejected requests added members %v", clan.MemberIDs)
+	}
+}
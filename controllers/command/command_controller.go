@@ -0,0 +1,405 @@
+package command_controllers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	clan_controllers "github.com/chtan/miniworld/controllers/clan"
+	common_controllers "github.com/chtan/miniworld/controllers/common"
+	command_models "github.com/chtan/miniworld/models/command"
+	"github.com/chtan/miniworld/mywebsocket"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DefaultCommandTTL = time.Hour
+
+	CommandStop = "stop"
+	// a stop that can't reach the car quickly is worse than none
+	StopTTL = 30 * time.Second
+
+	// how long a delivered command waits for an ack before it is resent
+	ackTimeout       = 30 * time.Second
+	dispatchInterval = 10 * time.Second
+	settlePoll       = 250 * time.Millisecond
+)
+
+var dispatcherOnce sync.Once
+
+func commands(app *config.AppConfig) *mongo.Collection {
+	return app.Client.Database("miniworld").Collection("commands")
+}
+
+// Enqueue stores a command for the device and tries to deliver it right away.
+func Enqueue(mctx context.Context, app *config.AppConfig, deviceID, issuedBy primitive.ObjectID, command string, payload interface{}, ttl time.Duration) (command_models.Command, error) {
+	if ttl <= 0 {
+		ttl = DefaultCommandTTL
+	}
+	cmd := command_models.Command{
+		ID:        primitive.NewObjectID(),
+		DeviceID:  deviceID,
+		IssuedBy:  issuedBy,
+		Command:   command,
+		Payload:   payload,
+		Status:    command_models.StatusPending,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if _, err := commands(app).InsertOne(mctx, cmd); err != nil {
+		return cmd, err
+	}
+
+	deliverDue(app, deviceID, ackTimeout)
+	return cmd, nil
+}
+
+// DeliverPending sends every unacked, unexpired command to the device in the
+// order they were queued. Called when a device (re)connects.
+func DeliverPending(app *config.AppConfig, deviceID primitive.ObjectID) {
+	deliverDue(app, deviceID, 0)
+}
+
+// deliverDue sends pending commands plus delivered ones that have waited
+// longer than resendAfter for an ack. It is a no-op while the device is offline.
+func deliverDue(app *config.AppConfig, deviceID primitive.ObjectID, resendAfter time.Duration) {
+	mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	cursor, err := commands(app).Find(mctx, bson.M{
+		"device_id":  deviceID,
+		"expires_at": bson.M{"$gt": now},
+		"$or": []bson.M{
+			{"status": command_models.StatusPending},
+			{"status": command_models.StatusDelivered, "delivered_at": bson.M{"$lte": now.Add(-resendAfter)}},
+		},
+	}, options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		log.Printf("Failed to load pending commands for %s: %v", deviceID.Hex(), err)
+		return
+	}
+	var pending []command_models.Command
+	if err := cursor.All(mctx, &pending); err != nil {
+		log.Printf("Failed to load pending commands for %s: %v", deviceID.Hex(), err)
+		return
+	}
+
+	for _, cmd := range pending {
+		if !deliver(mctx, app, cmd) {
+			return
+		}
+	}
+}
+
+func deliver(mctx context.Context, app *config.AppConfig, cmd command_models.Command) bool {
+	sent := mywebsocket.SendDeviceJSON(cmd.DeviceID.Hex(), gin.H{
+		"type": mywebsocket.TypeCommand,
+		"id":   cmd.ID.Hex(),
+		"data": command_models.DeviceCommandMessage{
+			Command:   cmd.Command,
+			Payload:   cmd.Payload,
+			ExpiresAt: cmd.ExpiresAt,
+		},
+	})
+	if !sent {
+		return false
+	}
+
+	// never downgrade a command that was acked while we were sending
+	_, err := commands(app).UpdateOne(mctx, bson.M{
+		"_id":    cmd.ID,
+		"status": bson.M{"$in": []string{command_models.StatusPending, command_models.StatusDelivered}},
+	}, bson.M{
+		"$set": bson.M{"status": command_models.StatusDelivered, "delivered_at": time.Now()},
+		"$inc": bson.M{"attempts": 1},
+	})
+	if err != nil {
+		log.Printf("Failed to mark command %s delivered: %v", cmd.ID.Hex(), err)
+	}
+	return true
+}
+
+// WaitSettled polls the commands until each is acked, failed or otherwise
+// finished, or until timeout, and returns them by id as they last stood.
+func WaitSettled(mctx context.Context, app *config.AppConfig, commandIDs []primitive.ObjectID, timeout time.Duration) (map[primitive.ObjectID]command_models.Command, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		cursor, err := commands(app).Find(mctx, bson.M{"_id": bson.M{"$in": commandIDs}})
+		if err != nil {
+			return nil, err
+		}
+		var found []command_models.Command
+		if err := cursor.All(mctx, &found); err != nil {
+			return nil, err
+		}
+
+		byID := make(map[primitive.ObjectID]command_models.Command, len(found))
+		open := 0
+		for _, cmd := range found {
+			byID[cmd.ID] = cmd
+			if cmd.Status == command_models.StatusPending || cmd.Status == command_models.StatusDelivered {
+				open++
+			}
+		}
+		if open == 0 || time.Now().After(deadline) {
+			return byID, nil
+		}
+
+		select {
+		case <-mctx.Done():
+			return byID, nil
+		case <-time.After(settlePoll):
+		}
+	}
+}
+
+// Cancel withdraws commands that have not been acked yet and returns the
+// ones it withdrew; the rest had already settled. Cars may still receive a
+// command already in flight; their ack is then ignored.
+func Cancel(mctx context.Context, app *config.AppConfig, commandIDs []primitive.ObjectID) (map[primitive.ObjectID]bool, error) {
+	cancelled := make(map[primitive.ObjectID]bool, len(commandIDs))
+	for _, id := range commandIDs {
+		// one at a time, so an ack racing the cancel is settled per command
+		result, err := commands(app).UpdateOne(mctx, bson.M{
+			"_id":    id,
+			"status": bson.M{"$in": []string{command_models.StatusPending, command_models.StatusDelivered}},
+		}, bson.M{"$set": bson.M{"status": command_models.StatusCancelled}})
+		if err != nil {
+			return cancelled, err
+		}
+		if result.ModifiedCount > 0 {
+			cancelled[id] = true
+		}
+	}
+	return cancelled, nil
+}
+
+// HandleDeviceMessage settles the command a "command_ack" refers to, as
+// acked or failed. Acks for commands that were cancelled, expired or already
+// settled change nothing.
+func HandleDeviceMessage(app *config.AppConfig, deviceID primitive.ObjectID, env mywebsocket.Envelope) bool {
+	if env.Type != mywebsocket.TypeCommandAck {
+		return false
+	}
+
+	cmdID, err := primitive.ObjectIDFromHex(env.ID)
+	if err != nil {
+		log.Printf("Dropping command ack with bad id from %s: %v", deviceID.Hex(), err)
+		return true
+	}
+	var ack command_models.DeviceAck
+	if len(env.Data) > 0 {
+		if err := json.Unmarshal(env.Data, &ack); err != nil {
+			log.Printf("Dropping malformed command ack from %s: %v", deviceID.Hex(), err)
+			return true
+		}
+	} else {
+		ack.OK = true
+	}
+
+	status := command_models.StatusAcked
+	if !ack.OK {
+		status = command_models.StatusFailed
+	}
+
+	mctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = commands(app).UpdateOne(mctx, bson.M{
+		"_id":       cmdID,
+		"device_id": deviceID,
+		"status":    bson.M{"$in": []string{command_models.StatusPending, command_models.StatusDelivered}},
+	}, bson.M{"$set": bson.M{
+		"status":   status,
+		"result":   ack.Result,
+		"acked_at": time.Now(),
+	}})
+	if err != nil {
+		log.Printf("Failed to record ack for command %s: %v", cmdID.Hex(), err)
+	}
+	return true
+}
+
+// EnqueueFromUser queues a "command" envelope received on a user's control
+// socket and returns the reply to send back to the user.
+func EnqueueFromUser(app *config.AppConfig, userID primitive.ObjectID, deviceHex string, env mywebsocket.Envelope) gin.H {
+	reply := func(msg string) gin.H {
+		return gin.H{"type": mywebsocket.TypeError, "id": env.ID, "data": gin.H{"error": msg}}
+	}
+
+	var msg command_models.UserCommandMessage
+	if err := json.Unmarshal(env.Data, &msg); err != nil {
+		return reply("malformed command: " + err.Error())
+	}
+	if err := app.Validator.Struct(msg); err != nil {
+		return reply(err.Error())
+	}
+	deviceID, err := primitive.ObjectIDFromHex(deviceHex)
+	if err != nil {
+		return reply("invalid device id")
+	}
+
+	mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ok, err := clan_controllers.IsMyClanDevice(mctx, app, userID, deviceID)
+	if err != nil {
+		return reply("failed to load device")
+	}
+	if !ok {
+		return reply("device is not in any of your clans")
+	}
+
+	cmd, err := Enqueue(mctx, app, deviceID, userID, msg.Command, msg.Payload, time.Duration(msg.TTLSeconds)*time.Second)
+	if err != nil {
+		return reply("failed to queue command")
+	}
+	return gin.H{
+		"type": mywebsocket.TypeCommandQueued,
+		"id":   cmd.ID.Hex(),
+		"data": gin.H{"ref": env.ID, "expires_at": cmd.ExpiresAt},
+	}
+}
+
+// StartDispatcher expires stale commands and resends unacked ones to the
+// devices connected to this node in the background. Safe to call more
+// than once. Mongo purges commands a week after they expire.
+func StartDispatcher(app *config.AppConfig) {
+	dispatcherOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(dispatchInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				dispatch(app)
+			}
+		}()
+	})
+}
+
+func dispatch(app *config.AppConfig) {
+	mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	_, err := commands(app).UpdateMany(mctx, bson.M{
+		"status":     bson.M{"$in": []string{command_models.StatusPending, command_models.StatusDelivered}},
+		"expires_at": bson.M{"$lte": now},
+	}, bson.M{"$set": bson.M{"status": command_models.StatusExpired}})
+	if err != nil {
+		log.Printf("Failed to expire commands: %v", err)
+	}
+
+	// each node resends to the cars connected to it
+	for _, id := range mywebsocket.LocalDevices() {
+		if deviceID, err := primitive.ObjectIDFromHex(id); err == nil {
+			deliverDue(app, deviceID, ackTimeout)
+		}
+	}
+}
+
+// EnqueueCommand queues a command for one of the user's clan devices.
+// POST /api/commands
+func EnqueueCommand(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req command_models.EnqueueRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+
+		deviceID, ok := clan_controllers.RequireMyClanDevice(mctx, ctx, app, req.DeviceID)
+		if !ok {
+			return
+		}
+		userDetails, err := common_controllers.GetMyId(mctx, ctx, app)
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		cmd, err := Enqueue(mctx, app, deviceID, userDetails.ID, req.Command, req.Payload, time.Duration(req.TTLSeconds)*time.Second)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to queue command", err.Error())
+			return
+		}
+		common_controllers.SuccessResponse(ctx, "Command queued", gin.H{
+			"id":         cmd.ID.Hex(),
+			"expires_at": cmd.ExpiresAt,
+		})
+	}
+}
+
+// ListCommands returns a device's commands, newest first, optionally by status.
+// GET /api/commands?device_id=&status=
+func ListCommands(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		deviceID, ok := clan_controllers.RequireMyClanDevice(mctx, ctx, app, ctx.Query("device_id"))
+		if !ok {
+			return
+		}
+
+		filter := bson.M{"device_id": deviceID}
+		if status := ctx.Query("status"); status != "" {
+			filter["status"] = status
+		}
+
+		cursor, err := commands(app).Find(mctx, filter, options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(200))
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to list commands", err.Error())
+			return
+		}
+		result := []command_models.Command{}
+		if err := cursor.All(mctx, &result); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to list commands", err.Error())
+			return
+		}
+
+		counts := map[string]int{
+			command_models.StatusPending:   0,
+			command_models.StatusDelivered: 0,
+			command_models.StatusAcked:     0,
+			command_models.StatusFailed:    0,
+			command_models.StatusExpired:   0,
+			command_models.StatusCancelled: 0,
+		}
+		cursor, err = commands(app).Aggregate(mctx, mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{"device_id": deviceID}}},
+			{{Key: "$group", Value: bson.M{"_id": "$status", "count": bson.M{"$sum": 1}}}},
+		})
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to count commands", err.Error())
+			return
+		}
+		var groups []struct {
+			Status string `bson:"_id"`
+			Count  int    `bson:"count"`
+		}
+		if err := cursor.All(mctx, &groups); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to count commands", err.Error())
+			return
+		}
+		for _, g := range groups {
+			counts[g.Status] = g.Count
+		}
+
+		common_controllers.SuccessResponse(ctx, "Device commands", gin.H{
+			"counts":   counts,
+			"commands": result,
+		})
+	}
+}
@@ -2,37 +2,39 @@ package common_controllers
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
+	"net"
 
 	"net/http"
-	"os"
+	"net/smtp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/chtan/miniworld/config"
 	models "github.com/chtan/miniworld/models/common"
 	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	// "go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var uploader *s3manager.Uploader
-
-func init() {
-	AWSSession()
-
-}
+var (
+	uploader   *s3manager.Uploader
+	s3Client   *s3.S3
+	bucketName string
+)
 
 func Generate_OTP() *int {
 
@@ -54,7 +56,38 @@ func CheckPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
-func SendMail(userMail string, message string) bool {
+// GenerateSecret returns n random bytes encoded as hex, for credentials handed to devices.
+func GenerateSecret(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SendMail sends message to userMail through the configured SMTP relay, or
+// only logs it under MAIL_LOG_ONLY. It reports whether the mail went out.
+func SendMail(app *config.AppConfig, userMail string, message string) bool {
+	mail := app.Settings.Mail
+	if mail.LogOnly {
+		log.Printf("Mail to %s (MAIL_LOG_ONLY, not sent): %s", userMail, message)
+		return true
+	}
+	if mail.Host == "" {
+		log.Printf("SMTP_HOST not set, can't mail %s", userMail)
+		return false
+	}
+
+	var auth smtp.Auth
+	if mail.Username != "" {
+		auth = smtp.PlainAuth("", mail.Username, mail.Password, mail.Host)
+	}
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Your miniworld code\r\n\r\n%s\r\n", mail.From, userMail, message)
+	addr := net.JoinHostPort(mail.Host, strconv.Itoa(mail.Port))
+	if err := smtp.SendMail(addr, auth, mail.From, []string{userMail}, []byte(body)); err != nil {
+		log.Printf("Failed to mail %s: %v", userMail, err)
+		return false
+	}
 	return true
 }
 
@@ -79,29 +112,19 @@ func GetMyId(mctx context.Context, ctx *gin.Context, app *config.AppConfig) (*mo
 		return &userDetails, err
 	}
 
-	filter := bson.M{
-		"access_token": token,
+	user, err := app.Repos.Users.ByAccessToken(mctx, token)
+	if err != nil {
+		return &userDetails, err
 	}
 
-	// // Define the projection to return specific fields
-	// opts := options.FindOne().SetProjection(bson.M{
-	// 	"user_id":          1,
-	// 	"first_name":       1,
-	// 	"last_name":        1,
-	// 	"email":            1,
-	// 	"profile_url":      1,
-	// 	"user_interests":   1,
-	// 	"user_looking_for": 1,
-	// 	"user_history":     1,
-	// 	"_id":              0,
-	// })
-
-	// Variable to store the result
-
-	// Execute the query
-	err = app.Client.Database("miniworld").Collection("users").FindOne(mctx, filter).Decode(&userDetails)
-
-	return &userDetails, err
+	userDetails.ID = user.ID
+	userDetails.FirstName = user.First_Name
+	userDetails.LastName = user.Last_Name
+	userDetails.Email = user.Email
+	if user.Profile_Url != nil {
+		userDetails.Profile = *user.Profile_Url
+	}
+	return &userDetails, nil
 }
 
 // Success response helper
@@ -160,7 +183,7 @@ func UploadUlalaImageAndReturnUrl(app *config.AppConfig) gin.HandlerFunc {
 func SaveFileToAWS(fileReader io.Reader, fileHeader *multipart.FileHeader, pathAndName string) (string, error) {
 	// Upload the file to S3 using the fileReader
 	_, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String("bucketName"),        // Ensure bucketName is set
+		Bucket: aws.String(bucketName),
 		Key:    aws.String(fileHeader.Filename), // Use the filename as the S3 object key
 		Body:   fileReader,
 	})
@@ -169,35 +192,73 @@ func SaveFileToAWS(fileReader io.Reader, fileHeader *multipart.FileHeader, pathA
 	}
 
 	// Return the URL of the uploaded file
-	url := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", "bucketName", pathAndName)
+	url := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", bucketName, pathAndName)
 	return url, nil
 }
 
-func AWSSession() {
-
-	envError := godotenv.Load()
-	if envError != nil {
-		log.Fatalf("Error loading .env file: %v", envError)
-	}
-
-	AWS_ACCESS_KEY := os.Getenv("AWS_ACCESS_KEY") // Access Key ID from IAM user
-	AWS_SECRET_KEY := os.Getenv("AWS_SECRET_KEY") // Secret Access Key from IAM user
+// SetupStorage opens the S3 session the object helpers use.
+func SetupStorage(app *config.AppConfig) error {
+	storage := app.Settings.Storage
 
 	aswSession, err := session.NewSessionWithOptions(session.Options{
 		Config: aws.Config{
-			Region: aws.String("eu-north-1"),
+			Region: aws.String(storage.Region),
 			Credentials: credentials.NewStaticCredentials(
-				AWS_ACCESS_KEY,
-				AWS_SECRET_KEY,
+				storage.AccessKey, // Access Key ID from IAM user
+				storage.SecretKey, // Secret Access Key from IAM user
 				"",
 			),
 		},
 	})
 	if err != nil {
-		panic(err)
+		return err
 	}
 
+	bucketName = storage.Bucket
 	uploader = s3manager.NewUploader(aswSession)
+	s3Client = s3.New(aswSession)
+	return nil
+}
+
+// SaveObject uploads body to the object store under key.
+func SaveObject(key string, body io.Reader, contentType string) error {
+	_, err := uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+// GetObject opens an object from the object store. The caller closes it.
+func GetObject(key string) (io.ReadCloser, error) {
+	out, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// DeleteObject removes key from the object store.
+func DeleteObject(key string) error {
+	_, err := s3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// PresignObjectURL returns a time-limited download URL for key.
+func PresignObjectURL(key string, expiry time.Duration) (string, error) {
+	req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	return req.Presign(expiry)
 }
 func ToObjectID(id string) (primitive.ObjectID, error) {
 	objID, err := primitive.ObjectIDFromHex(id)
@@ -7,10 +7,9 @@ import (
 
 	"github.com/chtan/miniworld/config"
 	common_controllers "github.com/chtan/miniworld/controllers/common"
-	device_models "github.com/chtan/miniworld/models/device"
+	"github.com/chtan/miniworld/repository"
 	"github.com/chtan/miniworld/token"
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -25,16 +24,20 @@ func LogIn(app *config.AppConfig) gin.HandlerFunc {
 			return
 		}
 
-		var device device_models.Device
 		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
-		err := app.Client.Database("miniworld").Collection("devices").FindOne(mctx, bson.M{"_id": device_request.ID}).Decode(&device)
+		device, err := app.Repos.Devices.Get(mctx, device_request.ID)
 		if err != nil {
 			common_controllers.ErrorResponse(ctx, http.StatusUnauthorized, "Invalid credentials", err.Error())
 			return
 		}
 
+		if device.Revoked {
+			common_controllers.ErrorResponse(ctx, http.StatusUnauthorized, "Invalid credentials", "Device credentials revoked")
+			return
+		}
+
 		if !common_controllers.CheckPasswordHash(device_request.Password, device.Password) {
 			common_controllers.ErrorResponse(ctx, http.StatusUnauthorized, "Invalid credentials", "Password Not Matched")
 			return
@@ -47,28 +50,12 @@ func LogIn(app *config.AppConfig) gin.HandlerFunc {
 		}
 
 		// Update tokens in the database
-		_, err = app.Client.Database("miniworld").Collection("devices").UpdateOne(
-			mctx,
-			bson.M{"_id": device.ID},
-			bson.M{"$set": bson.M{
-				"access_token":  tokenPair.AccessToken,
-				"refresh_token": tokenPair.RefreshToken,
-				"updated_at":    time.Now(),
-				"is_online":     true,
-				"revoked":       false,
-			}},
-		)
+		err = app.Repos.Sessions.Issue(mctx, repository.DeviceSessions, device.ID, tokenPair)
 		if err != nil {
 			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to update tokens", err.Error())
 			return
 		}
 
-		err = IAMOnline(app, device_request.ID, true)
-		if err != nil {
-			common_controllers.ErrorResponse(ctx, http.StatusUnauthorized, "Invalid credentials", err.Error())
-			return
-
-		}
 		common_controllers.SuccessResponse(ctx, "Signed In Successfully", gin.H{
 			"access_token":  tokenPair.AccessToken,
 			"refresh_token": tokenPair.RefreshToken,
@@ -0,0 +1,296 @@
+package device_controllers
+
+import (
+	"context"
+	"crypto/x509"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	common_controllers "github.com/chtan/miniworld/controllers/common"
+	device_models "github.com/chtan/miniworld/models/device"
+	"github.com/chtan/miniworld/mywebsocket"
+	"github.com/chtan/miniworld/pki"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuthenticateDevice identifies the device behind a websocket handshake.
+// A verified client certificate wins; otherwise the bearer token is used,
+// unless the server runs in mtls-only mode.
+func AuthenticateDevice(mctx context.Context, ctx *gin.Context, app *config.AppConfig) (*device_models.Device, string) {
+	if app.DeviceAuthMode != "token" {
+		if tlsState := ctx.Request.TLS; tlsState != nil && len(tlsState.VerifiedChains) > 0 {
+			return getDeviceByCert(mctx, app, tlsState.VerifiedChains[0][0])
+		}
+		if app.DeviceAuthMode == "mtls" {
+			return nil, "client certificate required"
+		}
+	}
+
+	clientToken, err := common_controllers.GetMyToken(ctx)
+	if err != nil {
+		return nil, err.Error()
+	}
+	return GetDeviceDetails(mctx, app, clientToken)
+}
+
+func getDeviceByCert(mctx context.Context, app *config.AppConfig, cert *x509.Certificate) (*device_models.Device, string) {
+	deviceID, err := primitive.ObjectIDFromHex(cert.Subject.CommonName)
+	if err != nil {
+		return nil, "certificate subject is not a device id"
+	}
+
+	var record device_models.DeviceCert
+	err = app.Client.Database("miniworld").Collection("deviceCerts").FindOne(mctx, bson.M{
+		"_id":       pki.SerialHex(cert.SerialNumber),
+		"device_id": deviceID,
+	}).Decode(&record)
+	if err != nil {
+		return nil, "certificate not recognised"
+	}
+	if record.Revoked {
+		return nil, "certificate revoked"
+	}
+
+	device, err := app.Repos.Devices.Get(mctx, deviceID)
+	if err != nil {
+		return nil, err.Error()
+	}
+	if device.Revoked {
+		return nil, "device revoked"
+	}
+	return &device_models.Device{ID: device.ID, ClanID: device.ClanID}, ""
+}
+
+// RevokeDeviceCerts marks every certificate issued to the device as revoked.
+func RevokeDeviceCerts(mctx context.Context, app *config.AppConfig, deviceID primitive.ObjectID) error {
+	now := time.Now()
+	_, err := app.Client.Database("miniworld").Collection("deviceCerts").UpdateMany(
+		mctx,
+		bson.M{"device_id": deviceID, "revoked": false},
+		bson.M{"$set": bson.M{"revoked": true, "revoked_at": now}},
+	)
+	return err
+}
+
+// IssueDeviceCert signs a client certificate for one of the admin's devices.
+// The private key is only returned in this response.
+func IssueDeviceCert(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		device, ok := loadAdminDevice(mctx, ctx, app)
+		if !ok {
+			return
+		}
+
+		ca, err := pki.DeviceCA(app)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Certificate authority unavailable", err.Error())
+			return
+		}
+
+		cert, certPEM, keyPEM, err := ca.IssueDeviceCert(device.ID.Hex())
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to issue certificate", err.Error())
+			return
+		}
+
+		record := device_models.DeviceCert{
+			Serial:    pki.SerialHex(cert.SerialNumber),
+			DeviceID:  device.ID,
+			AdminID:   device.AdminID,
+			CertPEM:   string(certPEM),
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+			CreatedAt: time.Now(),
+		}
+		if _, err := app.Client.Database("miniworld").Collection("deviceCerts").InsertOne(mctx, record); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to save certificate", err.Error())
+			return
+		}
+
+		common_controllers.SuccessResponse(ctx, "Certificate issued", gin.H{
+			"serial":         record.Serial,
+			"device_id":      device.ID.Hex(),
+			"certificate":    string(certPEM),
+			"private_key":    string(keyPEM),
+			"ca_certificate": string(ca.CertPEM),
+			"not_after":      record.NotAfter,
+		})
+	}
+}
+
+// ListDeviceCerts returns the certificates issued to one of the admin's devices.
+func ListDeviceCerts(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		deviceID, err := primitive.ObjectIDFromHex(ctx.Query("device_id"))
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid device_id", err.Error())
+			return
+		}
+
+		userDetails, err := common_controllers.GetMyId(mctx, ctx, app)
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		cursor, err := app.Client.Database("miniworld").Collection("deviceCerts").Find(
+			mctx,
+			bson.M{"device_id": deviceID, "admin_id": userDetails.ID},
+			options.Find().SetSort(bson.M{"created_at": -1}),
+		)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to list certificates", err.Error())
+			return
+		}
+		certs := []device_models.DeviceCert{}
+		if err := cursor.All(mctx, &certs); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to list certificates", err.Error())
+			return
+		}
+
+		common_controllers.SuccessResponse(ctx, "Device certificates", certs)
+	}
+}
+
+// DownloadDeviceCert serves a certificate as a PEM file.
+func DownloadDeviceCert(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		userDetails, err := common_controllers.GetMyId(mctx, ctx, app)
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		var record device_models.DeviceCert
+		err = app.Client.Database("miniworld").Collection("deviceCerts").FindOne(mctx, bson.M{
+			"_id":      ctx.Query("serial"),
+			"admin_id": userDetails.ID,
+		}).Decode(&record)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				common_controllers.ErrorResponse(ctx, http.StatusNotFound, "Certificate not found", err.Error())
+				return
+			}
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load certificate", err.Error())
+			return
+		}
+
+		ctx.Header("Content-Disposition", "attachment; filename="+record.DeviceID.Hex()+".crt")
+		ctx.Data(http.StatusOK, "application/x-pem-file", []byte(record.CertPEM))
+	}
+}
+
+// RevokeDeviceCert revokes a single certificate and drops the device's sockets.
+func RevokeDeviceCert(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req device_models.CertSerialRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+
+		userDetails, err := common_controllers.GetMyId(mctx, ctx, app)
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		var record device_models.DeviceCert
+		err = app.Client.Database("miniworld").Collection("deviceCerts").FindOneAndUpdate(
+			mctx,
+			bson.M{"_id": req.Serial, "admin_id": userDetails.ID},
+			bson.M{"$set": bson.M{"revoked": true, "revoked_at": time.Now()}},
+		).Decode(&record)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				common_controllers.ErrorResponse(ctx, http.StatusNotFound, "Certificate not found", err.Error())
+				return
+			}
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to revoke certificate", err.Error())
+			return
+		}
+
+		mywebsocket.DisconnectDevice(record.DeviceID.Hex(), mywebsocket.CloseCredentialsRevoked, "certificate revoked")
+
+		common_controllers.SuccessResponse(ctx, "Certificate revoked", gin.H{"serial": record.Serial})
+	}
+}
+
+// GetDeviceCA serves the CA certificate devices use to build their trust chain.
+func GetDeviceCA(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ca, err := pki.DeviceCA(app)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Certificate authority unavailable", err.Error())
+			return
+		}
+		ctx.Data(http.StatusOK, "application/x-pem-file", ca.CertPEM)
+	}
+}
+
+// GetDeviceCRL serves a freshly signed revocation list of every revoked device certificate.
+func GetDeviceCRL(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		ca, err := pki.DeviceCA(app)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Certificate authority unavailable", err.Error())
+			return
+		}
+
+		cursor, err := app.Client.Database("miniworld").Collection("deviceCerts").Find(
+			mctx,
+			bson.M{"revoked": true, "not_after": bson.M{"$gt": time.Now()}},
+			options.Find().SetProjection(bson.M{"_id": 1, "revoked_at": 1}),
+		)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load revocations", err.Error())
+			return
+		}
+		var records []device_models.DeviceCert
+		if err := cursor.All(mctx, &records); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load revocations", err.Error())
+			return
+		}
+
+		entries := make([]x509.RevocationListEntry, 0, len(records))
+		for _, r := range records {
+			serial, ok := new(big.Int).SetString(r.Serial, 16)
+			if !ok {
+				continue
+			}
+			revokedAt := time.Now()
+			if r.RevokedAt != nil {
+				revokedAt = *r.RevokedAt
+			}
+			entries = append(entries, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: revokedAt})
+		}
+
+		crl, err := ca.RevocationList(entries)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to sign revocation list", err.Error())
+			return
+		}
+		ctx.Data(http.StatusOK, "application/pkix-crl", crl)
+	}
+}
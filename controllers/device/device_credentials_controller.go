@@ -0,0 +1,177 @@
+package device_controllers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	common_controllers "github.com/chtan/miniworld/controllers/common"
+	device_models "github.com/chtan/miniworld/models/device"
+	"github.com/chtan/miniworld/mywebsocket"
+	"github.com/chtan/miniworld/repository"
+	"github.com/chtan/miniworld/token"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// GetMyDevice loads a device only if the user is its admin.
+func GetMyDevice(mctx context.Context, app *config.AppConfig, deviceID, adminID primitive.ObjectID) (*device_models.Device, error) {
+	device, err := app.Repos.Devices.GetOwned(mctx, deviceID, adminID)
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// loadAdminDevice binds the request, checks ownership and writes the error response itself.
+func loadAdminDevice(mctx context.Context, ctx *gin.Context, app *config.AppConfig) (*device_models.Device, bool) {
+	var req device_models.DeviceIDRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+		return nil, false
+	}
+
+	userDetails, err := common_controllers.GetMyId(mctx, ctx, app)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+
+	device, err := GetMyDevice(mctx, app, req.ID, userDetails.ID)
+	if err != nil {
+		if err == repository.ErrNotFound {
+			common_controllers.ErrorResponse(ctx, http.StatusNotFound, "Device not found", "You are not the admin of this device")
+			return nil, false
+		}
+		common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load device", err.Error())
+		return nil, false
+	}
+	return device, true
+}
+
+// RotateDeviceCredentials gives the device a new password, invalidates its
+// tokens and certificates and drops its live sockets. It returns the new password.
+func RotateDeviceCredentials(mctx context.Context, app *config.AppConfig, deviceID primitive.ObjectID) (string, error) {
+	secret, err := common_controllers.GenerateSecret(32)
+	if err != nil {
+		return "", err
+	}
+	password, err := common_controllers.HashPassword(secret)
+	if err != nil {
+		return "", err
+	}
+
+	if err := app.Repos.Devices.SetPassword(mctx, deviceID, password); err != nil {
+		return "", err
+	}
+	if err := RevokeDeviceCerts(mctx, app, deviceID); err != nil {
+		return "", err
+	}
+
+	mywebsocket.DisconnectDevice(deviceID.Hex(), mywebsocket.CloseCredentialsRevoked, "credentials rotated")
+	return secret, nil
+}
+
+// RotateCredentials replaces the device password, invalidates its tokens and
+// drops its live sockets. The new password is returned once.
+func RotateCredentials(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		device, ok := loadAdminDevice(mctx, ctx, app)
+		if !ok {
+			return
+		}
+
+		secret, err := RotateDeviceCredentials(mctx, app, device.ID)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to rotate credentials", err.Error())
+			return
+		}
+
+		common_controllers.SuccessResponse(ctx, "Credentials rotated", gin.H{
+			"id":       device.ID.Hex(),
+			"password": secret,
+		})
+	}
+}
+
+// RevokeDevice blocks the device from logging in or connecting until its
+// credentials are rotated again.
+func RevokeDevice(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		device, ok := loadAdminDevice(mctx, ctx, app)
+		if !ok {
+			return
+		}
+
+		err := app.Repos.Sessions.Revoke(mctx, repository.DeviceSessions, device.ID)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to revoke device", err.Error())
+			return
+		}
+		if err := RevokeDeviceCerts(mctx, app, device.ID); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to revoke certificates", err.Error())
+			return
+		}
+
+		mywebsocket.DisconnectDevice(device.ID.Hex(), mywebsocket.CloseCredentialsRevoked, "credentials revoked")
+
+		common_controllers.SuccessResponse(ctx, "Device revoked", gin.H{"id": device.ID.Hex()})
+	}
+}
+
+// RefreshToken lets a device swap its refresh token for a new pair without
+// its password. Each refresh token can be used once.
+func RefreshToken(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req struct {
+			RefreshToken string `json:"refresh_token" binding:"required"`
+		}
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+
+		if _, err := token.ValidateToken(req.RefreshToken, app); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusUnauthorized, "Token Error", "invalid or expired refresh token")
+			return
+		}
+
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		device, err := app.Repos.Devices.ByRefreshToken(mctx, req.RefreshToken)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusUnauthorized, "Token Error", "refresh token not found or revoked")
+			return
+		}
+
+		tokenPair, err := token.GenerateTokenPair(device.ID.Hex(), device.AdminID, app)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to generate tokens", err.Error())
+			return
+		}
+
+		// Rotating only the old refresh token makes concurrent refreshes race safely.
+		err = app.Repos.Sessions.Rotate(mctx, repository.DeviceSessions, req.RefreshToken, tokenPair)
+		if err == repository.ErrNotFound {
+			common_controllers.ErrorResponse(ctx, http.StatusUnauthorized, "Token Error", "refresh token already used")
+			return
+		}
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to update tokens", err.Error())
+			return
+		}
+
+		common_controllers.SuccessResponse(ctx, "Token refreshed", gin.H{
+			"access_token":  tokenPair.AccessToken,
+			"refresh_token": tokenPair.RefreshToken,
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package device_controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	common_controllers "github.com/chtan/miniworld/controllers/common"
+	device_models "github.com/chtan/miniworld/models/device"
+	"github.com/chtan/miniworld/repository"
+	"github.com/chtan/miniworld/token"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	PairingCodeTTL    = 10 * time.Minute
+	pairingCodeLength = 8
+	// no 0/O or 1/I so codes survive being read aloud or typed on a car
+	pairingAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+func generatePairingCode() (string, error) {
+	code := make([]byte, pairingCodeLength)
+	max := big.NewInt(int64(len(pairingAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = pairingAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// CreatePairingCode stores a new single-use pairing code for the admin's clan.
+func CreatePairingCode(mctx context.Context, app *config.AppConfig, adminID, clanID primitive.ObjectID, color string) (device_models.PairingCode, error) {
+	coll := app.Client.Database("miniworld").Collection("pairingCodes")
+
+	code, err := generatePairingCode()
+	if err != nil {
+		return device_models.PairingCode{}, err
+	}
+
+	pairing := device_models.PairingCode{
+		ID:        primitive.NewObjectID(),
+		Code:      code,
+		ClanID:    clanID,
+		AdminID:   adminID,
+		Color:     color,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(PairingCodeTTL),
+	}
+
+	if _, err := coll.InsertOne(mctx, pairing); err != nil {
+		return device_models.PairingCode{}, err
+	}
+	return pairing, nil
+}
+
+// PairDevice exchanges a pairing code for a new device and its credential.
+// The code is consumed on first use, even if a later step fails.
+func PairDevice(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req device_models.PairDeviceRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var pairing device_models.PairingCode
+		err := app.Client.Database("miniworld").Collection("pairingCodes").FindOneAndDelete(mctx, bson.M{
+			"code":       req.Code,
+			"expires_at": bson.M{"$gt": time.Now()},
+		}).Decode(&pairing)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				common_controllers.ErrorResponse(ctx, http.StatusUnauthorized, "Invalid pairing code", "Code not found or expired")
+				return
+			}
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to read pairing code", err.Error())
+			return
+		}
+
+		secret, err := common_controllers.GenerateSecret(32)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to generate credential", err.Error())
+			return
+		}
+		password, err := common_controllers.HashPassword(secret)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Error In Hashing", err.Error())
+			return
+		}
+
+		device, err := RegisterDevice(mctx, app, pairing.AdminID, device_models.Device{
+			ClanID:   pairing.ClanID,
+			Color:    pairing.Color,
+			Password: password,
+		})
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to register device", err.Error())
+			return
+		}
+
+		tokenPair, err := token.GenerateTokenPair(device.ID.Hex(), device.AdminID, app)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to generate tokens", err.Error())
+			return
+		}
+
+		err = app.Repos.Sessions.Issue(mctx, repository.DeviceSessions, device.ID, tokenPair)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to update tokens", err.Error())
+			return
+		}
+
+		// The secret is only ever returned here; the car keeps it for /dlogin.
+		common_controllers.SuccessResponse(ctx, "Device paired successfully", gin.H{
+			"id":            device.ID.Hex(),
+			"clan_id":       device.ClanID.Hex(),
+			"password":      secret,
+			"access_token":  tokenPair.AccessToken,
+			"refresh_token": tokenPair.RefreshToken,
+		})
+	}
+}
@@ -0,0 +1,629 @@
+package firmware_controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	clan_controllers "github.com/chtan/miniworld/controllers/clan"
+	command_controllers "github.com/chtan/miniworld/controllers/command"
+	common_controllers "github.com/chtan/miniworld/controllers/common"
+	device_models "github.com/chtan/miniworld/models/device"
+	firmware_models "github.com/chtan/miniworld/models/firmware"
+	"github.com/chtan/miniworld/mywebsocket"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	CommandFirmwareUpdate = "firmware_update"
+
+	maxFirmwareSize = 64 << 20
+	// offers and their download links stay valid this long
+	offerTTL = 24 * time.Hour
+)
+
+func collection(app *config.AppConfig, name string) *mongo.Collection {
+	return app.Client.Database("miniworld").Collection(name)
+}
+
+// UploadFirmware stores a signed firmware binary for one of the user's clans.
+// POST /api/firmware (multipart: file, clan_id, version, signature, notes)
+func UploadFirmware(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		defer cancel()
+
+		if app.FirmwarePublicKey == nil {
+			common_controllers.ErrorResponse(ctx, http.StatusServiceUnavailable, "Firmware uploads disabled", "FIRMWARE_PUBLIC_KEY is not configured")
+			return
+		}
+
+		clanID, err := primitive.ObjectIDFromHex(ctx.PostForm("clan_id"))
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid clan_id", err.Error())
+			return
+		}
+		version := ctx.PostForm("version")
+		if version == "" || len(version) > 64 {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid version", "version is required and at most 64 characters")
+			return
+		}
+		signature, err := base64.StdEncoding.DecodeString(ctx.PostForm("signature"))
+		if err != nil || len(signature) != ed25519.SignatureSize {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid signature", "signature must be a base64 ed25519 signature")
+			return
+		}
+
+		userDetails, err := common_controllers.GetMyId(mctx, ctx, app)
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		if _, err := clan_controllers.GetMyClan(mctx, app, clanID, userDetails.ID); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusForbidden, "Clan not found", "You are not the admin of this clan")
+			return
+		}
+
+		file, _, err := ctx.Request.FormFile("file")
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Error retrieving file", err.Error())
+			return
+		}
+		defer file.Close()
+
+		binary, err := io.ReadAll(io.LimitReader(file, maxFirmwareSize+1))
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Error reading file", err.Error())
+			return
+		}
+		if len(binary) > maxFirmwareSize {
+			common_controllers.ErrorResponse(ctx, http.StatusRequestEntityTooLarge, "Firmware too large", fmt.Sprintf("limit is %d bytes", maxFirmwareSize))
+			return
+		}
+		if !ed25519.Verify(app.FirmwarePublicKey, binary, signature) {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid signature", "signature does not match the firmware")
+			return
+		}
+
+		count, err := collection(app, "firmware").CountDocuments(mctx, bson.M{"clan_id": clanID, "version": version})
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to check version", err.Error())
+			return
+		}
+		if count > 0 {
+			common_controllers.ErrorResponse(ctx, http.StatusConflict, "Version already exists", version)
+			return
+		}
+
+		sum := sha256.Sum256(binary)
+		fw := firmware_models.Firmware{
+			ID:         primitive.NewObjectID(),
+			ClanID:     clanID,
+			Version:    version,
+			Notes:      ctx.PostForm("notes"),
+			Size:       int64(len(binary)),
+			SHA256:     hex.EncodeToString(sum[:]),
+			Signature:  base64.StdEncoding.EncodeToString(signature),
+			UploadedBy: userDetails.ID,
+			CreatedAt:  time.Now(),
+		}
+		fw.ObjectKey = fmt.Sprintf("firmware/%s/%s.bin", clanID.Hex(), fw.ID.Hex())
+
+		if err := common_controllers.SaveObject(fw.ObjectKey, bytes.NewReader(binary), "application/octet-stream"); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to store firmware", err.Error())
+			return
+		}
+		if _, err := collection(app, "firmware").InsertOne(mctx, fw); err != nil {
+			if err := common_controllers.DeleteObject(fw.ObjectKey); err != nil {
+				log.Printf("Failed to remove orphaned firmware %s: %v", fw.ObjectKey, err)
+			}
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to save firmware", err.Error())
+			return
+		}
+
+		common_controllers.SuccessResponse(ctx, "Firmware uploaded", fw)
+	}
+}
+
+// ListFirmware returns the firmware uploaded for one of the user's clans.
+// GET /api/firmware?clan_id=
+func ListFirmware(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		clanID, err := primitive.ObjectIDFromHex(ctx.Query("clan_id"))
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid clan_id", err.Error())
+			return
+		}
+		userDetails, err := common_controllers.GetMyId(mctx, ctx, app)
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		if _, err := clan_controllers.GetMyClan(mctx, app, clanID, userDetails.ID); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusForbidden, "Clan not found", "You are not the admin of this clan")
+			return
+		}
+
+		cursor, err := collection(app, "firmware").Find(mctx, bson.M{"clan_id": clanID}, options.Find().SetSort(bson.M{"created_at": -1}))
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to list firmware", err.Error())
+			return
+		}
+		result := []firmware_models.Firmware{}
+		if err := cursor.All(mctx, &result); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to list firmware", err.Error())
+			return
+		}
+		common_controllers.SuccessResponse(ctx, "Firmware", result)
+	}
+}
+
+// SetDeviceChannel moves a device onto a release channel.
+// POST /api/firmware/channel
+func SetDeviceChannel(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req firmware_models.SetChannelRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		deviceID, ok := clan_controllers.RequireMyClanDevice(mctx, ctx, app, req.DeviceID.Hex())
+		if !ok {
+			return
+		}
+
+		if err := app.Repos.Devices.SetFirmwareChannel(mctx, deviceID, req.Channel); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to set channel", err.Error())
+			return
+		}
+		common_controllers.SuccessResponse(ctx, "Channel updated", gin.H{"device_id": deviceID.Hex(), "channel": req.Channel})
+	}
+}
+
+// offer queues a firmware_update command for the device and returns its id.
+func offer(mctx context.Context, app *config.AppConfig, deviceID, issuedBy, releaseID primitive.ObjectID, fw firmware_models.Firmware, rollback bool) (primitive.ObjectID, error) {
+	url, err := common_controllers.PresignObjectURL(fw.ObjectKey, offerTTL)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	cmd, err := command_controllers.Enqueue(mctx, app, deviceID, issuedBy, CommandFirmwareUpdate, firmware_models.UpdateOffer{
+		ReleaseID:  releaseID.Hex(),
+		FirmwareID: fw.ID.Hex(),
+		Version:    fw.Version,
+		URL:        url,
+		Size:       fw.Size,
+		SHA256:     fw.SHA256,
+		Signature:  fw.Signature,
+		Rollback:   rollback,
+	}, offerTTL)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return cmd.ID, nil
+}
+
+// TargetDevices returns the clan's devices on the channel, narrowed to
+// deviceIDs when any are given.
+func TargetDevices(mctx context.Context, app *config.AppConfig, clanID primitive.ObjectID, channel string, deviceIDs []primitive.ObjectID) ([]device_models.Device, error) {
+	return app.Repos.Devices.ListOnChannel(mctx, clanID, channel, deviceIDs)
+}
+
+// StartRelease records a release and offers the firmware to each target device.
+// groupID is set when the release was assigned to a device group.
+func StartRelease(mctx context.Context, app *config.AppConfig, userID primitive.ObjectID, fw firmware_models.Firmware, channel string, groupID primitive.ObjectID, devices []device_models.Device) (firmware_models.Release, []firmware_models.Rollout, error) {
+	release := firmware_models.Release{
+		ID:         primitive.NewObjectID(),
+		FirmwareID: fw.ID,
+		Version:    fw.Version,
+		ClanID:     fw.ClanID,
+		Channel:    channel,
+		GroupID:    groupID,
+		DeviceIDs:  make([]primitive.ObjectID, 0, len(devices)),
+		Status:     firmware_models.ReleaseActive,
+		CreatedBy:  userID,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+	}
+	for _, d := range devices {
+		release.DeviceIDs = append(release.DeviceIDs, d.ID)
+	}
+	if _, err := collection(app, "firmwareReleases").InsertOne(mctx, release); err != nil {
+		return release, nil, err
+	}
+
+	rollouts := make([]firmware_models.Rollout, 0, len(devices))
+	docs := make([]interface{}, 0, len(devices))
+	for _, d := range devices {
+		rollout := firmware_models.Rollout{
+			ID:             primitive.NewObjectID(),
+			ReleaseID:      release.ID,
+			DeviceID:       d.ID,
+			FromFirmwareID: d.FirmwareID,
+			Status:         firmware_models.RolloutOffered,
+			UpdatedAt:      time.Now(),
+		}
+		if d.FirmwareID == fw.ID {
+			rollout.Status = firmware_models.RolloutSkipped
+			rollout.Error = "already running this firmware"
+		} else if cmdID, err := offer(mctx, app, d.ID, userID, release.ID, fw, false); err != nil {
+			rollout.Status = firmware_models.RolloutFailed
+			rollout.Error = err.Error()
+		} else {
+			rollout.CommandID = cmdID
+		}
+		rollouts = append(rollouts, rollout)
+		docs = append(docs, rollout)
+	}
+	if len(docs) > 0 {
+		if _, err := collection(app, "firmwareRollouts").InsertMany(mctx, docs); err != nil {
+			return release, rollouts, err
+		}
+	}
+	return release, rollouts, nil
+}
+
+// LoadMyFirmware loads a firmware only if the user administers its clan.
+func LoadMyFirmware(mctx context.Context, app *config.AppConfig, firmwareID, userID primitive.ObjectID) (firmware_models.Firmware, error) {
+	var fw firmware_models.Firmware
+	if err := collection(app, "firmware").FindOne(mctx, bson.M{"_id": firmwareID}).Decode(&fw); err != nil {
+		return fw, err
+	}
+	if _, err := clan_controllers.GetMyClan(mctx, app, fw.ClanID, userID); err != nil {
+		return fw, err
+	}
+	return fw, nil
+}
+
+// CreateRelease rolls a firmware out to a clan's devices on a channel.
+// POST /api/firmware/release
+func CreateRelease(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		defer cancel()
+
+		var req firmware_models.CreateReleaseRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		userDetails, err := common_controllers.GetMyId(mctx, ctx, app)
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		fw, err := LoadMyFirmware(mctx, app, req.FirmwareID, userDetails.ID)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusNotFound, "Firmware not found", err.Error())
+			return
+		}
+
+		devices, err := TargetDevices(mctx, app, fw.ClanID, req.Channel, req.DeviceIDs)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load devices", err.Error())
+			return
+		}
+		if len(devices) == 0 {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "No target devices", "no devices in the clan match this channel")
+			return
+		}
+
+		release, rollouts, err := StartRelease(mctx, app, userDetails.ID, fw, req.Channel, primitive.NilObjectID, devices)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to start release", err.Error())
+			return
+		}
+		common_controllers.SuccessResponse(ctx, "Release started", gin.H{
+			"release":  release,
+			"rollouts": rollouts,
+		})
+	}
+}
+
+// loadMyRelease loads a release only if the user administers its clan.
+func loadMyRelease(mctx context.Context, app *config.AppConfig, releaseID, userID primitive.ObjectID) (firmware_models.Release, error) {
+	var release firmware_models.Release
+	if err := collection(app, "firmwareReleases").FindOne(mctx, bson.M{"_id": releaseID}).Decode(&release); err != nil {
+		return release, err
+	}
+	if _, err := clan_controllers.GetMyClan(mctx, app, release.ClanID, userID); err != nil {
+		return release, err
+	}
+	return release, nil
+}
+
+// GetRollout returns a release with per-device status and totals.
+// GET /api/firmware/rollout?release_id=
+func GetRollout(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		releaseID, err := primitive.ObjectIDFromHex(ctx.Query("release_id"))
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid release_id", err.Error())
+			return
+		}
+		userDetails, err := common_controllers.GetMyId(mctx, ctx, app)
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		release, err := loadMyRelease(mctx, app, releaseID, userDetails.ID)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusNotFound, "Release not found", err.Error())
+			return
+		}
+
+		cursor, err := collection(app, "firmwareRollouts").Find(mctx, bson.M{"release_id": release.ID})
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load rollout", err.Error())
+			return
+		}
+		rollouts := []firmware_models.Rollout{}
+		if err := cursor.All(mctx, &rollouts); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load rollout", err.Error())
+			return
+		}
+
+		counts := map[string]int{}
+		for _, r := range rollouts {
+			counts[r.Status]++
+		}
+		common_controllers.SuccessResponse(ctx, "Rollout status", gin.H{
+			"release":  release,
+			"counts":   counts,
+			"rollouts": rollouts,
+		})
+	}
+}
+
+// RollbackRelease withdraws undelivered offers and sends every updated device
+// back to the firmware it ran before the release.
+// POST /api/firmware/rollback
+func RollbackRelease(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		defer cancel()
+
+		var req firmware_models.ReleaseIDRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		userDetails, err := common_controllers.GetMyId(mctx, ctx, app)
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		release, err := loadMyRelease(mctx, app, req.ReleaseID, userDetails.ID)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusNotFound, "Release not found", err.Error())
+			return
+		}
+		if release.Status == firmware_models.ReleaseRolledBack {
+			common_controllers.ErrorResponse(ctx, http.StatusConflict, "Release already rolled back", release.ID.Hex())
+			return
+		}
+
+		cursor, err := collection(app, "firmwareRollouts").Find(mctx, bson.M{"release_id": release.ID})
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load rollout", err.Error())
+			return
+		}
+		var rollouts []firmware_models.Rollout
+		if err := cursor.All(mctx, &rollouts); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load rollout", err.Error())
+			return
+		}
+
+		// stop offers the cars haven't acted on yet
+		commandIDs := make([]primitive.ObjectID, 0, len(rollouts))
+		for _, r := range rollouts {
+			if !r.CommandID.IsZero() {
+				commandIDs = append(commandIDs, r.CommandID)
+			}
+		}
+		withdrawn, err := command_controllers.Cancel(mctx, app, commandIDs)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to withdraw offers", err.Error())
+			return
+		}
+
+		previous := map[primitive.ObjectID]firmware_models.Firmware{}
+		for _, r := range rollouts {
+			status, errMsg := rollbackStatus(r, withdrawn[r.CommandID])
+			var cmdID primitive.ObjectID
+			if status == firmware_models.RolloutRollingBack {
+				fw, ok := previous[r.FromFirmwareID]
+				if !ok {
+					if err := collection(app, "firmware").FindOne(mctx, bson.M{"_id": r.FromFirmwareID}).Decode(&fw); err == nil {
+						previous[r.FromFirmwareID] = fw
+						ok = true
+					}
+				}
+				if !ok {
+					status, errMsg = firmware_models.RolloutFailed, "previous firmware not found"
+				} else if cmdID, err = offer(mctx, app, r.DeviceID, userDetails.ID, release.ID, fw, true); err != nil {
+					status, errMsg = firmware_models.RolloutFailed, err.Error()
+				}
+			}
+
+			_, err := collection(app, "firmwareRollouts").UpdateOne(mctx, bson.M{"_id": r.ID}, bson.M{"$set": bson.M{
+				"status":     status,
+				"error":      errMsg,
+				"command_id": cmdID,
+				"updated_at": time.Now(),
+			}})
+			if err != nil {
+				log.Printf("Failed to update rollout %s: %v", r.ID.Hex(), err)
+			}
+		}
+
+		_, err = collection(app, "firmwareReleases").UpdateOne(mctx, bson.M{"_id": release.ID}, bson.M{"$set": bson.M{
+			"status":     firmware_models.ReleaseRolledBack,
+			"updated_at": time.Now(),
+		}})
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to update release", err.Error())
+			return
+		}
+		common_controllers.SuccessResponse(ctx, "Release rolled back", gin.H{"release_id": release.ID.Hex()})
+	}
+}
+
+// rollbackStatus decides what a device needs when its release is rolled
+// back. withdrawn says whether the rollback cancelled the device's offer.
+func rollbackStatus(r firmware_models.Rollout, withdrawn bool) (string, string) {
+	switch r.Status {
+	case firmware_models.RolloutSkipped, firmware_models.RolloutRolledBack, firmware_models.RolloutFailed:
+		// a failed install leaves the car on the image it had
+		return r.Status, r.Error
+	case firmware_models.RolloutOffered:
+		if withdrawn {
+			// the car never took the offer
+			return firmware_models.RolloutRolledBack, ""
+		}
+		// it acked before the cancel landed and may be installing: send it back
+	}
+	if r.FromFirmwareID.IsZero() {
+		return firmware_models.RolloutFailed, "no previous firmware recorded"
+	}
+	return firmware_models.RolloutRollingBack, ""
+}
+
+// HandleDeviceMessage moves the car's rollout along on "firmware_status"
+// and notes its running image on "firmware_info". A successful install,
+// including one that completes a rollback, updates the firmware on record.
+func HandleDeviceMessage(app *config.AppConfig, deviceID primitive.ObjectID, env mywebsocket.Envelope) bool {
+	switch env.Type {
+	case mywebsocket.TypeFirmwareStatus:
+	case mywebsocket.TypeFirmwareInfo:
+		recordCurrentFirmware(app, deviceID, env)
+		return true
+	default:
+		return false
+	}
+
+	var msg firmware_models.DeviceStatus
+	if err := json.Unmarshal(env.Data, &msg); err != nil {
+		log.Printf("Dropping malformed firmware status from %s: %v", deviceID.Hex(), err)
+		return true
+	}
+	releaseID, err := primitive.ObjectIDFromHex(msg.ReleaseID)
+	if err != nil {
+		log.Printf("Dropping firmware status with bad release id from %s", deviceID.Hex())
+		return true
+	}
+	switch msg.Status {
+	case firmware_models.RolloutDownloading, firmware_models.RolloutInstalling,
+		firmware_models.RolloutSucceeded, firmware_models.RolloutFailed:
+	default:
+		log.Printf("Dropping unknown firmware status %q from %s", msg.Status, deviceID.Hex())
+		return true
+	}
+
+	mctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var rollout firmware_models.Rollout
+	err = collection(app, "firmwareRollouts").FindOne(mctx, bson.M{"release_id": releaseID, "device_id": deviceID}).Decode(&rollout)
+	if err != nil {
+		log.Printf("Firmware status for unknown rollout from %s: %v", deviceID.Hex(), err)
+		return true
+	}
+
+	// a rollback finishing is reported as success of the rollback offer
+	rollingBack := rollout.Status == firmware_models.RolloutRollingBack
+	status := msg.Status
+	if rollingBack && status == firmware_models.RolloutSucceeded {
+		status = firmware_models.RolloutRolledBack
+	} else if rollingBack && status != firmware_models.RolloutFailed {
+		status = firmware_models.RolloutRollingBack
+	}
+
+	_, err = collection(app, "firmwareRollouts").UpdateOne(mctx, bson.M{"_id": rollout.ID}, bson.M{"$set": bson.M{
+		"status":     status,
+		"error":      msg.Error,
+		"updated_at": time.Now(),
+	}})
+	if err != nil {
+		log.Printf("Failed to update rollout %s: %v", rollout.ID.Hex(), err)
+	}
+
+	if msg.Status == firmware_models.RolloutSucceeded {
+		var release firmware_models.Release
+		if err := collection(app, "firmwareReleases").FindOne(mctx, bson.M{"_id": releaseID}).Decode(&release); err == nil {
+			firmwareID := release.FirmwareID
+			if rollingBack {
+				firmwareID = rollout.FromFirmwareID
+			}
+			if err := app.Repos.Devices.SetFirmware(mctx, deviceID, firmwareID, msg.Version); err != nil {
+				log.Printf("Failed to record firmware on %s: %v", deviceID.Hex(), err)
+			}
+		}
+	}
+	return true
+}
+
+// recordCurrentFirmware stores the image a car says it is running, so a
+// release knows what to roll the car back to. Images that aren't an upload
+// of the device's clan clear firmware_id; there is nothing to roll back to.
+func recordCurrentFirmware(app *config.AppConfig, deviceID primitive.ObjectID, env mywebsocket.Envelope) {
+	var msg firmware_models.DeviceFirmware
+	if err := json.Unmarshal(env.Data, &msg); err != nil {
+		log.Printf("Dropping malformed firmware info from %s: %v", deviceID.Hex(), err)
+		return
+	}
+
+	mctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	device, err := app.Repos.Devices.Get(mctx, deviceID)
+	if err != nil {
+		log.Printf("Failed to load %s for firmware info: %v", deviceID.Hex(), err)
+		return
+	}
+
+	filter := bson.M{"clan_id": device.ClanID, "version": msg.Version}
+	if id, err := primitive.ObjectIDFromHex(msg.FirmwareID); err == nil {
+		filter = bson.M{"clan_id": device.ClanID, "_id": id}
+	} else if msg.Version == "" {
+		log.Printf("Dropping firmware info without an id or version from %s", deviceID.Hex())
+		return
+	}
+
+	var fw firmware_models.Firmware
+	err = collection(app, "firmware").FindOne(mctx, filter).Decode(&fw)
+	switch err {
+	case nil:
+	case mongo.ErrNoDocuments:
+		fw = firmware_models.Firmware{Version: msg.Version}
+	default:
+		log.Printf("Failed to look up firmware reported by %s: %v", deviceID.Hex(), err)
+		return
+	}
+	if err := app.Repos.Devices.SetFirmware(mctx, deviceID, fw.ID, fw.Version); err != nil {
+		log.Printf("Failed to record firmware on %s: %v", deviceID.Hex(), err)
+	}
+}
@@ -0,0 +1,118 @@
+package firmware_controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/chtan/miniworld/config"
+	auth_models "github.com/chtan/miniworld/models/auth"
+	clan_models "github.com/chtan/miniworld/models/clan"
+	device_models "github.com/chtan/miniworld/models/device"
+	firmware_models "github.com/chtan/miniworld/models/firmware"
+	"github.com/chtan/miniworld/repository"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newApp(t *testing.T) (*config.AppConfig, auth_models.SetSignUpModel, clan_models.Clan) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	repos := repository.NewMemory()
+	admin := auth_models.SetSignUpModel{ID: primitive.NewObjectID(), Email: "admin@example.com", Access_Token: "admin-token"}
+	clan := clan_models.Clan{ID: primitive.NewObjectID(), AdminID: admin.ID, ClanDetails: &clan_models.ClanDetails{Name: "Racers", Tag: "RCR"}}
+	if err := repos.Users.Create(context.Background(), admin); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Clans.Create(context.Background(), clan); err != nil {
+		t.Fatal(err)
+	}
+	return &config.AppConfig{Settings: config.DefaultSettings(), Repos: repos}, admin, clan
+}
+
+func addDevice(t *testing.T, app *config.AppConfig, d device_models.Device) primitive.ObjectID {
+	t.Helper()
+	d.ID = primitive.NewObjectID()
+	if err := app.Repos.Devices.Create(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+	return d.ID
+}
+
+func TestTargetDevices(t *testing.T) {
+	app, admin, clan := newApp(t)
+	unset := addDevice(t, app, device_models.Device{ClanID: clan.ID, AdminID: admin.ID})
+	stable := addDevice(t, app, device_models.Device{ClanID: clan.ID, AdminID: admin.ID, FirmwareChannel: firmware_models.ChannelStable})
+	beta := addDevice(t, app, device_models.Device{ClanID: clan.ID, AdminID: admin.ID, FirmwareChannel: firmware_models.ChannelBeta})
+	addDevice(t, app, device_models.Device{ClanID: clan.ID, AdminID: admin.ID, Revoked: true})
+	addDevice(t, app, device_models.Device{ClanID: primitive.NewObjectID(), AdminID: admin.ID})
+
+	tests := []struct {
+		name    string
+		channel string
+		only    []primitive.ObjectID
+		want    []primitive.ObjectID
+	}{
+		{"stable takes devices without a channel", firmware_models.ChannelStable, nil, []primitive.ObjectID{unset, stable}},
+		{"beta", firmware_models.ChannelBeta, nil, []primitive.ObjectID{beta}},
+		{"narrowed", firmware_models.ChannelStable, []primitive.ObjectID{stable, beta}, []primitive.ObjectID{stable}},
+		{"empty channel", firmware_models.ChannelDev, nil, nil},
+	}
+	for _, tt := range tests {
+		devices, err := TargetDevices(context.Background(), app, clan.ID, tt.channel, tt.only)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got []primitive.ObjectID
+		for _, d := range devices {
+			got = append(got, d.ID)
+		}
+		sortIDs(got)
+		sortIDs(tt.want)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: targets %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func sortIDs(ids []primitive.ObjectID) {
+	slices.SortFunc(ids, func(a, b primitive.ObjectID) int { return bytes.Compare(a[:], b[:]) })
+}
+
+func TestSetDeviceChannel(t *testing.T) {
+	app, admin, clan := newApp(t)
+	deviceID := addDevice(t, app, device_models.Device{ClanID: clan.ID, AdminID: admin.ID})
+
+	set := func(token string, req firmware_models.SetChannelRequest) int {
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "/api/firmware/channel", bytes.NewReader(body))
+		ctx.Request.Header.Set("Authorization", "Bearer "+token)
+		ctx.Request.Header.Set("Content-Type", "application/json")
+		SetDeviceChannel(app)(ctx)
+		return w.Code
+	}
+
+	if code := set(admin.Access_Token, firmware_models.SetChannelRequest{DeviceID: deviceID, Channel: firmware_models.ChannelBeta}); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	device, err := app.Repos.Devices.Get(context.Background(), deviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.FirmwareChannel != firmware_models.ChannelBeta {
+		t.Errorf("channel = %q, want beta", device.FirmwareChannel)
+	}
+
+	if code := set(admin.Access_Token, firmware_models.SetChannelRequest{DeviceID: deviceID, Channel: "nightly"}); code != http.StatusBadRequest {
+		t.Errorf("unknown channel: status %d, want 400", code)
+	}
+	if code := set(admin.Access_Token, firmware_models.SetChannelRequest{DeviceID: primitive.NewObjectID(), Channel: firmware_models.ChannelDev}); code != http.StatusNotFound {
+		t.Errorf("device outside the clans: status %d, want 404", code)
+	}
+}
@@ -0,0 +1,538 @@
+package group_controllers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	clan_controllers "github.com/chtan/miniworld/controllers/clan"
+	command_controllers "github.com/chtan/miniworld/controllers/command"
+	common_controllers "github.com/chtan/miniworld/controllers/common"
+	device_controllers "github.com/chtan/miniworld/controllers/device"
+	firmware_controllers "github.com/chtan/miniworld/controllers/firmware"
+	shadow_controllers "github.com/chtan/miniworld/controllers/shadow"
+	command_models "github.com/chtan/miniworld/models/command"
+	device_models "github.com/chtan/miniworld/models/device"
+	firmware_models "github.com/chtan/miniworld/models/firmware"
+	group_models "github.com/chtan/miniworld/models/group"
+	"github.com/chtan/miniworld/repository"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// how long BulkStop waits for cars to ack before reporting
+	stopAckWait = 3 * time.Second
+
+	errNotInClan = "device not found in clan"
+	errRevoked   = "device revoked"
+)
+
+func groups(app *config.AppConfig) *mongo.Collection {
+	return app.Client.Database("miniworld").Collection("deviceGroups")
+}
+
+// LoadMyGroup loads a group only if the user administers its clan.
+func LoadMyGroup(mctx context.Context, app *config.AppConfig, groupID, userID primitive.ObjectID) (group_models.DeviceGroup, error) {
+	var group group_models.DeviceGroup
+	if err := groups(app).FindOne(mctx, bson.M{"_id": groupID}).Decode(&group); err != nil {
+		return group, err
+	}
+	if _, err := clan_controllers.GetMyClan(mctx, app, group.ClanID, userID); err != nil {
+		return group, err
+	}
+	return group, nil
+}
+
+// requireMyGroup resolves the group for a handler, writing the error response itself.
+func requireMyGroup(mctx context.Context, ctx *gin.Context, app *config.AppConfig, groupID primitive.ObjectID) (group_models.DeviceGroup, primitive.ObjectID, bool) {
+	userDetails, err := common_controllers.GetMyId(mctx, ctx, app)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return group_models.DeviceGroup{}, primitive.NilObjectID, false
+	}
+	group, err := LoadMyGroup(mctx, app, groupID, userDetails.ID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments || err == repository.ErrNotFound {
+			common_controllers.ErrorResponse(ctx, http.StatusNotFound, "Group not found", "No such group in your clans")
+			return group, userDetails.ID, false
+		}
+		common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load group", err.Error())
+		return group, userDetails.ID, false
+	}
+	return group, userDetails.ID, true
+}
+
+// checkClanDevices makes sure every id is a device of the clan.
+func checkClanDevices(mctx context.Context, app *config.AppConfig, clanID primitive.ObjectID, deviceIDs []primitive.ObjectID) (bool, error) {
+	if len(deviceIDs) == 0 {
+		return true, nil
+	}
+	unique := map[primitive.ObjectID]bool{}
+	for _, id := range deviceIDs {
+		unique[id] = true
+	}
+	count, err := app.Repos.Devices.CountInClan(mctx, clanID, deviceIDs)
+	if err != nil {
+		return false, err
+	}
+	return count == len(unique), nil
+}
+
+// groupDevices loads the group's devices that still belong to its clan.
+// Devices deleted or moved to another clan since they were added are left out.
+func groupDevices(mctx context.Context, app *config.AppConfig, group group_models.DeviceGroup) (map[primitive.ObjectID]device_models.Device, error) {
+	devices, err := app.Repos.Devices.ListInClan(mctx, group.ClanID, group.DeviceIDs)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[primitive.ObjectID]device_models.Device, len(devices))
+	for _, d := range devices {
+		byID[d.ID] = d
+	}
+	return byID, nil
+}
+
+// skipReason says why a bulk action leaves the group member out, or returns
+// "" when the device can take it. Revoked cars are skipped so an action such
+// as a credential rotation cannot bring them back.
+func skipReason(devices map[primitive.ObjectID]device_models.Device, deviceID primitive.ObjectID) string {
+	d, ok := devices[deviceID]
+	switch {
+	case !ok:
+		return errNotInClan
+	case d.Revoked:
+		return errRevoked
+	}
+	return ""
+}
+
+// CreateGroup creates a named device group within one of the user's clans.
+// POST /api/groups
+func CreateGroup(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req group_models.CreateGroupRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		userDetails, err := common_controllers.GetMyId(mctx, ctx, app)
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		if _, err := clan_controllers.GetMyClan(mctx, app, req.ClanID, userDetails.ID); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusForbidden, "Clan not found", "You are not the admin of this clan")
+			return
+		}
+
+		ok, err := checkClanDevices(mctx, app, req.ClanID, req.DeviceIDs)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to check devices", err.Error())
+			return
+		}
+		if !ok {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid devices", "every device must belong to the clan")
+			return
+		}
+
+		count, err := groups(app).CountDocuments(mctx, bson.M{"clan_id": req.ClanID, "name": req.Name})
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to check group name", err.Error())
+			return
+		}
+		if count > 0 {
+			common_controllers.ErrorResponse(ctx, http.StatusConflict, "Group already exists", req.Name)
+			return
+		}
+
+		if req.DeviceIDs == nil {
+			req.DeviceIDs = []primitive.ObjectID{}
+		}
+		group := group_models.DeviceGroup{
+			ID:        primitive.NewObjectID(),
+			ClanID:    req.ClanID,
+			Name:      req.Name,
+			DeviceIDs: req.DeviceIDs,
+			CreatedBy: userDetails.ID,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+		if _, err := groups(app).InsertOne(mctx, group); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				common_controllers.ErrorResponse(ctx, http.StatusConflict, "Group already exists", req.Name)
+				return
+			}
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to create group", err.Error())
+			return
+		}
+		common_controllers.SuccessResponse(ctx, "Group created", group)
+	}
+}
+
+// ListGroups returns the device groups of one of the user's clans.
+// GET /api/groups?clan_id=
+func ListGroups(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		clanID, err := primitive.ObjectIDFromHex(ctx.Query("clan_id"))
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid clan_id", err.Error())
+			return
+		}
+		userDetails, err := common_controllers.GetMyId(mctx, ctx, app)
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		if _, err := clan_controllers.GetMyClan(mctx, app, clanID, userDetails.ID); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusForbidden, "Clan not found", "You are not the admin of this clan")
+			return
+		}
+
+		cursor, err := groups(app).Find(mctx, bson.M{"clan_id": clanID}, options.Find().SetSort(bson.M{"name": 1}))
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to list groups", err.Error())
+			return
+		}
+		result := []group_models.DeviceGroup{}
+		if err := cursor.All(mctx, &result); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to list groups", err.Error())
+			return
+		}
+		common_controllers.SuccessResponse(ctx, "Device groups", result)
+	}
+}
+
+// UpdateMembers adds and removes devices from a group.
+// POST /api/groups/members
+func UpdateMembers(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req group_models.UpdateMembersRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		group, _, ok := requireMyGroup(mctx, ctx, app, req.GroupID)
+		if !ok {
+			return
+		}
+
+		valid, err := checkClanDevices(mctx, app, group.ClanID, req.Add)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to check devices", err.Error())
+			return
+		}
+		if !valid {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid devices", "every device must belong to the clan")
+			return
+		}
+
+		// $addToSet and $pull can't touch the same field in one update
+		if len(req.Add) > 0 {
+			_, err = groups(app).UpdateOne(mctx, bson.M{"_id": group.ID}, bson.M{
+				"$addToSet": bson.M{"device_ids": bson.M{"$each": req.Add}},
+				"$set":      bson.M{"updated_at": time.Now()},
+			})
+		}
+		if err == nil && len(req.Remove) > 0 {
+			_, err = groups(app).UpdateOne(mctx, bson.M{"_id": group.ID}, bson.M{
+				"$pull": bson.M{"device_ids": bson.M{"$in": req.Remove}},
+				"$set":  bson.M{"updated_at": time.Now()},
+			})
+		}
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to update group", err.Error())
+			return
+		}
+
+		if err := groups(app).FindOne(mctx, bson.M{"_id": group.ID}).Decode(&group); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load group", err.Error())
+			return
+		}
+		common_controllers.SuccessResponse(ctx, "Group updated", group)
+	}
+}
+
+// DeleteGroup removes a group. Its devices are untouched.
+// POST /api/groups/delete
+func DeleteGroup(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req group_models.GroupIDRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		group, _, ok := requireMyGroup(mctx, ctx, app, req.GroupID)
+		if !ok {
+			return
+		}
+		if _, err := groups(app).DeleteOne(mctx, bson.M{"_id": group.ID}); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to delete group", err.Error())
+			return
+		}
+		common_controllers.SuccessResponse(ctx, "Group deleted", gin.H{"group_id": group.ID.Hex()})
+	}
+}
+
+// bulkResponse writes per-device results with a summary.
+func bulkResponse(ctx *gin.Context, message string, group group_models.DeviceGroup, results []group_models.DeviceResult) {
+	succeeded := 0
+	for _, r := range results {
+		if r.OK {
+			succeeded++
+		}
+	}
+	common_controllers.SuccessResponse(ctx, message, gin.H{
+		"group_id":  group.ID.Hex(),
+		"total":     len(results),
+		"succeeded": succeeded,
+		"failed":    len(results) - succeeded,
+		"results":   results,
+	})
+}
+
+// BulkStop queues a stop for every car in the group and waits briefly for
+// the acks. Cars that are offline get a short-lived stop rather than one
+// that fires when they reconnect. Each result carries the command's status;
+// only acked stops count as succeeded.
+// POST /api/groups/stop
+func BulkStop(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		var req group_models.GroupIDRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		group, userID, ok := requireMyGroup(mctx, ctx, app, req.GroupID)
+		if !ok {
+			return
+		}
+		devices, err := groupDevices(mctx, app, group)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load devices", err.Error())
+			return
+		}
+
+		results := make([]group_models.DeviceResult, len(group.DeviceIDs))
+		commandIDs := make([]primitive.ObjectID, len(group.DeviceIDs))
+		for i, deviceID := range group.DeviceIDs {
+			results[i] = group_models.DeviceResult{DeviceID: deviceID.Hex()}
+			if reason := skipReason(devices, deviceID); reason != "" {
+				results[i].Error = reason
+				continue
+			}
+			cmd, err := command_controllers.Enqueue(mctx, app, deviceID, userID, command_controllers.CommandStop, nil, command_controllers.StopTTL)
+			if err != nil {
+				results[i].Error = err.Error()
+				continue
+			}
+			commandIDs[i] = cmd.ID
+		}
+
+		queued := make([]primitive.ObjectID, 0, len(commandIDs))
+		for _, id := range commandIDs {
+			if !id.IsZero() {
+				queued = append(queued, id)
+			}
+		}
+		settled := map[primitive.ObjectID]command_models.Command{}
+		if len(queued) > 0 {
+			settled, err = command_controllers.WaitSettled(mctx, app, queued, stopAckWait)
+			if err != nil {
+				common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load stop status", err.Error())
+				return
+			}
+		}
+		for i, id := range commandIDs {
+			if id.IsZero() {
+				continue
+			}
+			cmd := settled[id]
+			results[i].Data = gin.H{"command_id": id.Hex()}
+			results[i].Status = cmd.Status
+			results[i].OK = cmd.Status == command_models.StatusAcked
+		}
+		bulkResponse(ctx, "Stop sent", group, results)
+	}
+}
+
+// BulkConfigure patches the desired shadow state of every car in the group.
+// POST /api/groups/configure
+func BulkConfigure(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		var req group_models.BulkConfigureRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		group, _, ok := requireMyGroup(mctx, ctx, app, req.GroupID)
+		if !ok {
+			return
+		}
+		devices, err := groupDevices(mctx, app, group)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load devices", err.Error())
+			return
+		}
+
+		results := make([]group_models.DeviceResult, 0, len(group.DeviceIDs))
+		for _, deviceID := range group.DeviceIDs {
+			result := group_models.DeviceResult{DeviceID: deviceID.Hex()}
+			if reason := skipReason(devices, deviceID); reason != "" {
+				result.Error = reason
+				results = append(results, result)
+				continue
+			}
+			shadow, err := shadow_controllers.SetDesired(mctx, app, deviceID, req.Desired)
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result.OK = true
+				result.Data = gin.H{"version": shadow.Version, "delta": shadow.Delta}
+			}
+			results = append(results, result)
+		}
+		bulkResponse(ctx, "Desired state updated", group, results)
+	}
+}
+
+// BulkRotateCredentials rotates every car's credentials. The new passwords
+// are only returned in this response.
+// POST /api/groups/rotate
+func BulkRotateCredentials(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		defer cancel()
+
+		var req group_models.GroupIDRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		group, _, ok := requireMyGroup(mctx, ctx, app, req.GroupID)
+		if !ok {
+			return
+		}
+		// the group may list devices that have since left the clan or were revoked
+		devices, err := groupDevices(mctx, app, group)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load devices", err.Error())
+			return
+		}
+
+		results := make([]group_models.DeviceResult, 0, len(group.DeviceIDs))
+		for _, deviceID := range group.DeviceIDs {
+			result := group_models.DeviceResult{DeviceID: deviceID.Hex()}
+			if reason := skipReason(devices, deviceID); reason != "" {
+				result.Error = reason
+				results = append(results, result)
+				continue
+			}
+			secret, err := device_controllers.RotateDeviceCredentials(mctx, app, deviceID)
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result.OK = true
+				result.Data = gin.H{"password": secret}
+			}
+			results = append(results, result)
+		}
+		bulkResponse(ctx, "Credentials rotated", group, results)
+	}
+}
+
+// BulkAssignFirmware starts a release of the firmware to every car in the group.
+// POST /api/groups/firmware
+func BulkAssignFirmware(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		defer cancel()
+
+		var req group_models.BulkFirmwareRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		group, userID, ok := requireMyGroup(mctx, ctx, app, req.GroupID)
+		if !ok {
+			return
+		}
+
+		fw, err := firmware_controllers.LoadMyFirmware(mctx, app, req.FirmwareID, userID)
+		if err != nil || fw.ClanID != group.ClanID {
+			common_controllers.ErrorResponse(ctx, http.StatusNotFound, "Firmware not found", "No such firmware for this group's clan")
+			return
+		}
+
+		inClan, err := app.Repos.Devices.ListInClan(mctx, group.ClanID, group.DeviceIDs)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load devices", err.Error())
+			return
+		}
+		devices := make([]device_models.Device, 0, len(inClan))
+		revoked := map[primitive.ObjectID]bool{}
+		for _, d := range inClan {
+			if d.Revoked {
+				revoked[d.ID] = true
+				continue
+			}
+			devices = append(devices, d)
+		}
+		if len(devices) == 0 {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "No target devices", "no device in the group can take firmware")
+			return
+		}
+
+		release, rollouts, err := firmware_controllers.StartRelease(mctx, app, userID, fw, "", group.ID, devices)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to start release", err.Error())
+			return
+		}
+
+		results := make([]group_models.DeviceResult, 0, len(group.DeviceIDs))
+		found := map[primitive.ObjectID]bool{}
+		for _, r := range rollouts {
+			found[r.DeviceID] = true
+			results = append(results, group_models.DeviceResult{
+				DeviceID: r.DeviceID.Hex(),
+				OK:       r.Status != firmware_models.RolloutFailed,
+				Status:   r.Status,
+				Error:    r.Error,
+			})
+		}
+		// group members that were revoked, deleted or moved out of the clan
+		for _, id := range group.DeviceIDs {
+			switch {
+			case found[id]:
+			case revoked[id]:
+				results = append(results, group_models.DeviceResult{DeviceID: id.Hex(), Error: errRevoked})
+			default:
+				results = append(results, group_models.DeviceResult{DeviceID: id.Hex(), Error: errNotInClan})
+			}
+		}
+
+		bulkResponse(ctx, "Firmware release "+release.ID.Hex()+" started", group, results)
+	}
+}
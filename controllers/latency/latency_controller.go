@@ -0,0 +1,356 @@
+package latency_controllers
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	clan_controllers "github.com/chtan/miniworld/controllers/clan"
+	common_controllers "github.com/chtan/miniworld/controllers/common"
+	latency_models "github.com/chtan/miniworld/models/latency"
+	"github.com/chtan/miniworld/mywebsocket"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// PingInterval is how often the control sockets are pinged to measure round trips.
+	PingInterval = 5 * time.Second
+
+	pendingTTL = 10 * time.Second
+	maxPending = 256
+	maxSamples = 4096
+)
+
+// metrics sums the node's round trips and ack times across all sessions;
+// divide a _sum by its count for the mean.
+var metrics = expvar.NewMap("control_latency")
+
+type pendingMessage struct {
+	forwardedAt time.Time
+	clientTs    int64
+}
+
+// tracker times one driver's control session with a car.
+type tracker struct {
+	mu sync.Mutex
+	// the driver's socket; only its handler may end the session
+	owner   *mywebsocket.Conn
+	doc     latency_models.ControlSession
+	userRTT time.Duration
+	pending map[uint64]pendingMessage
+
+	userToServer   []float64
+	serverToDevice []float64
+	deviceAck      []float64
+}
+
+var (
+	trackersMu sync.Mutex
+	// deviceId -> session of the driver controlling it
+	trackers = map[string]*tracker{}
+
+	// deviceId -> last round trip on the car's control socket
+	deviceRTTs sync.Map
+)
+
+func ms(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+func addSample(samples []float64, v float64) []float64 {
+	if len(samples) >= maxSamples {
+		// keep the most recent window
+		samples = append(samples[:0], samples[len(samples)/2:]...)
+	}
+	return append(samples, v)
+}
+
+func summarize(samples []float64) latency_models.Stats {
+	if len(samples) == 0 {
+		return latency_models.Stats{}
+	}
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+	}
+	at := func(p float64) float64 { return sorted[int(p*float64(len(sorted)-1))] }
+	return latency_models.Stats{
+		Count: len(sorted),
+		Avg:   sum / float64(len(sorted)),
+		P50:   at(0.50),
+		P95:   at(0.95),
+		Max:   sorted[len(sorted)-1],
+	}
+}
+
+func (t *tracker) summaryLocked() latency_models.Summary {
+	return latency_models.Summary{
+		UserToServer:   summarize(t.userToServer),
+		ServerToDevice: summarize(t.serverToDevice),
+		DeviceAck:      summarize(t.deviceAck),
+	}
+}
+
+func deviceRTT(deviceID string) time.Duration {
+	if v, ok := deviceRTTs.Load(deviceID); ok {
+		return v.(time.Duration)
+	}
+	return 0
+}
+
+// StartSession begins timing the control session on the driver's socket. A
+// driver taking over a car closes the previous driver's session.
+func StartSession(app *config.AppConfig, userID, deviceID string, owner *mywebsocket.Conn) {
+	userObjID, _ := primitive.ObjectIDFromHex(userID)
+	deviceObjID, _ := primitive.ObjectIDFromHex(deviceID)
+	t := &tracker{
+		owner: owner,
+		doc: latency_models.ControlSession{
+			ID:        primitive.NewObjectID(),
+			DeviceID:  deviceObjID,
+			UserID:    userObjID,
+			StartedAt: time.Now(),
+		},
+		pending: map[uint64]pendingMessage{},
+	}
+
+	trackersMu.Lock()
+	previous := trackers[deviceID]
+	trackers[deviceID] = t
+	trackersMu.Unlock()
+
+	if previous != nil {
+		go saveSession(app, previous)
+	}
+}
+
+// EndSession stores the session's latency summary in its history, if the
+// session was started on owner. The same user reconnecting starts a new one.
+func EndSession(app *config.AppConfig, deviceID string, owner *mywebsocket.Conn) {
+	trackersMu.Lock()
+	t := trackers[deviceID]
+	if t == nil || t.owner != owner {
+		trackersMu.Unlock()
+		return
+	}
+	delete(trackers, deviceID)
+	trackersMu.Unlock()
+
+	saveSession(app, t)
+}
+
+func saveSession(app *config.AppConfig, t *tracker) {
+	t.mu.Lock()
+	doc := t.doc
+	doc.EndedAt = time.Now()
+	doc.Latency = t.summaryLocked()
+	t.mu.Unlock()
+
+	if doc.DeviceID.IsZero() || doc.Messages == 0 {
+		return
+	}
+	mctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := app.Client.Database("miniworld").Collection("controlSessions").InsertOne(mctx, doc); err != nil {
+		log.Printf("Failed to store control session for %s: %v", doc.DeviceID.Hex(), err)
+	}
+}
+
+// UserRTT records a round trip to the driver controlling the device.
+func UserRTT(deviceID string, rtt time.Duration) {
+	trackersMu.Lock()
+	t := trackers[deviceID]
+	trackersMu.Unlock()
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.userRTT = rtt
+	t.mu.Unlock()
+	metrics.AddFloat("user_rtt_ms_sum", ms(rtt))
+	metrics.Add("user_rtt_count", 1)
+}
+
+// DeviceRTT records a round trip on the car's control socket.
+func DeviceRTT(deviceID string, rtt time.Duration) {
+	deviceRTTs.Store(deviceID, rtt)
+	metrics.AddFloat("device_rtt_ms_sum", ms(rtt))
+	metrics.Add("device_rtt_count", 1)
+}
+
+// ForgetDevice drops the car's round trip once it disconnects.
+func ForgetDevice(deviceID string) {
+	deviceRTTs.Delete(deviceID)
+}
+
+// StampUserMessage notes when a timed control message (one with a seq) was
+// forwarded and adds the server's clock to it as srv_ts. Other messages are
+// returned untouched.
+func StampUserMessage(deviceID string, env mywebsocket.Envelope, data []byte) []byte {
+	if env.Seq == 0 {
+		return data
+	}
+	trackersMu.Lock()
+	t := trackers[deviceID]
+	trackersMu.Unlock()
+	if t == nil {
+		return data
+	}
+
+	now := time.Now()
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return data
+	}
+	fields["srv_ts"], _ = json.Marshal(now.UnixMilli())
+	stamped, err := json.Marshal(fields)
+	if err != nil {
+		return data
+	}
+
+	t.mu.Lock()
+	if len(t.pending) >= maxPending {
+		for seq, p := range t.pending {
+			if now.Sub(p.forwardedAt) > pendingTTL {
+				delete(t.pending, seq)
+			}
+		}
+	}
+	if len(t.pending) < maxPending {
+		t.pending[env.Seq] = pendingMessage{forwardedAt: now, clientTs: env.Ts}
+	}
+	t.doc.Messages++
+	t.mu.Unlock()
+
+	metrics.Add("messages", 1)
+	return stamped
+}
+
+// HandleDeviceMessage times a "control_ack" from the car and reports the
+// result to the driver. Acks for messages no longer pending are dropped.
+func HandleDeviceMessage(app *config.AppConfig, deviceID primitive.ObjectID, env mywebsocket.Envelope) bool {
+	if env.Type != mywebsocket.TypeControlAck {
+		return false
+	}
+	seq := env.Seq
+	if seq == 0 {
+		var ack latency_models.DeviceAck
+		if err := json.Unmarshal(env.Data, &ack); err != nil {
+			return true
+		}
+		seq = ack.Seq
+	}
+
+	id := deviceID.Hex()
+	trackersMu.Lock()
+	t := trackers[id]
+	trackersMu.Unlock()
+	if t == nil {
+		return true
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	p, ok := t.pending[seq]
+	if !ok {
+		t.mu.Unlock()
+		return true
+	}
+	delete(t.pending, seq)
+
+	report := latency_models.Report{
+		Seq:              seq,
+		ClientTs:         p.clientTs,
+		UserToServerMs:   ms(t.userRTT / 2),
+		ServerToDeviceMs: ms(deviceRTT(id) / 2),
+		DeviceAckMs:      ms(now.Sub(p.forwardedAt)),
+	}
+	report.EstimatedMs = report.UserToServerMs + report.DeviceAckMs
+	if t.userRTT > 0 {
+		t.userToServer = addSample(t.userToServer, report.UserToServerMs)
+	}
+	if report.ServerToDeviceMs > 0 {
+		t.serverToDevice = addSample(t.serverToDevice, report.ServerToDeviceMs)
+	}
+	t.deviceAck = addSample(t.deviceAck, report.DeviceAckMs)
+	t.doc.Acked++
+	t.mu.Unlock()
+
+	metrics.Add("acks", 1)
+	metrics.AddFloat("device_ack_ms_sum", report.DeviceAckMs)
+
+	mywebsocket.SendUserJSON(id, gin.H{"type": mywebsocket.TypeLatency, "data": report})
+	return true
+}
+
+// GetLatency returns the live latency of the session controlling a car.
+// GET /api/latency?device_id=
+func GetLatency(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		deviceID, ok := clan_controllers.RequireMyClanDevice(mctx, ctx, app, ctx.Query("device_id"))
+		if !ok {
+			return
+		}
+		id := deviceID.Hex()
+
+		result := gin.H{
+			"device_id":     id,
+			"device_rtt_ms": ms(deviceRTT(id)),
+			"session":       nil,
+		}
+		trackersMu.Lock()
+		t := trackers[id]
+		trackersMu.Unlock()
+		if t != nil {
+			t.mu.Lock()
+			doc := t.doc
+			doc.Latency = t.summaryLocked()
+			result["user_rtt_ms"] = ms(t.userRTT)
+			t.mu.Unlock()
+			result["session"] = doc
+		}
+		common_controllers.SuccessResponse(ctx, "Control latency", result)
+	}
+}
+
+// ListControlSessions returns a car's past control sessions with their latency, newest first.
+// GET /api/controlsessions?device_id=
+func ListControlSessions(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		deviceID, ok := clan_controllers.RequireMyClanDevice(mctx, ctx, app, ctx.Query("device_id"))
+		if !ok {
+			return
+		}
+
+		cursor, err := app.Client.Database("miniworld").Collection("controlSessions").Find(
+			mctx,
+			bson.M{"device_id": deviceID},
+			options.Find().SetSort(bson.M{"started_at": -1}).SetLimit(100),
+		)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to list sessions", err.Error())
+			return
+		}
+		result := []latency_models.ControlSession{}
+		if err := cursor.All(mctx, &result); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to list sessions", err.Error())
+			return
+		}
+		common_controllers.SuccessResponse(ctx, "Control sessions", result)
+	}
+}
@@ -0,0 +1,34 @@
+package latency_controllers
+
+import (
+	"testing"
+
+	"github.com/chtan/miniworld/config"
+	"github.com/chtan/miniworld/mywebsocket"
+)
+
+func TestEndSessionKeepsTakeover(t *testing.T) {
+	app := &config.AppConfig{}
+	const userID, deviceID = "65f000000000000000000001", "65f000000000000000000002"
+	old, current := mywebsocket.NewConn(nil), mywebsocket.NewConn(nil)
+
+	StartSession(app, userID, deviceID, old)
+	StartSession(app, userID, deviceID, current)
+	// the old socket's handler cleans up after the same user reconnected
+	EndSession(app, deviceID, old)
+
+	trackersMu.Lock()
+	t.Cleanup(func() { delete(trackers, deviceID) })
+	tr := trackers[deviceID]
+	trackersMu.Unlock()
+	if tr == nil || tr.owner != current {
+		t.Fatal("the new connection's session was ended by the old one")
+	}
+
+	EndSession(app, deviceID, current)
+	trackersMu.Lock()
+	defer trackersMu.Unlock()
+	if trackers[deviceID] != nil {
+		t.Error("session kept after its own connection left")
+	}
+}
@@ -0,0 +1,350 @@
+package presence_controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	presence_models "github.com/chtan/miniworld/models/presence"
+	"github.com/chtan/miniworld/mywebsocket"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	leaseTTL      = 30 * time.Second
+	renewInterval = leaseTTL / 3
+	sweepInterval = 15 * time.Second
+)
+
+var (
+	// ErrSuperseded is returned when a newer connection claimed the stream first.
+	ErrSuperseded = errors.New("presence: superseded by a newer connection")
+	// ErrControlled is returned when another user is driving the device.
+	ErrControlled = errors.New("presence: device is controlled by another user")
+)
+
+var sweeperOnce sync.Once
+
+func presence(app *config.AppConfig) *mongo.Collection {
+	return app.Client.Database("miniworld").Collection("devicePresence")
+}
+
+// Connection is this node's lease on one of a device's streams. It is
+// renewed in the background until released or lost.
+type Connection struct {
+	app      *config.AppConfig
+	deviceID primitive.ObjectID
+	stream   string
+	userID   string
+
+	mu         sync.Mutex
+	generation int64
+	// claiming keeps a reclaim from landing after Release
+	claiming sync.Mutex
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// Connect claims the device's stream for this node and marks the device
+// online. A connection made earlier, here or on another node, loses its
+// claim and can no longer change the device's presence.
+func Connect(app *config.AppConfig, deviceID primitive.ObjectID, stream string) (*Connection, error) {
+	// a claim that started earlier may land later; it must not win
+	return claim(app, deviceID, stream, "", func(generation int64) []bson.M {
+		return []bson.M{{stream + ".generation": bson.M{"$lt": generation}}}
+	})
+}
+
+// Drive claims control of the device for the user. Only one user drives a
+// car at a time across all nodes: it fails with ErrControlled while
+// another user holds a live lease. The same user connecting again takes
+// over from their older connection.
+func Drive(app *config.AppConfig, deviceID primitive.ObjectID, userID string) (*Connection, error) {
+	stream := presence_models.StreamDriver
+	c, err := claim(app, deviceID, stream, userID, func(int64) []bson.M {
+		return []bson.M{
+			{stream + ".user_id": userID},
+			{stream + ".expires_at": bson.M{"$lt": time.Now()}},
+		}
+	})
+	if errors.Is(err, ErrSuperseded) {
+		return nil, ErrControlled
+	}
+	return c, err
+}
+
+// claim writes this node's lease for the stream if the stream is free or
+// one of contested matches the current holder.
+func claim(app *config.AppConfig, deviceID primitive.ObjectID, stream, userID string, contested func(generation int64) []bson.M) (*Connection, error) {
+	mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c := &Connection{
+		app:      app,
+		deviceID: deviceID,
+		stream:   stream,
+		userID:   userID,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := c.take(mctx, contested); err != nil {
+		return nil, err
+	}
+
+	if stream != presence_models.StreamDriver {
+		if err := syncOnline(mctx, app, deviceID); err != nil {
+			log.Printf("Failed to mark %s online: %v", deviceID.Hex(), err)
+		}
+	}
+	go c.renew()
+	return c, nil
+}
+
+// take claims the next generation of the device's presence and writes the
+// lease under it if the stream is free or contested by the holder. It
+// fails with ErrSuperseded if the stream is held.
+func (c *Connection) take(mctx context.Context, contested func(generation int64) []bson.M) error {
+	var doc presence_models.Presence
+	err := presence(c.app).FindOneAndUpdate(
+		mctx,
+		bson.M{"_id": c.deviceID},
+		bson.M{"$inc": bson.M{"generation": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&doc)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	lease := presence_models.Lease{
+		Node:        mywebsocket.NodeID(),
+		UserID:      c.userID,
+		Generation:  doc.Generation,
+		ConnectedAt: now,
+		ExpiresAt:   now.Add(leaseTTL),
+	}
+	free := []bson.M{{c.stream: bson.M{"$exists": false}}}
+	if contested != nil {
+		free = append(free, contested(doc.Generation)...)
+	}
+	result, err := presence(c.app).UpdateOne(mctx, bson.M{
+		"_id": c.deviceID,
+		"$or": free,
+	}, bson.M{"$set": bson.M{c.stream: lease}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrSuperseded
+	}
+
+	c.mu.Lock()
+	c.generation = doc.Generation
+	c.mu.Unlock()
+	return nil
+}
+
+// Done is closed once the connection no longer holds its stream: it was
+// released, or its lease was lost and couldn't be claimed back. The
+// socket it stands for should be closed so the peer reconnects.
+func (c *Connection) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Connection) end() {
+	c.doneOnce.Do(func() { close(c.done) })
+}
+
+func (c *Connection) renew() {
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+
+		mctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		result, err := presence(c.app).UpdateOne(mctx, c.owned(), bson.M{
+			"$set": bson.M{c.stream + ".expires_at": time.Now().Add(leaseTTL)},
+		})
+		if err == nil && result.MatchedCount == 0 {
+			err = c.reclaim(mctx)
+		}
+		cancel()
+
+		switch {
+		case err == nil:
+			renewed = time.Now()
+		case errors.Is(err, ErrSuperseded):
+			log.Printf("Lost %s lease for %s to a newer connection", c.stream, c.deviceID.Hex())
+			c.end()
+			return
+		case time.Since(renewed) >= leaseTTL:
+			// the sweeper may already have handed the stream on
+			log.Printf("Gave up %s lease for %s after failed renewals: %v", c.stream, c.deviceID.Hex(), err)
+			c.end()
+			return
+		default:
+			log.Printf("Failed to renew %s lease for %s: %v", c.stream, c.deviceID.Hex(), err)
+		}
+	}
+}
+
+// reclaim takes the stream back after the sweeper expired the lease, for
+// example when renewals stalled. It fails with ErrSuperseded once a newer
+// connection holds the stream.
+func (c *Connection) reclaim(mctx context.Context) error {
+	c.claiming.Lock()
+	defer c.claiming.Unlock()
+	select {
+	case <-c.stop:
+		return nil
+	default:
+	}
+
+	if err := c.take(mctx, nil); err != nil {
+		return err
+	}
+	log.Printf("Reclaimed expired %s lease for %s", c.stream, c.deviceID.Hex())
+	if c.stream != presence_models.StreamDriver {
+		return syncOnline(mctx, c.app, c.deviceID)
+	}
+	return nil
+}
+
+// owned matches the presence record only while this connection holds the stream.
+func (c *Connection) owned() bson.M {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bson.M{"_id": c.deviceID, c.stream + ".generation": c.generation}
+}
+
+// Release gives up the stream and marks the device offline if nothing else
+// holds it. It does nothing if a newer connection has taken over, so a slow
+// disconnect can't undo a reconnect. Release on a nil Connection is a no-op.
+func (c *Connection) Release() {
+	if c == nil {
+		return
+	}
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		defer c.end()
+		c.claiming.Lock()
+		defer c.claiming.Unlock()
+
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		result, err := presence(c.app).UpdateOne(mctx, c.owned(), bson.M{
+			"$unset": bson.M{c.stream: ""},
+			"$inc":   bson.M{"generation": 1},
+		})
+		if err != nil {
+			log.Printf("Failed to release %s lease for %s: %v", c.stream, c.deviceID.Hex(), err)
+			return
+		}
+		if result.MatchedCount == 0 {
+			return
+		}
+		if err := syncOnline(mctx, c.app, c.deviceID); err != nil {
+			log.Printf("Failed to mark %s offline: %v", c.deviceID.Hex(), err)
+		}
+	})
+}
+
+// syncOnline derives the device's is_online from its presence record. The
+// write carries the record's generation and is skipped if a newer
+// generation was already written, so racing nodes can't reorder it.
+func syncOnline(mctx context.Context, app *config.AppConfig, deviceID primitive.ObjectID) error {
+	var doc presence_models.Presence
+	err := presence(app).FindOne(mctx, bson.M{"_id": deviceID}).Decode(&doc)
+	if err != nil {
+		return err
+	}
+
+	return app.Repos.Devices.SyncPresence(mctx, deviceID, doc.Online(time.Now()), doc.Generation)
+}
+
+// StartSweeper periodically expires leases that weren't renewed, which
+// marks offline the devices of nodes that died without releasing them.
+func StartSweeper(app *config.AppConfig) {
+	sweeperOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(sweepInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				sweep(app)
+			}
+		}()
+	})
+}
+
+func sweep(app *config.AppConfig) {
+	mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	streams := []string{presence_models.StreamControl, presence_models.StreamCamera, presence_models.StreamDriver}
+	expired := make([]bson.M, 0, len(streams))
+	for _, stream := range streams {
+		expired = append(expired, bson.M{stream + ".expires_at": bson.M{"$lt": now}})
+	}
+
+	cursor, err := presence(app).Find(mctx, bson.M{"$or": expired})
+	if err != nil {
+		log.Printf("Failed to find expired leases: %v", err)
+		return
+	}
+	var docs []presence_models.Presence
+	if err := cursor.All(mctx, &docs); err != nil {
+		log.Printf("Failed to find expired leases: %v", err)
+		return
+	}
+
+	for _, doc := range docs {
+		leases := map[string]*presence_models.Lease{
+			presence_models.StreamControl: doc.Control,
+			presence_models.StreamCamera:  doc.Camera,
+			presence_models.StreamDriver:  doc.Driver,
+		}
+		changed := false
+		for stream, lease := range leases {
+			if lease == nil || lease.ExpiresAt.After(now) {
+				continue
+			}
+			// renewed or replaced since it was read: leave it alone
+			result, err := presence(app).UpdateOne(mctx, bson.M{
+				"_id":                  doc.DeviceID,
+				stream + ".generation": lease.Generation,
+				stream + ".expires_at": bson.M{"$lt": now},
+			}, bson.M{
+				"$unset": bson.M{stream: ""},
+				"$inc":   bson.M{"generation": 1},
+			})
+			if err != nil {
+				log.Printf("Failed to expire %s lease for %s: %v", stream, doc.DeviceID.Hex(), err)
+				continue
+			}
+			if result.MatchedCount > 0 {
+				log.Printf("Expired %s lease for %s held by %s", stream, doc.DeviceID.Hex(), lease.Node)
+				changed = true
+			}
+		}
+		if changed {
+			if err := syncOnline(mctx, app, doc.DeviceID); err != nil {
+				log.Printf("Failed to mark %s offline: %v", doc.DeviceID.Hex(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package recording_controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	clan_controllers "github.com/chtan/miniworld/controllers/clan"
+	common_controllers "github.com/chtan/miniworld/controllers/common"
+	recording_models "github.com/chtan/miniworld/models/recording"
+	"github.com/chtan/miniworld/recording"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxRecordingBytes    = 1 << 30
+	maxRecordingDuration = 2 * time.Hour
+	uploadTimeout        = 10 * time.Minute
+)
+
+// activeRecording is a session being written to a local temp file.
+// Both the control and camera sockets of a device feed the same one.
+type activeRecording struct {
+	mu      sync.Mutex
+	doc     recording_models.Recording
+	file    *os.File
+	w       *recording.Writer
+	refs    int
+	dropped int
+	err     error
+	// closed is set once finish owns the file; late captures are ignored
+	closed bool
+}
+
+var (
+	activeMu sync.RWMutex
+	active   = map[string]*activeRecording{}
+)
+
+func recordings(app *config.AppConfig) *mongo.Collection {
+	return app.Client.Database("miniworld").Collection("recordings")
+}
+
+// Start begins recording a device, or joins the recording already running
+// for it. Every Start must be paired with a Stop.
+func Start(mctx context.Context, app *config.AppConfig, userID, deviceID primitive.ObjectID) (primitive.ObjectID, error) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	if rec, ok := active[deviceID.Hex()]; ok {
+		rec.mu.Lock()
+		rec.refs++
+		rec.mu.Unlock()
+		return rec.doc.ID, nil
+	}
+
+	file, err := os.CreateTemp("", "recording-*.mwr")
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	now := time.Now()
+	w, err := recording.NewWriter(file, now, deviceID)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return primitive.NilObjectID, err
+	}
+
+	doc := recording_models.Recording{
+		ID:        primitive.NewObjectID(),
+		DeviceID:  deviceID,
+		UserID:    userID,
+		Status:    recording_models.StatusRecording,
+		StartedAt: now,
+	}
+	doc.ObjectKey = fmt.Sprintf("recordings/%s/%s.mwr", deviceID.Hex(), doc.ID.Hex())
+	if _, err := recordings(app).InsertOne(mctx, doc); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return primitive.NilObjectID, err
+	}
+
+	active[deviceID.Hex()] = &activeRecording{doc: doc, file: file, w: w, refs: 1}
+	log.Printf("Recording %s started for device %s", doc.ID.Hex(), deviceID.Hex())
+	return doc.ID, nil
+}
+
+// Stop releases one reference to the device's recording. The last one
+// finalizes the file and uploads it in the background.
+func Stop(app *config.AppConfig, deviceID string) {
+	activeMu.Lock()
+	rec, ok := active[deviceID]
+	if !ok {
+		activeMu.Unlock()
+		return
+	}
+	rec.mu.Lock()
+	rec.refs--
+	last := rec.refs <= 0
+	rec.mu.Unlock()
+	if last {
+		delete(active, deviceID)
+	}
+	activeMu.Unlock()
+
+	if last {
+		go finish(app, rec)
+	}
+}
+
+// StartIfRequested starts a recording when the websocket request carries
+// record=true. It must run before the upgrade so it can still answer with an
+// error, in which case ok is false. The returned stop is always safe to call.
+func StartIfRequested(mctx context.Context, ctx *gin.Context, app *config.AppConfig, userID primitive.ObjectID, deviceHex string) (stop func(), ok bool) {
+	noop := func() {}
+	if want, _ := strconv.ParseBool(ctx.Query("record")); !want {
+		return noop, true
+	}
+
+	deviceID, err := primitive.ObjectIDFromHex(deviceHex)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid deviceId"})
+		return noop, false
+	}
+	mine, err := clan_controllers.IsMyClanDevice(mctx, app, userID, deviceID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return noop, false
+	}
+	if !mine {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "only the clan admin can record this device"})
+		return noop, false
+	}
+	if _, err := Start(mctx, app, userID, deviceID); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start recording"})
+		return noop, false
+	}
+	return func() { Stop(app, deviceHex) }, true
+}
+
+// Capture appends a frame to the device's recording, if one is running.
+// It is cheap enough to call on every relayed frame.
+func Capture(deviceID string, stream recording.Stream, dir recording.Direction, messageType int, data []byte) {
+	activeMu.RLock()
+	rec, ok := active[deviceID]
+	activeMu.RUnlock()
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.closed {
+		return
+	}
+	if rec.err != nil || rec.w.Size() > maxRecordingBytes || now.Sub(rec.doc.StartedAt) > maxRecordingDuration {
+		rec.dropped++
+		return
+	}
+	if len(data) > recording.MaxPayload {
+		rec.dropped++
+		return
+	}
+	if err := rec.w.Write(now, stream, dir, messageType, data); err != nil {
+		log.Printf("Recording %s write failed: %v", rec.doc.ID.Hex(), err)
+		rec.err = err
+	}
+}
+
+// finish closes the writer and moves the file to the object store.
+func finish(app *config.AppConfig, rec *activeRecording) {
+	defer os.Remove(rec.file.Name())
+	defer rec.file.Close()
+
+	rec.mu.Lock()
+	rec.closed = true
+	err := rec.err
+	if err == nil {
+		err = rec.w.Close()
+	}
+	frames, duration, dropped := rec.w.Count(), rec.w.Duration(), rec.dropped
+	rec.mu.Unlock()
+
+	size := int64(0)
+	if info, serr := rec.file.Stat(); serr == nil {
+		size = info.Size()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+	defer cancel()
+
+	ended := time.Now()
+	set := bson.M{
+		"status":         recording_models.StatusUploading,
+		"size":           size,
+		"frames":         frames,
+		"duration_ms":    duration.Milliseconds(),
+		"dropped_frames": dropped,
+		"ended_at":       ended,
+	}
+	if _, uerr := recordings(app).UpdateOne(ctx, bson.M{"_id": rec.doc.ID}, bson.M{"$set": set}); uerr != nil {
+		log.Printf("Failed to update recording %s: %v", rec.doc.ID.Hex(), uerr)
+	}
+
+	if err == nil {
+		if _, err = rec.file.Seek(0, io.SeekStart); err == nil {
+			err = common_controllers.SaveObject(rec.doc.ObjectKey, rec.file, "application/octet-stream")
+		}
+	}
+
+	update := bson.M{"status": recording_models.StatusComplete}
+	if err != nil {
+		log.Printf("Recording %s failed: %v", rec.doc.ID.Hex(), err)
+		update = bson.M{"status": recording_models.StatusFailed, "error": err.Error()}
+	}
+	if _, uerr := recordings(app).UpdateOne(ctx, bson.M{"_id": rec.doc.ID}, bson.M{"$set": update}); uerr != nil {
+		log.Printf("Failed to update recording %s: %v", rec.doc.ID.Hex(), uerr)
+	}
+	log.Printf("Recording %s finished: %d frames, %d bytes", rec.doc.ID.Hex(), frames, size)
+}
+
+// LoadMyRecording loads a recording only if the user administers its device's clan.
+func LoadMyRecording(mctx context.Context, app *config.AppConfig, recordingID, userID primitive.ObjectID) (recording_models.Recording, error) {
+	var rec recording_models.Recording
+	if err := recordings(app).FindOne(mctx, bson.M{"_id": recordingID}).Decode(&rec); err != nil {
+		return rec, err
+	}
+	mine, err := clan_controllers.IsMyClanDevice(mctx, app, userID, rec.DeviceID)
+	if err != nil {
+		return rec, err
+	}
+	if !mine {
+		return rec, mongo.ErrNoDocuments
+	}
+	return rec, nil
+}
+
+// ListRecordings returns a device's recordings, newest first.
+// GET /api/recordings?device_id=&limit=
+func ListRecordings(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		deviceID, ok := clan_controllers.RequireMyClanDevice(mctx, ctx, app, ctx.Query("device_id"))
+		if !ok {
+			return
+		}
+
+		limit := int64(50)
+		if v := ctx.Query("limit"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 || n > 500 {
+				common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid limit", "limit must be between 1 and 500")
+				return
+			}
+			limit = n
+		}
+
+		cursor, err := recordings(app).Find(
+			mctx,
+			bson.M{"device_id": deviceID},
+			options.Find().SetSort(bson.M{"started_at": -1}).SetLimit(limit),
+		)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to list recordings", err.Error())
+			return
+		}
+		result := []recording_models.Recording{}
+		if err := cursor.All(mctx, &result); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to list recordings", err.Error())
+			return
+		}
+		common_controllers.SuccessResponse(ctx, "Recordings", result)
+	}
+}
+
+// DownloadRecording streams a finished recording file.
+// GET /api/recording?id=
+func DownloadRecording(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		recordingID, err := primitive.ObjectIDFromHex(ctx.Query("id"))
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid id", err.Error())
+			return
+		}
+		userDetails, err := common_controllers.GetMyId(mctx, ctx, app)
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		rec, err := LoadMyRecording(mctx, app, recordingID, userDetails.ID)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				common_controllers.ErrorResponse(ctx, http.StatusNotFound, "Recording not found", "No such recording for your devices")
+				return
+			}
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load recording", err.Error())
+			return
+		}
+		if rec.Status != recording_models.StatusComplete {
+			common_controllers.ErrorResponse(ctx, http.StatusConflict, "Recording not available", "recording is "+rec.Status)
+			return
+		}
+
+		body, err := common_controllers.GetObject(rec.ObjectKey)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadGateway, "Failed to fetch recording", err.Error())
+			return
+		}
+		defer body.Close()
+
+		ctx.DataFromReader(http.StatusOK, rec.Size, "application/octet-stream", body, map[string]string{
+			"Content-Disposition": fmt.Sprintf(`attachment; filename="%s.mwr"`, rec.ID.Hex()),
+		})
+	}
+}
+
+// OpenRecording copies a finished recording from the object store to a temp
+// file so it can be read at random. The caller must call release.
+func OpenRecording(rec recording_models.Recording) (*recording.Reader, func(), error) {
+	body, err := common_controllers.GetObject(rec.ObjectKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+
+	file, err := os.CreateTemp("", "replay-*.mwr")
+	if err != nil {
+		return nil, nil, err
+	}
+	release := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+	size, err := io.Copy(file, body)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	reader, err := recording.NewReader(file, size)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return reader, release, nil
+}
@@ -0,0 +1,232 @@
+package shadow_controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	clan_controllers "github.com/chtan/miniworld/controllers/clan"
+	common_controllers "github.com/chtan/miniworld/controllers/common"
+	shadow_models "github.com/chtan/miniworld/models/shadow"
+	"github.com/chtan/miniworld/mywebsocket"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LoadShadow returns the device's shadow, or an empty one if none was stored yet.
+func LoadShadow(mctx context.Context, app *config.AppConfig, deviceID primitive.ObjectID) (shadow_models.Shadow, error) {
+	shadow := shadow_models.Shadow{DeviceID: deviceID}
+	err := app.Client.Database("miniworld").Collection("shadows").FindOne(mctx, bson.M{"_id": deviceID}).Decode(&shadow)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return shadow, err
+	}
+	withDelta(&shadow)
+	return shadow, nil
+}
+
+// withDelta fills in every desired key whose reported value differs.
+func withDelta(shadow *shadow_models.Shadow) {
+	if shadow.Desired == nil {
+		shadow.Desired = bson.M{}
+	}
+	if shadow.Reported == nil {
+		shadow.Reported = bson.M{}
+	}
+	shadow.Delta = bson.M{}
+	for key, want := range shadow.Desired {
+		have, ok := shadow.Reported[key]
+		if !ok || !sameValue(want, have) {
+			shadow.Delta[key] = want
+		}
+	}
+}
+
+// sameValue compares through JSON so int32 vs float64 and map ordering
+// from BSON decoding don't register as differences.
+func sameValue(a, b interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(ja) == string(jb)
+}
+
+// buildPatch turns a top-level key patch into $set/$unset under the given field.
+// Values replace the stored value wholesale; null removes the key.
+func buildPatch(field string, patch map[string]interface{}) (bson.M, bson.M, error) {
+	set := bson.M{}
+	unset := bson.M{}
+	for key, value := range patch {
+		if key == "" || strings.ContainsAny(key, ".$") {
+			return nil, nil, fmt.Errorf("invalid key %q", key)
+		}
+		if value == nil {
+			unset[field+"."+key] = ""
+		} else {
+			set[field+"."+key] = value
+		}
+	}
+	return set, unset, nil
+}
+
+// PushShadow sends the current desired state and delta to the device, if connected.
+func PushShadow(app *config.AppConfig, deviceID primitive.ObjectID) {
+	mctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	shadow, err := LoadShadow(mctx, app, deviceID)
+	if err != nil {
+		log.Printf("Failed to load shadow for %s: %v", deviceID.Hex(), err)
+		return
+	}
+	sendShadow(shadow)
+}
+
+func sendShadow(shadow shadow_models.Shadow) {
+	mywebsocket.SendDeviceJSON(shadow.DeviceID.Hex(), gin.H{
+		"type": mywebsocket.TypeShadow,
+		"data": shadow_models.DeviceShadowMessage{
+			Desired: shadow.Desired,
+			Delta:   shadow.Delta,
+			Version: shadow.Version,
+		},
+	})
+}
+
+// HandleDeviceMessage merges a "shadow_reported" envelope into the reported
+// state; null values remove keys, as they do in a desired patch.
+func HandleDeviceMessage(app *config.AppConfig, deviceID primitive.ObjectID, env mywebsocket.Envelope) bool {
+	if env.Type != mywebsocket.TypeShadowReported {
+		return false
+	}
+
+	var reported map[string]interface{}
+	if err := json.Unmarshal(env.Data, &reported); err != nil {
+		log.Printf("Dropping malformed shadow report from %s: %v", deviceID.Hex(), err)
+		return true
+	}
+	set, unset, err := buildPatch("reported", reported)
+	if err != nil {
+		log.Printf("Dropping shadow report from %s: %v", deviceID.Hex(), err)
+		return true
+	}
+
+	mctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := updateShadow(mctx, app, bson.M{"_id": deviceID}, set, unset); err != nil {
+		log.Printf("Failed to store shadow report from %s: %v", deviceID.Hex(), err)
+	}
+	return true
+}
+
+func updateShadow(mctx context.Context, app *config.AppConfig, filter, set, unset bson.M) (shadow_models.Shadow, error) {
+	set["updated_at"] = time.Now()
+	update := bson.M{
+		"$set": set,
+		"$inc": bson.M{"version": 1},
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	var shadow shadow_models.Shadow
+	err := app.Client.Database("miniworld").Collection("shadows").FindOneAndUpdate(
+		mctx,
+		filter,
+		update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&shadow)
+	if err != nil {
+		return shadow, err
+	}
+	withDelta(&shadow)
+	return shadow, nil
+}
+
+// SetDesired patches a device's desired state without a version check and
+// pushes the result to the car.
+func SetDesired(mctx context.Context, app *config.AppConfig, deviceID primitive.ObjectID, patch map[string]interface{}) (shadow_models.Shadow, error) {
+	set, unset, err := buildPatch("desired", patch)
+	if err != nil {
+		return shadow_models.Shadow{}, err
+	}
+	shadow, err := updateShadow(mctx, app, bson.M{"_id": deviceID}, set, unset)
+	if err != nil {
+		return shadow, err
+	}
+	sendShadow(shadow)
+	return shadow, nil
+}
+
+// GetShadow returns desired, reported, delta and version for a device.
+// GET /api/shadow?device_id=
+func GetShadow(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		deviceID, ok := clan_controllers.RequireMyClanDevice(mctx, ctx, app, ctx.Query("device_id"))
+		if !ok {
+			return
+		}
+
+		shadow, err := LoadShadow(mctx, app, deviceID)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load shadow", err.Error())
+			return
+		}
+		common_controllers.SuccessResponse(ctx, "Device shadow", shadow)
+	}
+}
+
+// UpdateDesired patches the desired state and pushes the result to the car.
+// POST /api/shadow/desired
+func UpdateDesired(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req shadow_models.UpdateDesiredRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+
+		deviceID, ok := clan_controllers.RequireMyClanDevice(mctx, ctx, app, req.DeviceID)
+		if !ok {
+			return
+		}
+
+		set, unset, err := buildPatch("desired", req.Desired)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid desired state", err.Error())
+			return
+		}
+
+		filter := bson.M{"_id": deviceID}
+		if req.Version != nil {
+			filter["version"] = *req.Version
+		}
+
+		shadow, err := updateShadow(mctx, app, filter, set, unset)
+		if err != nil {
+			// a version mismatch turns the upsert into a duplicate _id insert
+			if mongo.IsDuplicateKeyError(err) {
+				common_controllers.ErrorResponse(ctx, http.StatusConflict, "Version conflict", "shadow was modified, reload and retry")
+				return
+			}
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to update shadow", err.Error())
+			return
+		}
+
+		sendShadow(shadow)
+		common_controllers.SuccessResponse(ctx, "Desired state updated", shadow)
+	}
+}
@@ -0,0 +1,275 @@
+package signaling_controllers
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	common_controllers "github.com/chtan/miniworld/controllers/common"
+	signaling_models "github.com/chtan/miniworld/models/signaling"
+	"github.com/chtan/miniworld/mywebsocket"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// a car that doesn't answer by then is treated as unable to do WebRTC
+const answerTimeout = 15 * time.Second
+
+type session struct {
+	signaling_models.Session
+	// the driver's socket that made the offer
+	owner *mywebsocket.Conn
+	timer *time.Timer
+}
+
+var (
+	sessionsMu sync.Mutex
+	// deviceId -> current peer connection attempt; at most one per car
+	sessions = map[string]*session{}
+)
+
+// ICEServers builds the list handed to both peers from the configuration.
+func ICEServers(app *config.AppConfig) []signaling_models.ICEServer {
+	servers := make([]signaling_models.ICEServer, 0, len(app.ICEServers))
+	for _, url := range app.ICEServers {
+		server := signaling_models.ICEServer{URLs: []string{url}}
+		if !strings.HasPrefix(url, "stun:") {
+			server.Username = app.TURNUsername
+			server.Credential = app.TURNCredential
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+func envelope(msgType, id string, data interface{}) gin.H {
+	return gin.H{"type": msgType, "id": id, "data": data}
+}
+
+func sendError(deviceID, sessionID, msg string) {
+	mywebsocket.SendUserJSON(deviceID, envelope(mywebsocket.TypeError, sessionID, gin.H{"error": msg}))
+}
+
+// current returns the device's session if id matches it, so signaling for a
+// superseded attempt is dropped.
+func current(deviceID, id string) *session {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s := sessions[deviceID]
+	if s == nil || s.ID != id {
+		return nil
+	}
+	return s
+}
+
+func setState(deviceID, id, state string) bool {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s := sessions[deviceID]
+	if s == nil || s.ID != id {
+		return false
+	}
+	s.State = state
+	if state != signaling_models.StateOffered && s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	return true
+}
+
+// EndSession tears down the device's peer connection attempt, if any, and
+// puts the car back on the server relay. Both peers are told why.
+func EndSession(deviceID, reason string) {
+	sessionsMu.Lock()
+	s := sessions[deviceID]
+	delete(sessions, deviceID)
+	if s != nil && s.timer != nil {
+		s.timer.Stop()
+	}
+	sessionsMu.Unlock()
+	if s == nil {
+		return
+	}
+
+	state := signaling_models.StateReport{
+		State:    signaling_models.StateClosed,
+		Reason:   reason,
+		Fallback: signaling_models.CameraModeRelay,
+	}
+	mywebsocket.SendDeviceJSON(deviceID, envelope(mywebsocket.TypeWebRTCHangup, s.ID, state))
+	mywebsocket.SendDeviceJSON(deviceID, envelope(mywebsocket.TypeCameraMode, s.ID, gin.H{"mode": signaling_models.CameraModeRelay}))
+	mywebsocket.SendUserJSON(deviceID, envelope(mywebsocket.TypeWebRTCState, s.ID, state))
+	log.Printf("WebRTC session %s for %s ended: %s", s.ID, deviceID, reason)
+}
+
+// EndUserSession ends the device's session only if it was offered on owner,
+// so a socket closing doesn't cut off whoever took over the car, even when
+// that is the same user on a new connection.
+func EndUserSession(deviceID string, owner *mywebsocket.Conn, reason string) {
+	sessionsMu.Lock()
+	s := sessions[deviceID]
+	mine := s != nil && s.owner == owner
+	sessionsMu.Unlock()
+	if mine {
+		failSession(deviceID, s.ID, reason)
+	}
+}
+
+// failSession ends the session only if it is still the given one.
+func failSession(deviceID, id, reason string) {
+	if current(deviceID, id) != nil {
+		EndSession(deviceID, reason)
+	}
+}
+
+// HandleUserMessage brokers signaling sent by the driver on conn. A new
+// offer replaces any attempt in flight for the car.
+func HandleUserMessage(app *config.AppConfig, userID, deviceID string, conn *mywebsocket.Conn, env mywebsocket.Envelope) bool {
+	switch env.Type {
+	case mywebsocket.TypeWebRTCOffer:
+		var offer signaling_models.SessionDescription
+		if err := json.Unmarshal(env.Data, &offer); err != nil || app.Validator.Struct(offer) != nil {
+			sendError(deviceID, env.ID, "invalid offer")
+			return true
+		}
+		startSession(app, userID, deviceID, conn, offer)
+
+	case mywebsocket.TypeWebRTCICE:
+		var candidate signaling_models.ICECandidate
+		if err := json.Unmarshal(env.Data, &candidate); err != nil || app.Validator.Struct(candidate) != nil {
+			sendError(deviceID, env.ID, "invalid candidate")
+			return true
+		}
+		if current(deviceID, env.ID) == nil {
+			return true
+		}
+		mywebsocket.SendDeviceJSON(deviceID, envelope(mywebsocket.TypeWebRTCICE, env.ID, candidate))
+
+	case mywebsocket.TypeWebRTCState:
+		handleState(app, deviceID, env, false)
+
+	case mywebsocket.TypeWebRTCHangup:
+		failSession(deviceID, env.ID, "user hung up")
+
+	default:
+		return false
+	}
+	return true
+}
+
+// HandleDeviceMessage brokers signaling sent by the car; anything for a
+// superseded session is dropped.
+func HandleDeviceMessage(app *config.AppConfig, deviceID primitive.ObjectID, env mywebsocket.Envelope) bool {
+	id := deviceID.Hex()
+	switch env.Type {
+	case mywebsocket.TypeWebRTCAnswer:
+		var answer signaling_models.SessionDescription
+		if err := json.Unmarshal(env.Data, &answer); err != nil || app.Validator.Struct(answer) != nil {
+			failSession(id, env.ID, "invalid answer from car")
+			return true
+		}
+		if !setState(id, env.ID, signaling_models.StateAnswered) {
+			return true
+		}
+		mywebsocket.SendUserJSON(id, envelope(mywebsocket.TypeWebRTCAnswer, env.ID, answer))
+
+	case mywebsocket.TypeWebRTCICE:
+		var candidate signaling_models.ICECandidate
+		if err := json.Unmarshal(env.Data, &candidate); err != nil || app.Validator.Struct(candidate) != nil {
+			return true
+		}
+		if current(id, env.ID) == nil {
+			return true
+		}
+		mywebsocket.SendUserJSON(id, envelope(mywebsocket.TypeWebRTCICE, env.ID, candidate))
+
+	case mywebsocket.TypeWebRTCState:
+		handleState(app, id, env, true)
+
+	case mywebsocket.TypeWebRTCHangup:
+		failSession(id, env.ID, "car hung up")
+
+	default:
+		return false
+	}
+	return true
+}
+
+func startSession(app *config.AppConfig, userID, deviceID string, owner *mywebsocket.Conn, offer signaling_models.SessionDescription) {
+	// a new offer replaces whatever attempt was in flight
+	EndSession(deviceID, "superseded")
+
+	s := &session{Session: signaling_models.Session{
+		ID:        primitive.NewObjectID().Hex(),
+		UserID:    userID,
+		DeviceID:  deviceID,
+		State:     signaling_models.StateOffered,
+		StartedAt: time.Now(),
+	}, owner: owner}
+	id := s.ID
+	s.timer = time.AfterFunc(answerTimeout, func() {
+		failSession(deviceID, id, "car did not answer")
+	})
+
+	sessionsMu.Lock()
+	sessions[deviceID] = s
+	sessionsMu.Unlock()
+
+	offer.ICEServers = ICEServers(app)
+	if !mywebsocket.SendDeviceJSON(deviceID, envelope(mywebsocket.TypeWebRTCOffer, id, offer)) {
+		failSession(deviceID, id, "car is offline")
+		return
+	}
+	mywebsocket.SendUserJSON(deviceID, envelope(mywebsocket.TypeWebRTCState, id, signaling_models.StateReport{
+		State: signaling_models.StateOffered,
+	}))
+}
+
+// handleState relays a peer's connection state to the other side. Once the
+// peers are connected the car may stop relaying frames; any failure puts it
+// back on the relay.
+func handleState(app *config.AppConfig, deviceID string, env mywebsocket.Envelope, fromDevice bool) {
+	var report signaling_models.StateReport
+	if err := json.Unmarshal(env.Data, &report); err != nil || app.Validator.Struct(report) != nil {
+		return
+	}
+
+	switch report.State {
+	case signaling_models.StateFailed, signaling_models.StateDisconnected, signaling_models.StateClosed:
+		reason := "peer connection " + report.State
+		if report.Reason != "" {
+			reason += ": " + report.Reason
+		}
+		failSession(deviceID, env.ID, reason)
+		return
+	case signaling_models.StateConnected:
+		if !setState(deviceID, env.ID, report.State) {
+			return
+		}
+		mywebsocket.SendDeviceJSON(deviceID, envelope(mywebsocket.TypeCameraMode, env.ID, gin.H{"mode": signaling_models.CameraModeP2P}))
+	default:
+		if current(deviceID, env.ID) == nil {
+			return
+		}
+	}
+
+	if fromDevice {
+		mywebsocket.SendUserJSON(deviceID, envelope(mywebsocket.TypeWebRTCState, env.ID, report))
+	} else {
+		mywebsocket.SendDeviceJSON(deviceID, envelope(mywebsocket.TypeWebRTCState, env.ID, report))
+	}
+}
+
+// GetICEServers returns the ICE servers a driver should create its peer connection with.
+// GET /api/webrtc/config
+func GetICEServers(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		common_controllers.SuccessResponse(ctx, "WebRTC configuration", gin.H{
+			"ice_servers":    ICEServers(app),
+			"answer_timeout": answerTimeout.Milliseconds(),
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package signaling_controllers
+
+import (
+	"testing"
+
+	signaling_models "github.com/chtan/miniworld/models/signaling"
+	"github.com/chtan/miniworld/mywebsocket"
+)
+
+func TestEndUserSessionKeepsTakeover(t *testing.T) {
+	const deviceID = "car"
+	old, reconnected := mywebsocket.NewConn(nil), mywebsocket.NewConn(nil)
+
+	// the same user offered again from a new socket
+	sessionsMu.Lock()
+	sessions[deviceID] = &session{
+		Session: signaling_models.Session{ID: "offer", UserID: "user", DeviceID: deviceID},
+		owner:   reconnected,
+	}
+	sessionsMu.Unlock()
+	t.Cleanup(func() { EndSession(deviceID, "test done") })
+
+	EndUserSession(deviceID, old, "user disconnected")
+	if current(deviceID, "offer") == nil {
+		t.Fatal("the new connection's session was ended by the old one")
+	}
+
+	EndUserSession(deviceID, reconnected, "user disconnected")
+	if current(deviceID, "offer") != nil {
+		t.Error("session kept after its own connection left")
+	}
+}
@@ -0,0 +1,285 @@
+package telemetry_controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	clan_controllers "github.com/chtan/miniworld/controllers/clan"
+	common_controllers "github.com/chtan/miniworld/controllers/common"
+	telemetry_models "github.com/chtan/miniworld/models/telemetry"
+	"github.com/chtan/miniworld/mywebsocket"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	telemetryCollection = "telemetry"
+
+	batchSize     = 200
+	flushInterval = time.Second
+	queueSize     = 4096
+
+	maxQueryLimit = 5000
+	maxBuckets    = 2000
+
+	// samples this late are stored as sent but flagged as backfilled
+	backfillAfter = time.Hour
+	// how far ahead of the server a car's clock may run
+	maxClockSkew = time.Minute
+)
+
+var (
+	recorderOnce sync.Once
+	samples      chan interface{}
+)
+
+// SetTelemetryRetention keeps the time-series collection's retention in
+// line with the configured value. The collection itself is created by the
+// migrations.
+func SetTelemetryRetention(app *config.AppConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return app.Client.Database("miniworld").RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: telemetryCollection},
+		{Key: "expireAfterSeconds", Value: int64(app.TelemetryRetention / time.Second)},
+	}).Err()
+}
+
+// RecordDeviceMessage persists a "telemetry" envelope sent by a car.
+// It reports false for any other message so the caller can handle it.
+func RecordDeviceMessage(app *config.AppConfig, deviceID primitive.ObjectID, env mywebsocket.Envelope) bool {
+	if env.Type != mywebsocket.TypeTelemetry {
+		return false
+	}
+
+	var in telemetry_models.DeviceSample
+	if err := json.Unmarshal(env.Data, &in); err != nil {
+		log.Printf("Dropping malformed telemetry from %s: %v", deviceID.Hex(), err)
+		return true
+	}
+	if err := app.Validator.Struct(in); err != nil {
+		log.Printf("Dropping invalid telemetry from %s: %v", deviceID.Hex(), err)
+		return true
+	}
+
+	now := time.Now()
+	ts := now
+	if in.TimestampMs > 0 {
+		ts = time.UnixMilli(in.TimestampMs)
+	}
+	// a sample from the future or past retention is a broken clock, and
+	// restamping it with server time would put it in the wrong place
+	if ts.After(now.Add(maxClockSkew)) || ts.Before(now.Add(-app.TelemetryRetention)) {
+		log.Printf("Dropping telemetry from %s stamped %s", deviceID.Hex(), ts.Format(time.RFC3339))
+		return true
+	}
+
+	enqueue(app, telemetry_models.Sample{
+		DeviceID:   deviceID,
+		Timestamp:  ts,
+		Battery:    in.Battery,
+		Speed:      in.Speed,
+		RSSI:       in.RSSI,
+		MotorTemp:  in.MotorTemp,
+		Position:   in.Position,
+		Backfilled: ts.Before(now.Add(-backfillAfter)),
+	})
+	return true
+}
+
+func enqueue(app *config.AppConfig, sample telemetry_models.Sample) {
+	recorderOnce.Do(func() {
+		samples = make(chan interface{}, queueSize)
+		go runRecorder(app)
+	})
+
+	select {
+	case samples <- sample:
+	default:
+		log.Printf("Telemetry queue full, dropping sample from %s", sample.DeviceID.Hex())
+	}
+}
+
+// runRecorder batches samples so a chatty fleet costs one insert per second.
+func runRecorder(app *config.AppConfig) {
+	coll := app.Client.Database("miniworld").Collection(telemetryCollection)
+	batch := make([]interface{}, 0, batchSize)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := coll.InsertMany(ctx, batch, options.InsertMany().SetOrdered(false)); err != nil {
+			log.Printf("Failed to write %d telemetry samples: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case s := <-samples:
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// parseRange reads from/to as RFC3339, defaulting to the last hour.
+func parseRange(ctx *gin.Context) (time.Time, time.Time, error) {
+	var from, to time.Time
+	to = time.Now()
+	if v := ctx.Query("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid to: %v", err)
+		}
+		to = t
+	}
+	if v := ctx.Query("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid from: %v", err)
+		}
+		from = t
+	} else {
+		from = to.Add(-time.Hour)
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+// GetTelemetry returns raw samples for one device in a time range.
+// GET /api/telemetry?device_id=&from=&to=&limit=
+func GetTelemetry(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		deviceID, ok := clan_controllers.RequireMyClanDevice(mctx, ctx, app, ctx.Query("device_id"))
+		if !ok {
+			return
+		}
+
+		from, to, err := parseRange(ctx)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid range", err.Error())
+			return
+		}
+
+		limit := int64(1000)
+		if v := ctx.Query("limit"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 || n > maxQueryLimit {
+				common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid limit", fmt.Sprintf("limit must be between 1 and %d", maxQueryLimit))
+				return
+			}
+			limit = n
+		}
+
+		cursor, err := app.Client.Database("miniworld").Collection(telemetryCollection).Find(
+			mctx,
+			bson.M{"device_id": deviceID, "ts": bson.M{"$gte": from, "$lt": to}},
+			options.Find().SetSort(bson.M{"ts": 1}).SetLimit(limit).SetProjection(bson.M{"_id": 0}),
+		)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to query telemetry", err.Error())
+			return
+		}
+		result := []telemetry_models.Sample{}
+		if err := cursor.All(mctx, &result); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to query telemetry", err.Error())
+			return
+		}
+
+		common_controllers.SuccessResponse(ctx, "Telemetry", result)
+	}
+}
+
+// GetTelemetryAggregate downsamples one device's telemetry into fixed buckets.
+// GET /api/telemetry/aggregate?device_id=&from=&to=&interval=1m
+func GetTelemetryAggregate(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		deviceID, ok := clan_controllers.RequireMyClanDevice(mctx, ctx, app, ctx.Query("device_id"))
+		if !ok {
+			return
+		}
+
+		from, to, err := parseRange(ctx)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid range", err.Error())
+			return
+		}
+
+		interval := time.Minute
+		if v := ctx.Query("interval"); v != "" {
+			interval, err = time.ParseDuration(v)
+			if err != nil || interval < time.Second {
+				common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid interval", "interval must be a duration of at least 1s")
+				return
+			}
+		}
+		if to.Sub(from)/interval > maxBuckets {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid interval", fmt.Sprintf("range would produce more than %d buckets", maxBuckets))
+			return
+		}
+
+		pipeline := mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{"device_id": deviceID, "ts": bson.M{"$gte": from, "$lt": to}}}},
+			{{Key: "$sort", Value: bson.M{"ts": 1}}},
+			{{Key: "$group", Value: bson.M{
+				"_id": bson.M{"$dateTrunc": bson.M{
+					"date":    "$ts",
+					"unit":    "second",
+					"binSize": int64(interval / time.Second),
+				}},
+				"count":          bson.M{"$sum": 1},
+				"avg_battery":    bson.M{"$avg": "$battery"},
+				"min_battery":    bson.M{"$min": "$battery"},
+				"avg_speed":      bson.M{"$avg": "$speed"},
+				"max_speed":      bson.M{"$max": "$speed"},
+				"avg_rssi":       bson.M{"$avg": "$rssi"},
+				"avg_motor_temp": bson.M{"$avg": "$motor_temp"},
+				"max_motor_temp": bson.M{"$max": "$motor_temp"},
+				"last_position":  bson.M{"$last": "$position"},
+			}}},
+			{{Key: "$sort", Value: bson.M{"_id": 1}}},
+		}
+
+		cursor, err := app.Client.Database("miniworld").Collection(telemetryCollection).Aggregate(mctx, pipeline)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to aggregate telemetry", err.Error())
+			return
+		}
+		result := []telemetry_models.Bucket{}
+		if err := cursor.All(mctx, &result); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to aggregate telemetry", err.Error())
+			return
+		}
+
+		common_controllers.SuccessResponse(ctx, "Telemetry aggregate", result)
+	}
+}
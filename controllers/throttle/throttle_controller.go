@@ -0,0 +1,181 @@
+package throttle_controllers
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	"github.com/chtan/miniworld/mywebsocket"
+	"github.com/chtan/miniworld/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	burstSeconds = 2
+	// a flooding client gets at most one notice per interval
+	noticeInterval = time.Second
+)
+
+// Reasons a driver's message was not relayed to the car.
+const (
+	ReasonSessionMessages = "session_messages"
+	ReasonSessionBytes    = "session_bytes"
+	ReasonDeviceMessages  = "device_messages"
+	ReasonDeviceBytes     = "device_bytes"
+	// the message is bigger than a byte limit's whole burst and can never pass
+	ReasonTooLarge = "too_large"
+)
+
+// exempt envelopes set up the video call or go through the command queue.
+// They are rare and must get through while the driver floods the car with
+// steering, so they don't spend the driving budget.
+var exempt = map[string]bool{
+	mywebsocket.TypeWebRTCOffer:  true,
+	mywebsocket.TypeWebRTCAnswer: true,
+	mywebsocket.TypeWebRTCICE:    true,
+	mywebsocket.TypeWebRTCHangup: true,
+	mywebsocket.TypeWebRTCState:  true,
+	mywebsocket.TypeCameraMode:   true,
+	mywebsocket.TypeCommand:      true,
+	mywebsocket.TypeCommandAck:   true,
+}
+
+// Exempt reports whether envelopes of the type skip the relay limits.
+func Exempt(envelopeType string) bool {
+	return exempt[envelopeType]
+}
+
+// metrics counts relayed and dropped control messages on this node, with
+// drops split by the limit that hit them.
+var metrics = expvar.NewMap("control_rate_limit")
+
+// deviceLimits are shared by every session relaying to one car on this node.
+type deviceLimits struct {
+	messages *ratelimit.Bucket
+	bytes    *ratelimit.Bucket
+	refs     int
+}
+
+var (
+	devicesMu sync.Mutex
+	// deviceId -> limits of the car
+	devices = map[string]*deviceLimits{}
+)
+
+func bucket(rate float64) *ratelimit.Bucket {
+	return ratelimit.NewBucket(rate, rate*burstSeconds)
+}
+
+// Session limits what one driver's control socket relays to its car.
+type Session struct {
+	deviceID string
+	messages *ratelimit.Bucket
+	bytes    *ratelimit.Bucket
+	device   *deviceLimits
+
+	mu         sync.Mutex
+	dropped    int
+	lastNotice time.Time
+}
+
+// NewSession starts limiting a driver's session with the car. Close it when
+// the session ends.
+func NewSession(app *config.AppConfig, deviceID string) *Session {
+	limits := app.RelayLimits
+
+	devicesMu.Lock()
+	d := devices[deviceID]
+	if d == nil {
+		d = &deviceLimits{
+			messages: bucket(limits.DeviceMessages),
+			bytes:    bucket(limits.DeviceBytes),
+		}
+		devices[deviceID] = d
+	}
+	d.refs++
+	devicesMu.Unlock()
+
+	return &Session{
+		deviceID: deviceID,
+		messages: bucket(limits.SessionMessages),
+		bytes:    bucket(limits.SessionBytes),
+		device:   d,
+	}
+}
+
+func (s *Session) Close() {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	s.device.refs--
+	if s.device.refs == 0 && devices[s.deviceID] == s.device {
+		delete(devices, s.deviceID)
+	}
+}
+
+// check takes a message's worth from every limit, or nothing if any of them
+// is exhausted.
+func (s *Session) check(size int) (string, time.Duration) {
+	n := float64(size)
+	for _, b := range []*ratelimit.Bucket{s.bytes, s.device.bytes} {
+		if !b.Unlimited() && n > b.Burst() {
+			return ReasonTooLarge, 0
+		}
+	}
+
+	limits := []struct {
+		reason string
+		bucket *ratelimit.Bucket
+		tokens float64
+	}{
+		{ReasonSessionMessages, s.messages, 1},
+		{ReasonSessionBytes, s.bytes, n},
+		{ReasonDeviceMessages, s.device.messages, 1},
+		{ReasonDeviceBytes, s.device.bytes, n},
+	}
+	for i, l := range limits {
+		if ok, wait := l.bucket.Reserve(l.tokens); !ok {
+			for _, taken := range limits[:i] {
+				taken.bucket.Refund(taken.tokens)
+			}
+			return l.reason, wait
+		}
+	}
+	return "", 0
+}
+
+// Allow reports whether a message of size bytes may be relayed. A message
+// that may not is counted and reported to the driver on conn.
+func (s *Session) Allow(conn *mywebsocket.Conn, size int) bool {
+	reason, retryAfter := s.check(size)
+	if reason == "" {
+		metrics.Add("relayed", 1)
+		return true
+	}
+	if reason == ReasonTooLarge {
+		metrics.Add("rejected", 1)
+	} else {
+		metrics.Add("throttled", 1)
+	}
+	metrics.Add(reason, 1)
+	metrics.Add("dropped_bytes", int64(size))
+
+	s.mu.Lock()
+	s.dropped++
+	dropped := s.dropped
+	notify := reason == ReasonTooLarge || time.Since(s.lastNotice) >= noticeInterval
+	if notify {
+		s.dropped = 0
+		s.lastNotice = time.Now()
+	}
+	s.mu.Unlock()
+
+	if notify {
+		_ = conn.WriteJSON(gin.H{"type": mywebsocket.TypeRateLimited, "data": gin.H{
+			"reason":         reason,
+			"dropped":        dropped,
+			"retry_after_ms": retryAfter.Milliseconds(),
+		}})
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package ticket_controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	clan_controllers "github.com/chtan/miniworld/controllers/clan"
+	common_controllers "github.com/chtan/miniworld/controllers/common"
+	recording_controllers "github.com/chtan/miniworld/controllers/recording"
+	user_controllers "github.com/chtan/miniworld/controllers/user"
+	ticket_models "github.com/chtan/miniworld/models/ticket"
+	user_models "github.com/chtan/miniworld/models/user"
+	"github.com/chtan/miniworld/repository"
+	"github.com/chtan/miniworld/token"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TicketTTL is how long a ticket can wait to be used.
+const TicketTTL = 30 * time.Second
+
+func hashTicket(ticket string) string {
+	sum := sha256.Sum256([]byte(ticket))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueTicket exchanges the caller's access token for a single-use ticket
+// to open one websocket, for browsers that can't send an Authorization
+// header with the handshake. Pass it as ?ticket= within TicketTTL.
+// POST /api/wsticket {"stream": "control|camera|replay|lobby", "device_id": "...", "recording_id": "..."}
+func IssueTicket(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req ticket_models.TicketRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+
+		userDetails, err := common_controllers.GetMyId(mctx, ctx, app)
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		ticket := ticket_models.Ticket{
+			UserID:    userDetails.ID,
+			Stream:    req.Stream,
+			CreatedAt: time.Now(),
+			ExpiresAt: time.Now().Add(TicketTTL),
+		}
+		switch req.Stream {
+		case ticket_models.StreamControl, ticket_models.StreamCamera:
+			deviceID, ok := clan_controllers.RequireMyClanDevice(mctx, ctx, app, req.DeviceID)
+			if !ok {
+				return
+			}
+			ticket.DeviceID = deviceID
+		case ticket_models.StreamReplay:
+			recordingID, err := primitive.ObjectIDFromHex(req.RecordingID)
+			if err != nil {
+				common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid recording id", "replay tickets need the recording_id to play")
+				return
+			}
+			if _, err := recording_controllers.LoadMyRecording(mctx, app, recordingID, userDetails.ID); err != nil {
+				common_controllers.ErrorResponse(ctx, http.StatusNotFound, "Recording not found", "No such recording for your clans")
+				return
+			}
+			ticket.RecordingID = recordingID
+		case ticket_models.StreamLobby:
+		default:
+			common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid stream", "stream must be control, camera, replay or lobby")
+			return
+		}
+
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to issue ticket", err.Error())
+			return
+		}
+		secret := base64.RawURLEncoding.EncodeToString(raw)
+		ticket.ID = hashTicket(secret)
+
+		if err := app.Repos.Tickets.Put(mctx, ticket); err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to issue ticket", err.Error())
+			return
+		}
+		common_controllers.SuccessResponse(ctx, "Ticket issued", gin.H{
+			"ticket":       secret,
+			"stream":       ticket.Stream,
+			"device_id":    req.DeviceID,
+			"recording_id": req.RecordingID,
+			"expires_at":   ticket.ExpiresAt,
+		})
+	}
+}
+
+// redeem uses up a ticket for the stream and its target: the device for
+// control and camera, the recording for replay. A ticket presented for the
+// wrong target is used up all the same.
+func redeem(mctx context.Context, app *config.AppConfig, secret, stream, target string) (primitive.ObjectID, string) {
+	ticket, err := app.Repos.Tickets.Take(mctx, hashTicket(secret))
+	if err == repository.ErrNotFound {
+		return primitive.NilObjectID, "invalid or expired ticket"
+	}
+	if err != nil {
+		log.Printf("Database error during ticket check: %v", err)
+		return primitive.NilObjectID, "internal server error"
+	}
+	switch {
+	case ticket.Stream != stream:
+		return primitive.NilObjectID, "ticket was issued for another stream"
+	case !ticket.DeviceID.IsZero() && ticket.DeviceID.Hex() != target:
+		return primitive.NilObjectID, "ticket was issued for another device"
+	case !ticket.RecordingID.IsZero() && ticket.RecordingID.Hex() != target:
+		return primitive.NilObjectID, "ticket was issued for another recording"
+	}
+	return ticket.UserID, ""
+}
+
+// AuthenticateUser identifies the user opening a websocket, by the
+// Authorization header or by a ?ticket= issued for this stream and target.
+// The target is the device id for control and camera streams, the recording
+// id for replay, and ignored for the lobby. Either way the session must be
+// live and, for device-bound streams, the device must still be in one of the
+// user's clans.
+func AuthenticateUser(mctx context.Context, ctx *gin.Context, app *config.AppConfig, stream, target string) (*user_models.User, string) {
+	user, idError := identify(mctx, ctx, app, stream, target)
+	if idError != "" {
+		return nil, idError
+	}
+
+	switch stream {
+	case ticket_models.StreamControl, ticket_models.StreamCamera:
+		deviceObjID, err := primitive.ObjectIDFromHex(target)
+		if err != nil {
+			return nil, "invalid device id"
+		}
+		ok, err := clan_controllers.IsMyClanDevice(mctx, app, user.ID, deviceObjID)
+		if err != nil {
+			return nil, "failed to load device"
+		}
+		if !ok {
+			return nil, "device is not in any of your clans"
+		}
+	}
+	return user, ""
+}
+
+func identify(mctx context.Context, ctx *gin.Context, app *config.AppConfig, stream, target string) (*user_models.User, string) {
+	if secret := ctx.Query("ticket"); secret != "" && ctx.GetHeader("Authorization") == "" {
+		userID, idError := redeem(mctx, app, secret, stream, target)
+		if idError != "" {
+			return nil, idError
+		}
+		// the ticket outlives the token it was issued for, so check the user
+		user, err := app.Repos.Users.Get(mctx, userID)
+		if err != nil {
+			return nil, err.Error()
+		}
+		if user.Revoked {
+			return nil, "user signed out"
+		}
+		return &user_models.User{ID: user.ID}, ""
+	}
+
+	clientToken, err := common_controllers.GetMyToken(ctx)
+	if err != nil {
+		return nil, err.Error()
+	}
+	claims, err := token.ValidateToken(clientToken, app)
+	if err != nil {
+		return nil, err.Error()
+	}
+	// as the Authentication middleware does for the rest of the API
+	if app.RequireDBCheck {
+		switch err := app.Repos.Sessions.Check(mctx, repository.UserSessions, claims.UID, clientToken); err {
+		case nil:
+		case repository.ErrNotFound:
+			return nil, "token not found or user unauthorized"
+		case repository.ErrRevoked:
+			return nil, "token has been revoked"
+		default:
+			log.Printf("Database error during token check: %v", err)
+			return nil, "internal server error"
+		}
+	}
+	return user_controllers.GetUserDetails(mctx, app, clientToken)
+}
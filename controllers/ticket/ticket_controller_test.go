@@ -0,0 +1,137 @@
+package ticket_controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	auth_models "github.com/chtan/miniworld/models/auth"
+	clan_models "github.com/chtan/miniworld/models/clan"
+	device_models "github.com/chtan/miniworld/models/device"
+	ticket_models "github.com/chtan/miniworld/models/ticket"
+	"github.com/chtan/miniworld/repository"
+	"github.com/chtan/miniworld/token"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestAuthenticateUserByHeader(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	repos := repository.NewMemory()
+	app := &config.AppConfig{
+		Settings:       config.DefaultSettings(),
+		Repos:          repos,
+		SecretKey:      []byte("test secret"),
+		RequireDBCheck: true,
+	}
+
+	user := auth_models.SetSignUpModel{ID: primitive.NewObjectID(), Email: "driver@example.com"}
+	clan := clan_models.Clan{ID: primitive.NewObjectID(), AdminID: user.ID, ClanDetails: &clan_models.ClanDetails{Name: "Racers", Tag: "RCR"}}
+	mine := device_models.Device{ID: primitive.NewObjectID(), ClanID: clan.ID, AdminID: user.ID}
+	theirs := device_models.Device{ID: primitive.NewObjectID(), ClanID: primitive.NewObjectID()}
+	if err := repos.Users.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Clans.Create(ctx, clan); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []device_models.Device{mine, theirs} {
+		if err := repos.Devices.Create(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pair, err := token.GenerateTokenPair(user.Email, user.ID, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Sessions.Issue(ctx, repository.UserSessions, user.ID, pair); err != nil {
+		t.Fatal(err)
+	}
+
+	authenticate := func(stream, deviceID string) string {
+		ginCtx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ginCtx.Request = httptest.NewRequest(http.MethodGet, "/ws/user?deviceId="+deviceID, nil)
+		ginCtx.Request.Header.Set("Authorization", "Bearer "+pair.AccessToken)
+		details, idError := AuthenticateUser(ctx, ginCtx, app, stream, deviceID)
+		if idError == "" && details.ID != user.ID {
+			t.Fatalf("authenticated as %s, want %s", details.ID.Hex(), user.ID.Hex())
+		}
+		return idError
+	}
+
+	if idError := authenticate(ticket_models.StreamControl, mine.ID.Hex()); idError != "" {
+		t.Errorf("own device: %s", idError)
+	}
+	if idError := authenticate(ticket_models.StreamLobby, ""); idError != "" {
+		t.Errorf("lobby: %s", idError)
+	}
+	if idError := authenticate(ticket_models.StreamCamera, theirs.ID.Hex()); idError == "" {
+		t.Error("authenticated for another clan's device")
+	}
+	if idError := authenticate(ticket_models.StreamControl, "not-an-id"); idError == "" {
+		t.Error("authenticated for a malformed device id")
+	}
+
+	if err := repos.Sessions.Revoke(ctx, repository.UserSessions, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if idError := authenticate(ticket_models.StreamLobby, ""); idError == "" {
+		t.Error("authenticated with a revoked session")
+	}
+}
+
+func TestRedeem(t *testing.T) {
+	ctx := context.Background()
+	app := &config.AppConfig{Settings: config.DefaultSettings(), Repos: repository.NewMemory()}
+	userID := primitive.NewObjectID()
+	device, recording := primitive.NewObjectID(), primitive.NewObjectID()
+
+	issue := func(secret string, ticket ticket_models.Ticket) {
+		t.Helper()
+		ticket.ID = hashTicket(secret)
+		ticket.UserID = userID
+		if ticket.ExpiresAt.IsZero() {
+			ticket.ExpiresAt = time.Now().Add(TicketTTL)
+		}
+		if err := app.Repos.Tickets.Put(ctx, ticket); err != nil {
+			t.Fatal(err)
+		}
+	}
+	issue("control", ticket_models.Ticket{Stream: ticket_models.StreamControl, DeviceID: device})
+	issue("camera", ticket_models.Ticket{Stream: ticket_models.StreamCamera, DeviceID: device})
+	issue("other-device", ticket_models.Ticket{Stream: ticket_models.StreamControl, DeviceID: device})
+	issue("replay", ticket_models.Ticket{Stream: ticket_models.StreamReplay, RecordingID: recording})
+	issue("other-recording", ticket_models.Ticket{Stream: ticket_models.StreamReplay, RecordingID: recording})
+	issue("expired", ticket_models.Ticket{Stream: ticket_models.StreamLobby, ExpiresAt: time.Now().Add(-time.Second)})
+
+	tests := []struct {
+		name    string
+		secret  string
+		stream  string
+		target  string
+		success bool
+	}{
+		{"control", "control", ticket_models.StreamControl, device.Hex(), true},
+		{"used twice", "control", ticket_models.StreamControl, device.Hex(), false},
+		{"wrong stream", "camera", ticket_models.StreamControl, device.Hex(), false},
+		{"used up by the wrong stream", "camera", ticket_models.StreamCamera, device.Hex(), false},
+		{"wrong device", "other-device", ticket_models.StreamControl, primitive.NewObjectID().Hex(), false},
+		{"replay", "replay", ticket_models.StreamReplay, recording.Hex(), true},
+		{"wrong recording", "other-recording", ticket_models.StreamReplay, primitive.NewObjectID().Hex(), false},
+		{"expired", "expired", ticket_models.StreamLobby, "", false},
+		{"unknown", "never issued", ticket_models.StreamLobby, "", false},
+	}
+	for _, tt := range tests {
+		got, idError := redeem(ctx, app, tt.secret, tt.stream, tt.target)
+		if tt.success && (idError != "" || got != userID) {
+			t.Errorf("%s: redeemed for %s (%q), want %s", tt.name, got.Hex(), idError, userID.Hex())
+		}
+		if !tt.success && idError == "" {
+			t.Errorf("%s: ticket accepted", tt.name)
+		}
+	}
+}
@@ -13,14 +13,15 @@ import (
 	"github.com/chtan/miniworld/helper"
 	auth_models "github.com/chtan/miniworld/models/auth"
 	common_models "github.com/chtan/miniworld/models/common"
+	"github.com/chtan/miniworld/repository"
 	"github.com/chtan/miniworld/token"
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// maxOTPAttempts is how many wrong OTPs a signup survives.
+const maxOTPAttempts = 4
+
 func SignUp(app *config.AppConfig) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -32,7 +33,7 @@ func SignUp(app *config.AppConfig) gin.HandlerFunc {
 			return
 		}
 
-		if helper.IsFieldUsed(app, mctx, ctx, "email", getSignupDetails.Email) {
+		if helper.IsEmailUsed(app, mctx, ctx, getSignupDetails.Email) {
 			return
 		}
 		password, err := common_controllers.HashPassword(getSignupDetails.Password)
@@ -47,13 +48,11 @@ func SignUp(app *config.AppConfig) gin.HandlerFunc {
 		getSignupDetails.Count = 0
 
 		message := fmt.Sprintf("Hello, your OTP is %d. Please keep it confidential.", getSignupDetails.OTP)
-		if !common_controllers.SendMail(getSignupDetails.Email, message) {
+		if !common_controllers.SendMail(app, getSignupDetails.Email, message) {
 			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Error In OTP", "Failed to Send OTP")
 			return
 		}
-		// Create TTL index on tempOtps collection (run once)
-		CreateTTLIndex(app.Client.Database("miniworld").Collection("tempData"))
-		insertTempErr := InsertTempUsers(app.Client.Database("miniworld").Collection("tempData"), getSignupDetails)
+		insertTempErr := InsertTempUsers(mctx, app, getSignupDetails)
 		if insertTempErr != nil {
 			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Temperory users", "Failed to save temporary user")
 			return
@@ -78,15 +77,12 @@ func ValidateOtpAndSaveUser(app *config.AppConfig) gin.HandlerFunc {
 			return
 		}
 
-		filter := bson.M{
-			"_id":   objID,
-			"count": bson.M{"$lt": 4},
+		getSignupDetails, err := app.Repos.TempSignups.Get(mctx, objID)
+		if err == nil && getSignupDetails.Count >= maxOTPAttempts {
+			err = repository.ErrNotFound
 		}
-
-		var getSignupDetails auth_models.GetSignUpModel
-		err = app.Client.Database("miniworld").Collection("tempData").FindOne(mctx, filter).Decode(&getSignupDetails)
 		if err != nil {
-			if err == mongo.ErrNoDocuments {
+			if err == repository.ErrNotFound {
 				common_controllers.ErrorResponse(ctx, http.StatusNotFound, "Not data found", err.Error())
 
 			} else {
@@ -96,11 +92,7 @@ func ValidateOtpAndSaveUser(app *config.AppConfig) gin.HandlerFunc {
 		}
 
 		if getSignupDetails.OTP != validateOTP.OTP {
-			_, updateErr := app.Client.Database("miniworld").Collection("tempData").UpdateOne(
-				mctx,
-				bson.M{"_id": validateOTP.ID},
-				bson.M{"$inc": bson.M{"count": 1}},
-			)
+			updateErr := app.Repos.TempSignups.FailAttempt(mctx, objID)
 			if updateErr != nil {
 				common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to update attempt count", updateErr.Error())
 				return
@@ -109,7 +101,7 @@ func ValidateOtpAndSaveUser(app *config.AppConfig) gin.HandlerFunc {
 			return
 		}
 
-		if helper.IsFieldUsed(app, mctx, ctx, "email", getSignupDetails.Email) {
+		if helper.IsEmailUsed(app, mctx, ctx, getSignupDetails.Email) {
 			return
 		}
 
@@ -135,11 +127,18 @@ func ValidateOtpAndSaveUser(app *config.AppConfig) gin.HandlerFunc {
 		setSignUpModel.Access_Token = tokenPair.AccessToken
 		setSignUpModel.Refresh_Token = tokenPair.RefreshToken
 
-		_, err = app.Client.Database("miniworld").Collection("users").InsertOne(mctx, setSignUpModel)
+		err = app.Repos.Users.Create(mctx, setSignUpModel)
 		if err != nil {
+			if err == repository.ErrDuplicate {
+				common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Failed to save user", "email is already used")
+				return
+			}
 			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to save user", err.Error())
 			return
 		}
+		if err := app.Repos.TempSignups.Delete(mctx, objID); err != nil {
+			log.Printf("Failed to delete temporary user %s: %v", objID.Hex(), err)
+		}
 
 		common_controllers.SuccessResponse(ctx, "User Created Successfully", gin.H{
 			"access_token":  tokenPair.AccessToken,
@@ -160,11 +159,10 @@ func SignIn(app *config.AppConfig) gin.HandlerFunc {
 			return
 		}
 
-		var user auth_models.SetSignUpModel
 		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
-		err := app.Client.Database("miniworld").Collection("users").FindOne(mctx, bson.M{"email": creds.Email}).Decode(&user)
+		user, err := app.Repos.Users.ByEmail(mctx, creds.Email)
 		if err != nil {
 			common_controllers.ErrorResponse(ctx, http.StatusUnauthorized, "Invalid credentials", err.Error())
 			return
@@ -182,16 +180,7 @@ func SignIn(app *config.AppConfig) gin.HandlerFunc {
 		}
 
 		// Update tokens in the database
-		_, err = app.Client.Database("miniworld").Collection("users").UpdateOne(
-			mctx,
-			bson.M{"_id": user.ID},
-			bson.M{"$set": bson.M{
-				"access_token":  tokenPair.AccessToken,
-				"refresh_token": tokenPair.RefreshToken,
-				"updated_at":    time.Now(),
-				"revoked":       false,
-			}},
-		)
+		err = app.Repos.Sessions.Issue(mctx, repository.UserSessions, user.ID, tokenPair)
 		if err != nil {
 			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to update tokens", err.Error())
 			return
@@ -248,12 +237,10 @@ func Logout(app *config.AppConfig) gin.HandlerFunc {
 			return
 		}
 
-		uid := ctx.GetString("uid")
+		uid, _ := ctx.MustGet("_id").(primitive.ObjectID)
 		mctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		_, err := app.Client.Database("miniworld").Collection("users").UpdateOne(mctx, bson.M{"user_id": uid}, bson.M{
-			"$set": bson.M{"revoked": true, "updated_at": time.Now().Unix()},
-		})
+		err := app.Repos.Sessions.Revoke(mctx, repository.UserSessions, uid)
 		if err != nil {
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to logout"})
 			return
@@ -262,21 +249,8 @@ func Logout(app *config.AppConfig) gin.HandlerFunc {
 	}
 }
 
-func CreateTTLIndex(collection *mongo.Collection) {
-	index := mongo.IndexModel{
-		Keys:    bson.D{{Key: "expires_at", Value: 1}}, // Accending index on expireAt
-		Options: options.Index().SetExpireAfterSeconds(0),
-	}
-	_, err := collection.Indexes().CreateOne(context.Background(), index)
-	if err != nil {
-		log.Fatal("Failed to create TTL index:", err)
-	}
-	log.Println("TTL index created on expireAt field")
-}
-
-func InsertTempUsers(collection *mongo.Collection, userDetails auth_models.GetSignUpModel) error {
+func InsertTempUsers(mctx context.Context, app *config.AppConfig, userDetails auth_models.GetSignUpModel) error {
 	userDetails.Expires_At = time.Now().Add(5 * time.Minute)
 
-	_, err := collection.InsertOne(context.Background(), userDetails)
-	return err
+	return app.Repos.TempSignups.Put(mctx, userDetails)
 }
@@ -0,0 +1,154 @@
+package websocket_controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	clan_controllers "github.com/chtan/miniworld/controllers/clan"
+	common_controllers "github.com/chtan/miniworld/controllers/common"
+	"github.com/chtan/miniworld/mywebsocket"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	mjpegBoundary = "frame"
+	maxMJPEGFPS   = 30
+
+	// a cached frame older than this is stale; wait for the next one instead
+	snapshotMaxAge  = 5 * time.Second
+	snapshotTimeout = 3 * time.Second
+)
+
+func isJPEG(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0xFF, 0xD8})
+}
+
+// GetCameraMJPEG streams a car's camera as multipart/x-mixed-replace JPEG,
+// which browsers render natively in an <img> tag.
+// GET /api/camera/mjpeg?device_id=&fps=
+func GetCameraMJPEG(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		deviceID, ok := clan_controllers.RequireMyClanDevice(mctx, ctx, app, ctx.Query("device_id"))
+		if !ok {
+			return
+		}
+
+		var minGap time.Duration
+		if v := ctx.Query("fps"); v != "" {
+			fps, err := strconv.Atoi(v)
+			if err != nil || fps <= 0 || fps > maxMJPEGFPS {
+				common_controllers.ErrorResponse(ctx, http.StatusBadRequest, "Invalid fps", fmt.Sprintf("fps must be between 1 and %d", maxMJPEGFPS))
+				return
+			}
+			minGap = time.Second / time.Duration(fps)
+		}
+
+		viewer := mywebsocket.Frames.Subscribe(deviceID.Hex())
+		defer viewer.Close()
+
+		ctx.Header("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+		ctx.Header("Cache-Control", "no-cache, no-store, must-revalidate")
+		ctx.Header("Connection", "close")
+		ctx.Status(http.StatusOK)
+
+		writeFrame := func(f mywebsocket.Frame) error {
+			if _, err := fmt.Fprintf(ctx.Writer, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", mjpegBoundary, len(f.Data)); err != nil {
+				return err
+			}
+			if _, err := ctx.Writer.Write(f.Data); err != nil {
+				return err
+			}
+			if _, err := ctx.Writer.Write([]byte("\r\n")); err != nil {
+				return err
+			}
+			ctx.Writer.Flush()
+			return nil
+		}
+
+		// start with the latest frame so the image isn't blank until the next one
+		var last time.Time
+		if f, ok := mywebsocket.Frames.Latest(deviceID.Hex()); ok && isJPEG(f.Data) {
+			if writeFrame(f) != nil {
+				return
+			}
+			last = f.At
+		}
+
+		done := ctx.Request.Context().Done()
+		for {
+			select {
+			case <-done:
+				return
+			case f, ok := <-viewer.C:
+				if !ok {
+					return
+				}
+				if !isJPEG(f.Data) || f.At.Sub(last) < minGap {
+					continue
+				}
+				if writeFrame(f) != nil {
+					return
+				}
+				last = f.At
+			}
+		}
+	}
+}
+
+// GetCameraSnapshot returns a single JPEG frame from a car's camera.
+// GET /api/camera/snapshot?device_id=
+func GetCameraSnapshot(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		deviceID, ok := clan_controllers.RequireMyClanDevice(mctx, ctx, app, ctx.Query("device_id"))
+		if !ok {
+			return
+		}
+
+		// Subscribe first so a frame arriving during the check isn't missed
+		viewer := mywebsocket.Frames.Subscribe(deviceID.Hex())
+		defer viewer.Close()
+
+		frame, ok := mywebsocket.Frames.Latest(deviceID.Hex())
+		if !ok || !isJPEG(frame.Data) || time.Since(frame.At) > snapshotMaxAge {
+			ok = false
+			timeout := time.NewTimer(snapshotTimeout)
+			defer timeout.Stop()
+		wait:
+			for {
+				select {
+				case f, open := <-viewer.C:
+					if !open {
+						break wait
+					}
+					if isJPEG(f.Data) {
+						frame, ok = f, true
+						break wait
+					}
+				case <-timeout.C:
+					break wait
+				case <-ctx.Request.Context().Done():
+					return
+				}
+			}
+		}
+		if !ok {
+			common_controllers.ErrorResponse(ctx, http.StatusServiceUnavailable, "No frame available", "camera is not streaming")
+			return
+		}
+
+		ctx.Header("Cache-Control", "no-store")
+		ctx.Header("Last-Modified", frame.At.UTC().Format(http.TimeFormat))
+		ctx.Data(http.StatusOK, "image/jpeg", frame.Data)
+	}
+}
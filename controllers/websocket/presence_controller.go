@@ -0,0 +1,113 @@
+package websocket_controllers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	clan_controllers "github.com/chtan/miniworld/controllers/clan"
+	common_controllers "github.com/chtan/miniworld/controllers/common"
+	ticket_controllers "github.com/chtan/miniworld/controllers/ticket"
+	ticket_models "github.com/chtan/miniworld/models/ticket"
+	"github.com/chtan/miniworld/mywebsocket"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const lobbyPingInterval = 30 * time.Second
+
+// ws://server/api/ws/lobby[?ticket=<ticket>]
+//
+// Pushes presence changes for every device in the user's clans. The first
+// message is a snapshot, every following message is a mywebsocket.Event.
+// Another snapshot replaces the client's state if it fell behind.
+func HandleLobbyWS(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		// 1) AUTH BEFORE WEBSOCKET UPGRADE
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		userDetails, idError := ticket_controllers.AuthenticateUser(mctx, ctx, app, ticket_models.StreamLobby, "")
+		if idError != "" {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": idError})
+			return
+		}
+
+		deviceIDs, err := clan_controllers.GetMyClanDeviceIDs(mctx, app, userDetails.ID)
+		if err != nil {
+			common_controllers.ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load clan devices", err.Error())
+			return
+		}
+		watched := make(map[string]bool, len(deviceIDs))
+		for _, id := range deviceIDs {
+			watched[id] = true
+		}
+
+		// Subscribe before the snapshot so no change slips in between.
+		events, unsubscribe := mywebsocket.Events.Subscribe()
+		defer func() { unsubscribe() }()
+
+		// 2) UPGRADE TO WEBSOCKET AFTER AUTH
+		conn, err := newUpgrader(app).Upgrade(ctx.Writer, ctx.Request, nil)
+		if err != nil {
+			log.Println("❌ Lobby upgrade error:", err)
+			return
+		}
+		defer mywebsocket.Track(conn)()
+		defer conn.Close()
+
+		snapshot := func() error {
+			return conn.WriteJSON(gin.H{
+				"type":    "snapshot",
+				"devices": mywebsocket.Events.Snapshot(deviceIDs),
+			})
+		}
+		if err := snapshot(); err != nil {
+			return
+		}
+
+		// The lobby is push-only; reading just detects the client going away.
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		ping := time.NewTicker(lobbyPingInterval)
+		defer ping.Stop()
+
+		// 3) PUSH LOOP
+		for {
+			select {
+			case <-closed:
+				return
+			case <-ping.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+					return
+				}
+			case ev, ok := <-events:
+				if !ok {
+					// we fell behind and missed events; start over
+					events, unsubscribe = mywebsocket.Events.Subscribe()
+					if err := snapshot(); err != nil {
+						return
+					}
+					continue
+				}
+				if !watched[ev.DeviceID] {
+					continue
+				}
+				if err := conn.WriteJSON(ev); err != nil {
+					log.Println("⚠️ Lobby write error:", err)
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package websocket_controllers
+
+import (
+	"log"
+	"time"
+
+	"github.com/chtan/miniworld/mywebsocket"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	qualityInterval = 2 * time.Second
+	viewerPingEvery = 2 * time.Second
+
+	// a viewer steps down when it falls this far behind...
+	congestedQueue = 0.75
+	congestedRTT   = 800 * time.Millisecond
+	// ...and back up only after this many calm checks in a row
+	calmQueue  = 1
+	calmRTT    = 250 * time.Millisecond
+	calmChecks = 3
+
+	defaultQualityLevel = 2
+)
+
+// QualityLevel is one step of the camera settings ladder, lowest first.
+type QualityLevel struct {
+	Level       int `json:"level"`
+	FPS         int `json:"fps"`
+	Width       int `json:"width"`
+	Height      int `json:"height"`
+	JPEGQuality int `json:"jpeg_quality"` // 1-100, higher is better
+}
+
+var qualityLevels = []QualityLevel{
+	{Level: 0, FPS: 5, Width: 320, Height: 240, JPEGQuality: 40},
+	{Level: 1, FPS: 10, Width: 640, Height: 480, JPEGQuality: 50},
+	{Level: 2, FPS: 15, Width: 640, Height: 480, JPEGQuality: 70},
+	{Level: 3, FPS: 20, Width: 1280, Height: 720, JPEGQuality: 80},
+}
+
+// viewerQuality is what the controller remembers about one viewer between checks.
+type viewerQuality struct {
+	level   int
+	dropped uint64
+	calm    int
+}
+
+// nextLevel moves a viewer one step down when it is congested and one step
+// up after a run of calm checks.
+func (q *viewerQuality) nextLevel(stats mywebsocket.ViewerStats) int {
+	dropped := stats.Dropped > q.dropped
+	q.dropped = stats.Dropped
+
+	congested := dropped ||
+		float64(stats.Queue) >= congestedQueue*float64(stats.Capacity) ||
+		stats.RTT > congestedRTT
+	if congested {
+		q.calm = 0
+		if q.level > 0 {
+			q.level--
+		}
+		return q.level
+	}
+
+	if stats.Queue <= calmQueue && stats.RTT <= calmRTT {
+		q.calm++
+		if q.calm >= calmChecks && q.level < len(qualityLevels)-1 {
+			q.level++
+			q.calm = 0
+		}
+	}
+	return q.level
+}
+
+// runQualityControl periodically picks the lowest level every viewer of the
+// camera can keep up with and tells the camera when it changes.
+func runQualityControl(camConn *mywebsocket.Conn, deviceID string, done <-chan struct{}) {
+	ticker := time.NewTicker(qualityInterval)
+	defer ticker.Stop()
+
+	viewers := map[*mywebsocket.Viewer]*viewerQuality{}
+	sent := -1
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		current := mywebsocket.Frames.Viewers(deviceID)
+		if len(current) == 0 {
+			// nobody watching; keep whatever was last asked for
+			viewers = map[*mywebsocket.Viewer]*viewerQuality{}
+			continue
+		}
+
+		live := make(map[*mywebsocket.Viewer]*viewerQuality, len(current))
+		level := len(qualityLevels) - 1
+		for _, v := range current {
+			q, ok := viewers[v]
+			if !ok {
+				// new viewers start where the camera already is
+				start := sent
+				if start < 0 {
+					start = defaultQualityLevel
+				}
+				q = &viewerQuality{level: start, dropped: v.Stats().Dropped}
+			}
+			live[v] = q
+			level = min(level, q.nextLevel(v.Stats()))
+		}
+		viewers = live
+
+		if level == sent {
+			continue
+		}
+		if err := camConn.WriteJSON(gin.H{"type": mywebsocket.TypeCameraQuality, "data": qualityLevels[level]}); err != nil {
+			return
+		}
+		log.Printf("Camera %s quality set to level %d for %d viewers", deviceID, level, len(current))
+		sent = level
+	}
+}
+
+// streamToViewer writes hub frames to a websocket viewer until it is closed.
+func streamToViewer(conn *mywebsocket.Conn, viewer *mywebsocket.Viewer) {
+	for f := range viewer.C {
+		if err := conn.WriteMessage(websocket.BinaryMessage, f.Data); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package websocket_controllers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	recording_controllers "github.com/chtan/miniworld/controllers/recording"
+	ticket_controllers "github.com/chtan/miniworld/controllers/ticket"
+	recording_models "github.com/chtan/miniworld/models/recording"
+	ticket_models "github.com/chtan/miniworld/models/ticket"
+	"github.com/chtan/miniworld/mywebsocket"
+	"github.com/chtan/miniworld/recording"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	minReplaySpeed = 0.1
+	maxReplaySpeed = 16
+)
+
+// replayClock maps recording offsets to wall time at a given speed.
+type replayClock struct {
+	base       time.Time
+	baseOffset time.Duration
+	speed      float64
+	paused     bool
+}
+
+func (c *replayClock) now() time.Duration {
+	if c.paused {
+		return c.baseOffset
+	}
+	return c.baseOffset + time.Duration(float64(time.Since(c.base))*c.speed)
+}
+
+func (c *replayClock) reset(offset time.Duration) {
+	c.base = time.Now()
+	c.baseOffset = offset
+}
+
+// due is the wall time at which a record at offset should be sent.
+func (c *replayClock) due(offset time.Duration) time.Time {
+	return c.base.Add(time.Duration(float64(offset-c.baseOffset) / c.speed))
+}
+
+func parseSpeed(v string) (float64, bool) {
+	speed, err := strconv.ParseFloat(v, 64)
+	return speed, err == nil && speed >= minReplaySpeed && speed <= maxReplaySpeed
+}
+
+// ws://server/api/ws/replay?id=<recordingId>&speed=1&from_ms=0&stream=all[&ticket=<ticket>]
+//
+// Plays a recording back with the framing of the live sockets: camera frames
+// as binary messages, control messages as the text frames the car sent.
+// stream=camera or stream=control limits playback to one channel so a viewer
+// can open one replay socket per live socket it normally uses. The client
+// may send replay_seek {offset_ms}, replay_speed {speed}, replay_pause and
+// replay_resume envelopes.
+func HandleReplayWS(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		// 1) AUTH BEFORE WEBSOCKET UPGRADE
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		userDetails, idError := ticket_controllers.AuthenticateUser(mctx, ctx, app, ticket_models.StreamReplay, ctx.Query("id"))
+		if idError != "" {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": idError})
+			return
+		}
+
+		recordingID, err := primitive.ObjectIDFromHex(ctx.Query("id"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+
+		clock := &replayClock{speed: 1}
+		if v := ctx.Query("speed"); v != "" {
+			speed, ok := parseSpeed(v)
+			if !ok {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "speed must be between 0.1 and 16"})
+				return
+			}
+			clock.speed = speed
+		}
+		var from time.Duration
+		if v := ctx.Query("from_ms"); v != "" {
+			ms, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || ms < 0 {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid from_ms"})
+				return
+			}
+			from = time.Duration(ms) * time.Millisecond
+		}
+		var only recording.Stream
+		switch ctx.DefaultQuery("stream", "all") {
+		case "all":
+		case "control":
+			only = recording.StreamControl
+		case "camera":
+			only = recording.StreamCamera
+		default:
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "stream must be all, control or camera"})
+			return
+		}
+
+		rec, err := recording_controllers.LoadMyRecording(mctx, app, recordingID, userDetails.ID)
+		if err == mongo.ErrNoDocuments {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "recording not found"})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if rec.Status != recording_models.StatusComplete {
+			ctx.JSON(http.StatusConflict, gin.H{"error": "recording is " + rec.Status})
+			return
+		}
+
+		reader, release, err := recording_controllers.OpenRecording(rec)
+		if err != nil {
+			ctx.JSON(http.StatusBadGateway, gin.H{"error": "failed to fetch recording"})
+			return
+		}
+		defer release()
+
+		pos := reader.First()
+		if from > 0 {
+			if pos, err = reader.Seek(from); err != nil {
+				ctx.JSON(http.StatusConflict, gin.H{"error": "recording can't be seeked"})
+				return
+			}
+		}
+
+		// 2) UPGRADE TO WEBSOCKET AFTER AUTH
+		conn, err := newUpgrader(app).Upgrade(ctx.Writer, ctx.Request, nil)
+		if err != nil {
+			log.Println("❌ Replay upgrade error:", err)
+			return
+		}
+		defer mywebsocket.Track(conn)()
+		defer conn.Close()
+
+		if err := conn.WriteJSON(gin.H{"type": mywebsocket.TypeReplayInfo, "data": gin.H{
+			"recording_id": rec.ID.Hex(),
+			"device_id":    rec.DeviceID.Hex(),
+			"started_at":   rec.StartedAt,
+			"duration_ms":  rec.DurationMs,
+			"frames":       rec.Frames,
+			"seekable":     reader.Indexed(),
+			"speed":        clock.speed,
+		}}); err != nil {
+			return
+		}
+
+		controls := make(chan mywebsocket.Envelope, 8)
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				msgType, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if msgType != websocket.TextMessage {
+					continue
+				}
+				if env, ok := mywebsocket.ParseEnvelope(data); ok {
+					select {
+					case controls <- env:
+					default:
+					}
+				}
+			}
+		}()
+
+		ping := time.NewTicker(lobbyPingInterval)
+		defer ping.Stop()
+		timer := time.NewTimer(time.Hour)
+		timer.Stop()
+		defer timer.Stop()
+
+		clock.reset(from)
+		// the index lands up to a second early; frames before the seek point are skipped
+		skipBefore := from
+		var pending *recording.Record
+		ended := false
+
+		sendError := func(msg string) {
+			_ = conn.WriteJSON(gin.H{"type": mywebsocket.TypeError, "data": gin.H{"error": msg}})
+		}
+
+		// 3) PLAYBACK LOOP
+		for {
+			// find the next frame this viewer should see
+			for pending == nil && !ended {
+				r, next, err := reader.ReadAt(pos)
+				if err == io.EOF {
+					ended = true
+					if err := conn.WriteJSON(gin.H{"type": mywebsocket.TypeReplayEnd, "data": gin.H{"offset_ms": clock.now().Milliseconds()}}); err != nil {
+						return
+					}
+					break
+				}
+				if err != nil {
+					log.Println("⚠️ Replay read error:", err)
+					return
+				}
+				pos = next
+				// the viewer sees what the car sent, as it would live
+				if r.Direction != recording.FromDevice || (only != 0 && r.Stream != only) || r.Offset < skipBefore {
+					continue
+				}
+				pending = &r
+			}
+
+			var fire <-chan time.Time
+			if pending != nil && !clock.paused {
+				timer.Reset(time.Until(clock.due(pending.Offset)))
+				fire = timer.C
+			}
+
+			select {
+			case <-closed:
+				return
+			case <-ping.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+					return
+				}
+			case <-fire:
+				if err := conn.WriteMessage(pending.MessageType, pending.Data); err != nil {
+					return
+				}
+				pending = nil
+			case env := <-controls:
+				switch env.Type {
+				case mywebsocket.TypeReplaySeek:
+					var req struct {
+						OffsetMs int64 `json:"offset_ms"`
+					}
+					if err := json.Unmarshal(env.Data, &req); err != nil || req.OffsetMs < 0 {
+						sendError("invalid offset_ms")
+						break
+					}
+					offset := time.Duration(req.OffsetMs) * time.Millisecond
+					p, err := reader.Seek(offset)
+					if err != nil {
+						sendError("recording can't be seeked")
+						break
+					}
+					pos, pending, ended, skipBefore = p, nil, false, offset
+					clock.reset(offset)
+				case mywebsocket.TypeReplaySpeed:
+					var req struct {
+						Speed float64 `json:"speed"`
+					}
+					if err := json.Unmarshal(env.Data, &req); err != nil || req.Speed < minReplaySpeed || req.Speed > maxReplaySpeed {
+						sendError("speed must be between 0.1 and 16")
+						break
+					}
+					clock.reset(clock.now())
+					clock.speed = req.Speed
+				case mywebsocket.TypeReplayPause:
+					if !clock.paused {
+						clock.reset(clock.now())
+						clock.paused = true
+					}
+				case mywebsocket.TypeReplayResume:
+					if clock.paused {
+						clock.paused = false
+						clock.reset(clock.baseOffset)
+					}
+				}
+			}
+		}
+	}
+}
@@ -7,23 +7,27 @@ import (
 	"time"
 
 	"github.com/chtan/miniworld/config"
-	common_controllers "github.com/chtan/miniworld/controllers/common"
 	device_controllers "github.com/chtan/miniworld/controllers/device"
-	user_controllers "github.com/chtan/miniworld/controllers/user"
+	presence_controllers "github.com/chtan/miniworld/controllers/presence"
+	recording_controllers "github.com/chtan/miniworld/controllers/recording"
+	ticket_controllers "github.com/chtan/miniworld/controllers/ticket"
+	presence_models "github.com/chtan/miniworld/models/presence"
+	ticket_models "github.com/chtan/miniworld/models/ticket"
 	"github.com/chtan/miniworld/mywebsocket"
+	"github.com/chtan/miniworld/recording"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
 
 var (
-	upgrader = websocket.Upgrader{
-		// In dev: allow all origins. For prod, restrict this.
-		CheckOrigin: func(r *http.Request) bool { return true },
-	}
-
-	sessionManager = mywebsocket.NewSessionManager()
+	sessionManager = mywebsocket.NewCamSessionManager()
 )
 
+// newUpgrader checks browser origins against the configured CORS policy.
+func newUpgrader(app *config.AppConfig) *websocket.Upgrader {
+	return &websocket.Upgrader{CheckOrigin: app.CORS.CheckOrigin}
+}
+
 // ws://server/ws/device
 func HandleDeviceWSCam(app *config.AppConfig) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
@@ -31,14 +35,9 @@ func HandleDeviceWSCam(app *config.AppConfig) gin.HandlerFunc {
 		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
-		clientToken, tokenError := common_controllers.GetMyToken(ctx)
-		if tokenError != nil {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": tokenError})
-			return
-		}
 		println("i am here at device cam")
 
-		deviceDetails, idError := device_controllers.GetDeviceDetails(mctx, app, clientToken)
+		deviceDetails, idError := device_controllers.AuthenticateDevice(mctx, ctx, app)
 		if idError != "" {
 			ctx.JSON(http.StatusUnauthorized, gin.H{"error": idError})
 			println(idError)
@@ -54,23 +53,37 @@ func HandleDeviceWSCam(app *config.AppConfig) gin.HandlerFunc {
 
 		println("3")
 		// 2) UPGRADE TO WEBSOCKET AFTER AUTH
-		conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+		conn, err := newUpgrader(app).Upgrade(ctx.Writer, ctx.Request, nil)
 		if err != nil {
 			log.Println("❌ Device upgrade error:", err)
-			device_controllers.IAMOnline(app, deviceDetails.ID, false)
 			return
 		}
+		defer mywebsocket.Track(conn)()
 		println("4")
 
 		// 3) REGISTER DEVICE SESSION
-		sessionManager.AddDevice(deviceID+"_Cam", conn)
+		camConn := sessionManager.AddDevice(deviceID, conn)
 		log.Println("✅ Device Cam connected:", deviceID)
-		device_controllers.IAMOnline(app, deviceDetails.ID, true)
+		lease, err := presence_controllers.Connect(app, deviceDetails.ID, presence_models.StreamCamera)
+		if err != nil {
+			log.Printf("Failed to claim camera presence for %s: %v", deviceID, err)
+		} else {
+			// a lost lease means the sweeper or another node moved on: reconnect
+			go func() {
+				<-lease.Done()
+				conn.Close()
+			}()
+		}
+
+		stopQuality := make(chan struct{})
+		go runQualityControl(camConn, deviceID, stopQuality)
 
 		defer func() {
+			close(stopQuality)
 			log.Println("⚠️ cam Device disconnected:", deviceID)
-			sessionManager.RemoveDevice(deviceID + "_Cam")
-			device_controllers.IAMOnline(app, deviceDetails.ID, false)
+			sessionManager.RemoveDevice(deviceID, camConn)
+			mywebsocket.Frames.Forget(deviceID)
+			lease.Release()
 			conn.Close()
 		}()
 
@@ -84,67 +97,64 @@ func HandleDeviceWSCam(app *config.AppConfig) gin.HandlerFunc {
 			if msgType != websocket.BinaryMessage {
 				continue // ignore text / control frames
 			}
+			recording_controllers.Capture(deviceID, recording.StreamCamera, recording.FromDevice, msgType, data)
 
-			// ONE device -> ONE controlling user, so direct lookup:
-			userSession := sessionManager.GetUserByDevice(deviceID + "_Cam")
-			if userSession != nil {
-				log.Println("data recived from cam and sending to user")
-				_ = userSession.Conn.WriteMessage(websocket.BinaryMessage, data)
-			}
+			// every viewer, websocket or HTTP, is fed from the frame hub
+			mywebsocket.Frames.Publish(deviceID, data)
 		}
 	}
 }
 
 // ===================== USER WEBSOCKET =====================
 
-// ws://server/ws/user?deviceId=<deviceId>
+// ws://server/ws/usercam?deviceId=<deviceId>[&ticket=<ticket>]
 func HandleUserWSCam(app *config.AppConfig) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		// 1) AUTH BEFORE WEBSOCKET UPGRADE
 		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		println("i am 1")
-
-		clientToken, tokenError := common_controllers.GetMyToken(ctx)
-		if tokenError != nil {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": tokenError})
-			println("i am 2")
-
-			return
-		}
-
-		userDetails, idError := user_controllers.GetUserDetails(mctx, app, clientToken)
-		println("i am 3")
+		deviceID := ctx.Query("deviceId") // which device this user wants to control
 
+		userDetails, idError := ticket_controllers.AuthenticateUser(mctx, ctx, app, ticket_models.StreamCamera, deviceID)
 		if idError != "" {
-			println("i am 4")
-
 			ctx.JSON(http.StatusUnauthorized, gin.H{"error": idError})
 			return
 		}
 
 		userID := userDetails.ID.Hex()
-		deviceID := ctx.Query("deviceId") // which device this user wants to control
 
 		if userID == "" || deviceID == "" {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "missing userId or deviceId"})
 			return
 		}
 
+		stopRecording, ok := recording_controllers.StartIfRequested(mctx, ctx, app, userDetails.ID, deviceID)
+		if !ok {
+			return
+		}
+		defer stopRecording()
+
 		// 2) UPGRADE TO WEBSOCKET AFTER AUTH
-		conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+		conn, err := newUpgrader(app).Upgrade(ctx.Writer, ctx.Request, nil)
 		if err != nil {
 			log.Println("❌ User upgrade error:", err)
 			return
 		}
+		defer mywebsocket.Track(conn)()
 
 		// 3) REGISTER USER SESSION (one device -> one user)
-		sessionManager.AddUser(userID+"_Cam", deviceID+"_Cam", conn)
+		userConn := sessionManager.AddUser(userID, deviceID, conn)
 		log.Printf("✅ User %s connected, controlling device cam %s\n", userID, deviceID)
 
+		viewer := mywebsocket.Frames.Subscribe(deviceID)
+		stopPing := userConn.StartPinger(viewerPingEvery, viewer.SetRTT)
+		go streamToViewer(userConn, viewer)
+
 		defer func() {
 			log.Println("⚠️ User disconnected:", userID)
-			sessionManager.RemoveUser(userID + "_Cam")
+			stopPing()
+			viewer.Close()
+			sessionManager.RemoveUser(userID, userConn)
 			conn.Close()
 		}()
 
@@ -158,12 +168,10 @@ func HandleUserWSCam(app *config.AppConfig) gin.HandlerFunc {
 			if msgType != websocket.BinaryMessage {
 				continue // ignore text / control frames
 			}
+			recording_controllers.Capture(deviceID, recording.StreamCamera, recording.FromUser, msgType, data)
 
 			// Forward to THIS user's device only
-			devConn := sessionManager.GetDeviceConn(deviceID + "_Cam")
-			if devConn != nil {
-				_ = devConn.WriteMessage(websocket.BinaryMessage, data)
-			}
+			_ = sessionManager.SendToDevice(deviceID, websocket.BinaryMessage, data)
 		}
 	}
 }
@@ -2,28 +2,41 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net/http"
 	"time"
 
 	"github.com/chtan/miniworld/config"
-	common_controllers "github.com/chtan/miniworld/controllers/common"
+	command_controllers "github.com/chtan/miniworld/controllers/command"
 	device_controllers "github.com/chtan/miniworld/controllers/device"
-	user_controllers "github.com/chtan/miniworld/controllers/user"
+	firmware_controllers "github.com/chtan/miniworld/controllers/firmware"
+	latency_controllers "github.com/chtan/miniworld/controllers/latency"
+	presence_controllers "github.com/chtan/miniworld/controllers/presence"
+	recording_controllers "github.com/chtan/miniworld/controllers/recording"
+	shadow_controllers "github.com/chtan/miniworld/controllers/shadow"
+	signaling_controllers "github.com/chtan/miniworld/controllers/signaling"
+	telemetry_controllers "github.com/chtan/miniworld/controllers/telemetry"
+	throttle_controllers "github.com/chtan/miniworld/controllers/throttle"
+	ticket_controllers "github.com/chtan/miniworld/controllers/ticket"
+	presence_models "github.com/chtan/miniworld/models/presence"
+	ticket_models "github.com/chtan/miniworld/models/ticket"
 	"github.com/chtan/miniworld/mywebsocket"
+	"github.com/chtan/miniworld/recording"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 var (
-	upgrader = websocket.Upgrader{
-		// In dev: allow all origins. For prod, restrict this.
-		CheckOrigin: func(r *http.Request) bool { return true },
-	}
-
 	sessionManager = mywebsocket.NewSessionManager()
 )
 
+// newUpgrader checks browser origins against the configured CORS policy.
+func newUpgrader(app *config.AppConfig) *websocket.Upgrader {
+	return &websocket.Upgrader{CheckOrigin: app.CORS.CheckOrigin}
+}
+
 // ws://server/ws/device
 func HandleDeviceWS(app *config.AppConfig) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
@@ -31,12 +44,7 @@ func HandleDeviceWS(app *config.AppConfig) gin.HandlerFunc {
 		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
-		clientToken, tokenError := common_controllers.GetMyToken(ctx)
-		if tokenError != nil {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": tokenError})
-			return
-		}
-		deviceDetails, idError := device_controllers.GetDeviceDetails(mctx, app, clientToken)
+		deviceDetails, idError := device_controllers.AuthenticateDevice(mctx, ctx, app)
 		if idError != "" {
 			ctx.JSON(http.StatusUnauthorized, gin.H{"error": idError})
 			return
@@ -48,20 +56,37 @@ func HandleDeviceWS(app *config.AppConfig) gin.HandlerFunc {
 		}
 
 		// 2) UPGRADE TO WEBSOCKET AFTER AUTH
-		conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+		conn, err := newUpgrader(app).Upgrade(ctx.Writer, ctx.Request, nil)
 		if err != nil {
-			device_controllers.IAMOnline(app, deviceDetails.ID, false)
 			return
 		}
+		defer mywebsocket.Track(conn)()
 		// 3) REGISTER DEVICE SESSION
-		sessionManager.AddDevice(deviceID, conn)
+		devConn := sessionManager.AddDevice(deviceID, conn)
 		log.Println("Car Device connected:", deviceID)
-		device_controllers.IAMOnline(app, deviceDetails.ID, true)
+		lease, err := presence_controllers.Connect(app, deviceDetails.ID, presence_models.StreamControl)
+		if err != nil {
+			log.Printf("Failed to claim car presence for %s: %v", deviceID, err)
+		} else {
+			// a lost lease means the sweeper or another node moved on: reconnect
+			go func() {
+				<-lease.Done()
+				conn.Close()
+			}()
+		}
+		shadow_controllers.PushShadow(app, deviceDetails.ID)
+		command_controllers.DeliverPending(app, deviceDetails.ID)
+		stopPing := devConn.StartPinger(latency_controllers.PingInterval, func(rtt time.Duration) {
+			latency_controllers.DeviceRTT(deviceID, rtt)
+		})
 
 		defer func() {
 			log.Println("Car Device disconnected:", deviceID)
-			sessionManager.RemoveDevice(deviceID)
-			device_controllers.IAMOnline(app, deviceDetails.ID, false)
+			stopPing()
+			latency_controllers.ForgetDevice(deviceID)
+			sessionManager.RemoveDevice(deviceID, devConn)
+			signaling_controllers.EndSession(deviceID, "car disconnected")
+			lease.Release()
 			conn.Close()
 		}()
 
@@ -72,60 +97,105 @@ func HandleDeviceWS(app *config.AppConfig) gin.HandlerFunc {
 				log.Println("⚠️ Device read error:", err)
 				return
 			}
+			recording_controllers.Capture(deviceID, recording.StreamControl, recording.FromDevice, msgType, data)
 
-			// ONE device -> ONE controlling user, so direct lookup:
-			userSession := sessionManager.GetUserByDevice(deviceID)
-			if userSession != nil {
-				_ = userSession.Conn.WriteMessage(msgType, data)
+			if msgType == websocket.TextMessage {
+				if env, ok := mywebsocket.ParseEnvelope(data); ok {
+					// telemetry is stored and still relayed for live dashboards
+					telemetry_controllers.RecordDeviceMessage(app, deviceDetails.ID, env)
+					if shadow_controllers.HandleDeviceMessage(app, deviceDetails.ID, env) ||
+						command_controllers.HandleDeviceMessage(app, deviceDetails.ID, env) ||
+						firmware_controllers.HandleDeviceMessage(app, deviceDetails.ID, env) ||
+						signaling_controllers.HandleDeviceMessage(app, deviceDetails.ID, env) ||
+						latency_controllers.HandleDeviceMessage(app, deviceDetails.ID, env) {
+						continue
+					}
+				}
 			}
+
+			// ONE device -> ONE controlling user, here or on another node
+			_ = sessionManager.SendToUser(deviceID, msgType, data)
 		}
 	}
 }
 
 // ===================== USER WEBSOCKET =====================
 
-// ws://server/ws/user?deviceId=<deviceId>
+// ws://server/ws/user?deviceId=<deviceId>[&ticket=<ticket>]
 func HandleUserWS(app *config.AppConfig) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		// 1) AUTH BEFORE WEBSOCKET UPGRADE
 		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		clientToken, tokenError := common_controllers.GetMyToken(ctx)
-
-		if tokenError != nil {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": tokenError})
-			return
-		}
-
-		userDetails, idError := user_controllers.GetUserDetails(mctx, app, clientToken)
+		deviceID := ctx.Query("deviceId") // which device this user wants to control
 
+		userDetails, idError := ticket_controllers.AuthenticateUser(mctx, ctx, app, ticket_models.StreamControl, deviceID)
 		if idError != "" {
 			ctx.JSON(http.StatusUnauthorized, gin.H{"error": idError})
 			return
 		}
 
 		userID := userDetails.ID.Hex()
-		deviceID := ctx.Query("deviceId") // which device this user wants to control
 
 		if userID == "" || deviceID == "" {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "missing userId or deviceId"})
 			return
 		}
 
+		deviceObjID, err := primitive.ObjectIDFromHex(deviceID)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid deviceId"})
+			return
+		}
+
+		// one device -> one user across every node, so only one node routes to a driver
+		drive, err := presence_controllers.Drive(app, deviceObjID, userID)
+		if errors.Is(err, presence_controllers.ErrControlled) {
+			ctx.JSON(http.StatusConflict, gin.H{"error": "device is controlled by another user"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to claim control of %s: %v", deviceID, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to claim control"})
+			return
+		}
+		defer drive.Release()
+
+		stopRecording, ok := recording_controllers.StartIfRequested(mctx, ctx, app, userDetails.ID, deviceID)
+		if !ok {
+			return
+		}
+		defer stopRecording()
+
 		// 2) UPGRADE TO WEBSOCKET AFTER AUTH
-		conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+		conn, err := newUpgrader(app).Upgrade(ctx.Writer, ctx.Request, nil)
 		if err != nil {
 			log.Println("❌ User upgrade error:", err)
 			return
 		}
+		defer mywebsocket.Track(conn)()
+		go func() {
+			<-drive.Done()
+			conn.Close()
+		}()
 
 		// 3) REGISTER USER SESSION (one device -> one user)
-		sessionManager.AddUser(userID, deviceID, conn)
+		userConn := sessionManager.AddUser(userID, deviceID, conn)
 		log.Printf("✅ User %s connected, controlling car device %s\n", userID, deviceID)
+		latency_controllers.StartSession(app, userID, deviceID, userConn)
+		limiter := throttle_controllers.NewSession(app, deviceID)
+		stopPing := userConn.StartPinger(latency_controllers.PingInterval, func(rtt time.Duration) {
+			latency_controllers.UserRTT(deviceID, rtt)
+		})
 
 		defer func() {
 			log.Println("⚠️ User disconnected:", userID)
-			sessionManager.RemoveUser(userID)
+			stopPing()
+			limiter.Close()
+			// each cleanup leaves alone a newer connection that took over
+			latency_controllers.EndSession(app, deviceID, userConn)
+			signaling_controllers.EndUserSession(deviceID, userConn, "user disconnected")
+			sessionManager.RemoveUser(userID, userConn)
 			conn.Close()
 		}()
 
@@ -136,14 +206,52 @@ func HandleUserWS(app *config.AppConfig) gin.HandlerFunc {
 				log.Println("⚠️ User read error:", err)
 				return
 			}
+			var env mywebsocket.Envelope
+			isEnvelope := false
+			if msgType == websocket.TextMessage {
+				env, isEnvelope = mywebsocket.ParseEnvelope(data)
+			}
+			exempt := isEnvelope && throttle_controllers.Exempt(env.Type)
+			if !exempt && !limiter.Allow(userConn, len(data)) {
+				continue
+			}
+			recording_controllers.Capture(deviceID, recording.StreamControl, recording.FromUser, msgType, data)
 
-			// Forward to THIS user's device only
-			devConn := sessionManager.GetDeviceConn(deviceID)
-			if devConn != nil {
-				_ = devConn.WriteMessage(msgType, data)
+			if isEnvelope {
+				// Non-realtime commands go through the persistent queue so they
+				// survive the car being offline
+				if env.Type == mywebsocket.TypeCommand {
+					_ = userConn.WriteJSON(command_controllers.EnqueueFromUser(app, userDetails.ID, deviceID, env))
+					continue
+				}
+				if signaling_controllers.HandleUserMessage(app, userID, deviceID, userConn, env) {
+					continue
+				}
+				data = latency_controllers.StampUserMessage(deviceID, env, data)
 			}
+
+			// Forward to THIS user's device only
+			_ = sessionManager.SendToDevice(deviceID, msgType, data)
+		}
+	}
+}
+
+// DrainWebSockets stops the cars driven through this node, then closes
+// every socket here with a going-away frame and waits for the handlers to
+// mark their devices offline. http.Server.Shutdown doesn't do this because
+// upgraded connections are hijacked.
+func DrainWebSockets(ctx context.Context, app *config.AppConfig) error {
+	for deviceID, userID := range mywebsocket.DrivenDevices() {
+		deviceObjID, err := primitive.ObjectIDFromHex(deviceID)
+		if err != nil {
+			continue
+		}
+		userObjID, _ := primitive.ObjectIDFromHex(userID)
+		if _, err := command_controllers.Enqueue(ctx, app, deviceObjID, userObjID, command_controllers.CommandStop, nil, command_controllers.StopTTL); err != nil {
+			log.Printf("Failed to stop %s on shutdown: %v", deviceID, err)
 		}
 	}
+	return mywebsocket.Drain(ctx)
 }
 
 func deviceDetails() {
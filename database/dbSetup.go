@@ -10,22 +10,23 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func DatabaseSetup() *mongo.Client {
-	// Create a context with a 10 second timeout for the connection.
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// DatabaseSetup connects to the MongoDB server at uri and pings it, giving
+// up after timeout.
+func DatabaseSetup(uri string, timeout time.Duration) (*mongo.Client, error) {
+	// Create a context with a timeout for the connection.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	// Connect to MongoDB using the URI provided
-
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
 	if err != nil {
-		log.Fatalf("Error connection to MongoDB: %v", err)
+		return nil, fmt.Errorf("failed to connect to MongoDB: %v", err)
 	}
 
 	// Ping the MongoDB server to ensure the connection is established
 	if err := client.Ping(ctx, nil); err != nil {
-		log.Fatalf("Failed to connect to MongoDB: %v", err)
+		return nil, fmt.Errorf("MongoDB ping failed: %v", err)
 	}
-	fmt.Println("Successfully connected to the database")
-	return client
+	log.Println("Successfully connected to the database")
+	return client, nil
 }
@@ -8,24 +8,22 @@ import (
 
 	"github.com/chtan/miniworld/config"
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
-func IsFieldUsed(
+func IsEmailUsed(
 	app *config.AppConfig,
 	mctx context.Context,
 	ctx *gin.Context,
-	fieldName string,
-	fieldValue interface{}) bool {
-	count, err := app.Client.Database("miniworld").Collection("users").CountDocuments(mctx, bson.M{fieldName: fieldValue})
+	email string) bool {
+	used, err := app.Repos.Users.EmailTaken(mctx, email)
 	if err != nil {
-		log.Panic(err)
+		log.Printf("Failed to check email: %v", err)
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		return true
 	}
 
-	if count > 0 {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": fieldName + " is already used"})
+	if used {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "email is already used"})
 		return true
 	}
 	return false
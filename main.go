@@ -2,51 +2,103 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
+	"github.com/chtan/miniworld/broker"
 	"github.com/chtan/miniworld/config"
+	"github.com/chtan/miniworld/controllers"
+	command_controllers "github.com/chtan/miniworld/controllers/command"
+	common_controllers "github.com/chtan/miniworld/controllers/common"
+	presence_controllers "github.com/chtan/miniworld/controllers/presence"
+	telemetry_controllers "github.com/chtan/miniworld/controllers/telemetry"
 	"github.com/chtan/miniworld/middleware"
+	"github.com/chtan/miniworld/migrations"
+	"github.com/chtan/miniworld/mywebsocket"
+	"github.com/chtan/miniworld/pki"
 	"github.com/chtan/miniworld/routes"
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
-	// Set Gin mode based on environment
-	if os.Getenv("GIN_MODE") == "release" {
-		gin.SetMode(gin.ReleaseMode)
-	} else {
-		gin.SetMode(gin.DebugMode)
-	}
-
 	// Initialize AppConfig (includes validator)
 	app, err := config.Init()
 	if err != nil {
 		log.Fatalf("Failed to initialize AppConfig: %v", err)
 	}
+	settings := app.Settings
+
+	gin.SetMode(settings.Server.Mode)
+
+	// Uploads, firmware and recordings live in S3
+	if err := common_controllers.SetupStorage(app); err != nil {
+		log.Fatalf("Failed to set up storage: %v", err)
+	}
 	defer func() {
 		if err := app.Client.Disconnect(context.Background()); err != nil {
 			log.Printf("Error disconnecting MongoDB client: %v", err)
 		}
 	}()
 
-	// Get port from environment or default to 8000
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8000"
+	// Indexes, validators and backfills the code relies on
+	if settings.Mongo.MigrateOnStart {
+		mctx, cancel := context.WithTimeout(context.Background(), settings.Mongo.MigrateTimeout.Std())
+		applied, err := migrations.Run(mctx, app.Client.Database("miniworld"))
+		cancel()
+		switch {
+		case errors.Is(err, migrations.ErrBlocked):
+			// the rest applied; serve while an operator fixes the data
+			log.Printf("Database migrations need attention (%d applied): %v", len(applied), err)
+		case err != nil:
+			log.Fatalf("Failed to migrate database: %v", err)
+		default:
+			log.Printf("Database schema up to date (%d migrations applied)", len(applied))
+		}
+	}
+
+	// Telemetry lives in a time-series collection with retention
+	if err := telemetry_controllers.SetTelemetryRetention(app); err != nil {
+		log.Fatalf("Failed to set telemetry retention (are migrations applied?): %v", err)
+	}
+
+	// Resend unacked device commands and expire stale ones
+	command_controllers.StartDispatcher(app)
+
+	// Mark offline the devices of nodes that stopped renewing their leases
+	presence_controllers.StartSweeper(app)
+
+	// Route websocket messages between nodes when running as a cluster
+	if app.BrokerURL != "" {
+		b, err := broker.Open(app.BrokerURL)
+		if err != nil {
+			log.Fatalf("Failed to connect to broker: %v", err)
+		}
+		defer b.Close()
+		if err := mywebsocket.UseBroker(b, app.NodeID); err != nil {
+			log.Fatalf("Failed to subscribe to broker: %v", err)
+		}
+		log.Printf("Routing websocket messages through the broker as node %s", mywebsocket.NodeID())
 	}
 
 	// Initialize Gin router
 	router := gin.New()
-	router.Use(gin.Logger(), gin.Recovery())
+	// gin trusts every proxy unless told otherwise
+	if err := router.SetTrustedProxies(app.Settings.Server.TrustedProxies); err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err)
+	}
+	router.Use(gin.Logger(), gin.Recovery(), middleware.CORS(app))
 
 	// Public routes (no authentication)
 	routes.UserPublicRoutes(router, app)
 	routes.DevicePublicRoutes(router, app)
+	// websocket handshakes authenticate themselves, by header or ticket
+	routes.UserWebSocketRoutes(router, app)
 
 	// Authorized routes (with authentication middleware)
 	authorized := router.Group("/api")
@@ -54,30 +106,84 @@ func main() {
 	routes.UserRoutes(authorized, app)
 	routes.ClanRoutes(authorized, app)
 	routes.WebSocketRoutes(authorized, app)
+	routes.TicketRoutes(authorized, app)
+	routes.TelemetryRoutes(authorized, app)
+	routes.ShadowRoutes(authorized, app)
+	routes.CommandRoutes(authorized, app)
+	routes.FirmwareRoutes(authorized, app)
+	routes.GroupRoutes(authorized, app)
+	routes.RecordingRoutes(authorized, app)
+	routes.LatencyRoutes(authorized, app)
 
 	// Start server with graceful shutdown
 	srv := &http.Server{
-		Addr:    "0.0.0.0:" + port,
+		Addr:    "0.0.0.0:" + settings.Server.Port,
 		Handler: router,
 	}
 
+	// Devices may present a client certificate signed by the built-in CA
+	if app.DeviceAuthMode != "token" {
+		ca, err := pki.DeviceCA(app)
+		if err != nil {
+			log.Fatalf("Failed to load device CA: %v", err)
+		}
+		srv.TLSConfig = &tls.Config{
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  ca.Pool(),
+		}
+	}
+
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS(app.TLSCertFile, app.TLSKeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Printf("Server failed to start: %v", err)
 		}
 	}()
 
+	// Operator metrics get their own listener so tenants can't read them
+	var admin *http.Server
+	if settings.Server.AdminAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+		admin = &http.Server{Addr: settings.Server.AdminAddr, Handler: mux}
+		go func() {
+			if err := admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Admin listener failed to start: %v", err)
+			}
+		}()
+	}
+
 	// Handle shutdown signals
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	log.Println("Shutting down server...")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Server.ShutdownTimeout.Std())
 	defer cancel()
+
+	// Upgraded websockets are hijacked, so srv.Shutdown doesn't wait for them
+	drained := make(chan error, 1)
+	go func() { drained <- controllers.DrainWebSockets(ctx, app) }()
+
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Printf("Server shutdown failed: %v", err)
 	} else {
 		log.Println("Server shut down gracefully")
 	}
+	if admin != nil {
+		if err := admin.Shutdown(ctx); err != nil {
+			log.Printf("Admin listener shutdown failed: %v", err)
+		}
+	}
+	if err := <-drained; err != nil {
+		log.Printf("Websocket drain incomplete: %v", err)
+	} else {
+		log.Println("Websockets drained")
+	}
 }
@@ -8,11 +8,10 @@ import (
 
 	"github.com/chtan/miniworld/config"
 	common_controllers "github.com/chtan/miniworld/controllers/common"
-	auth_models "github.com/chtan/miniworld/models/auth"
+	"github.com/chtan/miniworld/repository"
 	"github.com/chtan/miniworld/token"
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // Authentication is a Gin middleware for JWT validation
@@ -39,25 +38,23 @@ func Authentication(app *config.AppConfig) gin.HandlerFunc {
 
 		// Optional database verification
 		if app.RequireDBCheck {
-			filter := bson.M{"_id": claims.UID, "access_token": clientToken}
-			var user auth_models.SetSignUpModel
-			err := app.Client.Database("miniworld").Collection("users").FindOne(mctx, filter).Decode(&user)
-			if err != nil {
-				if err == mongo.ErrNoDocuments {
-					ctx.JSON(http.StatusUnauthorized, gin.H{"error": "token not found or user unauthorized"})
-				} else {
-					log.Printf("Database error during token check: %v", err)
-					ctx.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
-				}
+			err := app.Repos.Sessions.Check(mctx, repository.UserSessions, claims.UID, clientToken)
+			switch err {
+			case nil:
+			case repository.ErrNotFound:
+				ctx.JSON(http.StatusUnauthorized, gin.H{"error": "token not found or user unauthorized"})
 				ctx.Abort()
 				return
-			}
-
-			// Check if token is revoked
-			if user.Revoked {
+			case repository.ErrRevoked:
+				// Check if token is revoked
 				ctx.JSON(http.StatusUnauthorized, gin.H{"error": "token has been revoked"})
 				ctx.Abort()
 				return
+			default:
+				log.Printf("Database error during token check: %v", err)
+				ctx.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+				ctx.Abort()
+				return
 			}
 		}
 
@@ -81,12 +78,11 @@ func RequireAuthWithRole(app *config.AppConfig, requiredRole string) gin.Handler
 
 		// Example: Check role (assumes roles are stored in DB or token)
 		// Here, you'd fetch the user's role from the database or token claims
-		uid := ctx.GetString("_id")
+		uid, _ := ctx.MustGet("_id").(primitive.ObjectID)
 		mctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
-		var user auth_models.SetSignUpModel
-		err := app.Client.Database("miniworld").Collection("users").FindOne(mctx, bson.M{"_id": uid}).Decode(&user)
+		_, err := app.Repos.Users.Get(mctx, uid)
 		if err != nil {
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch user role"})
 			ctx.Abort()
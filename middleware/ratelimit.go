@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	common_controllers "github.com/chtan/miniworld/controllers/common"
+	"github.com/chtan/miniworld/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// requests a client IP may make to one endpoint, and a single account
+	ipLimit      = ratelimit.PerMinute(30)
+	accountLimit = ratelimit.PerMinute(10)
+
+	// failed attempts on an account from one IP before that IP is locked out
+	// of it; the lock doubles with every further failure. Locking the
+	// account itself would let anyone lock its owner out.
+	accountLockout = ratelimit.Lockout{Threshold: 5, Window: 15 * time.Minute, Base: time.Minute, Max: time.Hour}
+	// an IP guessing across many accounts is locked out too
+	ipLockout = ratelimit.Lockout{Threshold: 20, Window: 15 * time.Minute, Base: 5 * time.Minute, Max: 24 * time.Hour}
+)
+
+// maxLimitedBody caps how much of the body is read to find the account.
+const maxLimitedBody = 64 << 10
+
+// RateLimit throttles a public auth endpoint by client IP and by the account
+// named in the JSON body's accountField, and locks the IP out of the account,
+// and out of everything, after repeated failed attempts. A 401 or 403 from
+// the handler counts as a failure; a success clears the IP's failures on the
+// account. The client IP only honours forwarding headers from the router's
+// trusted proxies.
+func RateLimit(app *config.AppConfig, endpoint, accountField string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		store := app.RateLimits
+
+		ipKey := "ip:" + ctx.ClientIP()
+		accountKey, attemptKey := "", ""
+		if account := bodyField(ctx, accountField); account != "" {
+			accountKey = accountField + ":" + strings.ToLower(account)
+			attemptKey = ipKey + "|" + accountKey
+		}
+
+		// 1) LOCKOUTS
+		for _, key := range []string{ipKey, attemptKey} {
+			if key == "" {
+				continue
+			}
+			left, err := store.Locked(mctx, key)
+			if err != nil {
+				log.Printf("Rate limit store error: %v", err)
+				continue
+			}
+			if left > 0 {
+				tooManyRequests(ctx, left, "Too many failed attempts")
+				return
+			}
+		}
+
+		// 2) BUCKETS
+		type bucket struct {
+			key   string
+			limit ratelimit.Limit
+		}
+		buckets := []bucket{{endpoint + ":" + ipKey, ipLimit}}
+		if accountKey != "" {
+			buckets = append(buckets, bucket{endpoint + ":" + accountKey, accountLimit})
+		}
+		for _, b := range buckets {
+			ok, wait, err := store.Take(mctx, b.key, b.limit)
+			if err != nil {
+				log.Printf("Rate limit store error: %v", err)
+				continue
+			}
+			if !ok {
+				tooManyRequests(ctx, wait, "Too many requests")
+				return
+			}
+		}
+
+		ctx.Next()
+
+		// 3) FAILURES
+		switch status := ctx.Writer.Status(); {
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			if attemptKey != "" {
+				if lock, err := store.Fail(mctx, attemptKey, accountLockout); err != nil {
+					log.Printf("Rate limit store error: %v", err)
+				} else if lock > 0 {
+					log.Printf("Locked out %s on %s for %s", attemptKey, endpoint, lock)
+				}
+			}
+			if lock, err := store.Fail(mctx, ipKey, ipLockout); err != nil {
+				log.Printf("Rate limit store error: %v", err)
+			} else if lock > 0 {
+				log.Printf("Locked out %s on %s for %s", ipKey, endpoint, lock)
+			}
+		case status < 300 && attemptKey != "":
+			if err := store.Succeed(mctx, attemptKey); err != nil {
+				log.Printf("Rate limit store error: %v", err)
+			}
+		}
+	}
+}
+
+func tooManyRequests(ctx *gin.Context, retryAfter time.Duration, message string) {
+	seconds := int(retryAfter.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	ctx.Header("Retry-After", strconv.Itoa(seconds))
+	common_controllers.ErrorResponse(ctx, http.StatusTooManyRequests, message, fmt.Sprintf("retry after %d seconds", seconds))
+	ctx.Abort()
+}
+
+// bodyField reads a top-level field of the JSON body and leaves the body in
+// place for the handler.
+func bodyField(ctx *gin.Context, field string) string {
+	if field == "" || ctx.Request.Body == nil {
+		return ""
+	}
+	body, err := io.ReadAll(io.LimitReader(ctx.Request.Body, maxLimitedBody))
+	ctx.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), ctx.Request.Body))
+	if err != nil {
+		return ""
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return ""
+	}
+	switch v := fields[field].(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
@@ -0,0 +1,336 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// All is the schema history. Append new migrations with the next version;
+// never edit or reorder one that has shipped.
+var All = []Migration{
+	{1, "users_unique_email", usersUniqueEmail},
+	{2, "clans_unique_name_tag", clansUniqueNameTag},
+	{3, "temp_signups_ttl", tempSignupsTTL},
+	{4, "ws_tickets_ttl", wsTicketsTTL},
+	{5, "lookup_indexes", lookupIndexes},
+	{6, "users_devices_validators", usersDevicesValidators},
+	{7, "backfill_revoked", backfillRevoked},
+	{8, "commands_indexes", commandsIndexes},
+	{9, "devices_drop_modified_at", devicesDropModifiedAt},
+	{10, "pairing_codes_ttl", pairingCodesTTL},
+	{11, "rate_limits_ttl", rateLimitsTTL},
+	{12, "telemetry_collection", telemetryCollection},
+	{13, "device_presence_indexes", devicePresenceIndexes},
+	{14, "control_sessions_indexes", controlSessionsIndexes},
+	{15, "device_certs_indexes", deviceCertsIndexes},
+	{16, "firmware_rollouts_indexes", firmwareRolloutsIndexes},
+	{17, "shadows_collection", shadowsCollection},
+}
+
+// maxReported caps how many offending values a blocked migration lists.
+const maxReported = 20
+
+// signup and ValidateOtpAndSaveUser rely on one account per email. Accounts
+// created before the index may share one; which to keep is the operator's
+// call, so they are reported rather than merged.
+func usersUniqueEmail(ctx context.Context, db *mongo.Database) error {
+	duplicates, err := findDuplicates(ctx, db.Collection("users"), "email", nil)
+	if err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		return fmt.Errorf("%w: %d emails belong to more than one user: %s; merge or delete the extra accounts and migrate again",
+			ErrBlocked, len(duplicates), listDuplicates(duplicates))
+	}
+
+	_, err = db.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// CreateClan reports a duplicate key as a taken name or tag. Names differ
+// by more than case, as in the memory repository. Clans that already share
+// one are reported; which keeps it is up to their admins.
+func clansUniqueNameTag(ctx context.Context, db *mongo.Database) error {
+	caseless := &options.Collation{Locale: "en", Strength: 2}
+	clans := db.Collection("clans")
+	names, err := findDuplicates(ctx, clans, "clan_details.name", caseless)
+	if err != nil {
+		return err
+	}
+	tags, err := findDuplicates(ctx, clans, "clan_details.tag", nil)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 || len(tags) > 0 {
+		return fmt.Errorf("%w: %d names and %d tags belong to more than one clan: names [%s], tags [%s]; rename the extra clans and migrate again",
+			ErrBlocked, len(names), len(tags), listDuplicates(names), listDuplicates(tags))
+	}
+
+	_, err = clans.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "clan_details.name", Value: 1}},
+			Options: options.Index().SetUnique(true).SetCollation(caseless),
+		},
+		{
+			Keys:    bson.D{{Key: "clan_details.tag", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	})
+	return err
+}
+
+// duplicate is a value more than one document holds.
+type duplicate struct {
+	Value string `bson:"_id"`
+	Count int    `bson:"count"`
+}
+
+// findDuplicates returns the values of field held by more than one document
+// of coll, compared under collation as a unique index with it would.
+func findDuplicates(ctx context.Context, coll *mongo.Collection, field string, collation *options.Collation) ([]duplicate, error) {
+	opts := options.Aggregate()
+	if collation != nil {
+		opts.SetCollation(collation)
+	}
+	cursor, err := coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$" + field, "count": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var duplicates []duplicate
+	if err := cursor.All(ctx, &duplicates); err != nil {
+		return nil, err
+	}
+	return duplicates, nil
+}
+
+// listDuplicates formats up to maxReported duplicates with their counts.
+func listDuplicates(duplicates []duplicate) string {
+	listed := make([]string, 0, min(len(duplicates), maxReported))
+	for _, d := range duplicates[:min(len(duplicates), maxReported)] {
+		listed = append(listed, fmt.Sprintf("%s (%d)", d.Value, d.Count))
+	}
+	return strings.Join(listed, ", ")
+}
+
+// pending signups used to create this on every signup
+func tempSignupsTTL(ctx context.Context, db *mongo.Database) error {
+	return ttlIndex(ctx, db.Collection("tempData"))
+}
+
+func wsTicketsTTL(ctx context.Context, db *mongo.Database) error {
+	return ttlIndex(ctx, db.Collection("wsTickets"))
+}
+
+func ttlIndex(ctx context.Context, coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// every authenticated request looks its caller up by token
+func lookupIndexes(ctx context.Context, db *mongo.Database) error {
+	indexes := map[string][]mongo.IndexModel{
+		"users": {
+			{Keys: bson.D{{Key: "access_token", Value: 1}}},
+			{Keys: bson.D{{Key: "refresh_token", Value: 1}}},
+		},
+		"devices": {
+			{Keys: bson.D{{Key: "access_token", Value: 1}}},
+			{Keys: bson.D{{Key: "refresh_token", Value: 1}}},
+			{Keys: bson.D{{Key: "clan_id", Value: 1}}},
+			{Keys: bson.D{{Key: "admin_id", Value: 1}}},
+		},
+		"clans": {
+			{Keys: bson.D{{Key: "admin_id", Value: 1}}},
+		},
+	}
+	for name, models := range indexes {
+		if _, err := db.Collection(name).Indexes().CreateMany(ctx, models); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rejects writes that would break the fields the repositories depend on.
+// Moderate validation leaves existing documents that don't match alone
+// until they are next updated.
+func usersDevicesValidators(ctx context.Context, db *mongo.Database) error {
+	validators := map[string]bson.M{
+		"users": {"$jsonSchema": bson.M{
+			"bsonType": "object",
+			"required": bson.A{"email", "password"},
+			"properties": bson.M{
+				"email":    bson.M{"bsonType": "string"},
+				"password": bson.M{"bsonType": "string"},
+				"revoked":  bson.M{"bsonType": "bool"},
+			},
+		}},
+		"devices": {"$jsonSchema": bson.M{
+			"bsonType": "object",
+			"required": bson.A{"clan_id", "admin_id", "password"},
+			"properties": bson.M{
+				"clan_id":   bson.M{"bsonType": "objectId"},
+				"admin_id":  bson.M{"bsonType": "objectId"},
+				"password":  bson.M{"bsonType": "string"},
+				"revoked":   bson.M{"bsonType": "bool"},
+				"is_online": bson.M{"bsonType": "bool"},
+			},
+		}},
+	}
+	for name, validator := range validators {
+		if err := ensureCollection(ctx, db, name); err != nil {
+			return err
+		}
+		err := db.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: name},
+			{Key: "validator", Value: validator},
+			{Key: "validationLevel", Value: "moderate"},
+			{Key: "validationAction", Value: "error"},
+		}).Err()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sessions filter on revoked, and the old user refresh path wrote the
+// access token to a stray "token" field.
+func backfillRevoked(ctx context.Context, db *mongo.Database) error {
+	for _, name := range []string{"users", "devices"} {
+		_, err := db.Collection(name).UpdateMany(ctx,
+			bson.M{"revoked": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"revoked": false}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := db.Collection("users").UpdateMany(ctx,
+		bson.M{"token": bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"token": ""}},
+	)
+	return err
+}
+
+// ensureCollection creates the collection, so collMod has something to
+// modify, unless it already exists.
+func ensureCollection(ctx context.Context, db *mongo.Database, name string, opts ...*options.CreateCollectionOptions) error {
+	err := db.CreateCollection(ctx, name, opts...)
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Name == "NamespaceExists" {
+		return nil
+	}
+	return err
+}
+
+// Delivery looks up a device's open commands oldest first and the
+// dispatcher expires open ones by expiry; finished commands are kept a
+// week after they expire for the command history.
+func commandsIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("commands").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "device_id", Value: 1}, {Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "expires_at", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32((7 * 24 * time.Hour).Seconds())),
+		},
+	})
+	return err
+}
+
+// Presence used to stamp devices with modified_at while everything else
+// wrote updated_at. The later of the two is kept as updated_at.
+func devicesDropModifiedAt(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("devices").UpdateMany(ctx,
+		bson.M{"modified_at": bson.M{"$exists": true}},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{"updated_at": bson.M{"$max": bson.A{"$updated_at", "$modified_at"}}}}},
+			{{Key: "$unset", Value: "modified_at"}},
+		},
+	)
+	return err
+}
+
+// pairing codes used to get this on the first code created
+func pairingCodesTTL(ctx context.Context, db *mongo.Database) error {
+	return ttlIndex(ctx, db.Collection("pairingCodes"))
+}
+
+// the mongo rate limit store used to create this whenever a node started
+func rateLimitsTTL(ctx context.Context, db *mongo.Database) error {
+	return ttlIndex(ctx, db.Collection("rateLimits"))
+}
+
+// Telemetry is a time-series collection per device. Its retention follows
+// TELEMETRY_RETENTION_DAYS and is set by the server on start.
+func telemetryCollection(ctx context.Context, db *mongo.Database) error {
+	return ensureCollection(ctx, db, "telemetry", options.CreateCollection().
+		SetTimeSeriesOptions(options.TimeSeries().
+			SetTimeField("ts").
+			SetMetaField("device_id").
+			SetGranularity("seconds")))
+}
+
+// The sweeper looks for leases past their expiry on every stream.
+func devicePresenceIndexes(ctx context.Context, db *mongo.Database) error {
+	streams := []string{"control", "camera", "driver"}
+	models := make([]mongo.IndexModel, 0, len(streams))
+	for _, stream := range streams {
+		models = append(models, mongo.IndexModel{
+			Keys:    bson.D{{Key: stream + ".expires_at", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		})
+	}
+	_, err := db.Collection("devicePresence").Indexes().CreateMany(ctx, models)
+	return err
+}
+
+// a device's control sessions are listed newest first
+func controlSessionsIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("controlSessions").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "device_id", Value: 1}, {Key: "started_at", Value: -1}},
+	})
+	return err
+}
+
+// Certificates are listed and revoked per device, and the revocation list
+// reads the revoked ones that haven't expired.
+func deviceCertsIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("deviceCerts").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "device_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "revoked", Value: 1}, {Key: "not_after", Value: 1}}},
+	})
+	return err
+}
+
+// a release's rollouts are read together and by device as cars report
+func firmwareRolloutsIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("firmwareRollouts").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "release_id", Value: 1}, {Key: "device_id", Value: 1}},
+	})
+	return err
+}
+
+// Shadows are keyed by device id, which _id already indexes; the
+// collection is created so every collection the server uses comes from a
+// migration.
+func shadowsCollection(ctx context.Context, db *mongo.Database) error {
+	return ensureCollection(ctx, db, "shadows")
+}
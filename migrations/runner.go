@@ -0,0 +1,161 @@
+// Package migrations brings the miniworld database's indexes, validators
+// and data up to date. Each migration runs once, in version order; the
+// versions applied are recorded in the schemaMigrations collection.
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration is one step of the schema. Up must be safe to re-run, since a
+// node can die after applying a step but before recording it. Up returns an
+// error wrapping ErrBlocked when existing data must be fixed by hand first.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, db *mongo.Database) error
+}
+
+// Record is a migration that has been applied.
+type Record struct {
+	Version   int           `json:"version" bson:"_id"`
+	Name      string        `json:"name" bson:"name"`
+	AppliedAt time.Time     `json:"applied_at" bson:"applied_at"`
+	Took      time.Duration `json:"took" bson:"took"`
+}
+
+// Status pairs a migration with its record, which is nil while pending.
+type Status struct {
+	Migration Migration
+	Applied   *Record
+}
+
+const (
+	recordsCollection = "schemaMigrations"
+	locksCollection   = "migrationLocks"
+
+	// a node that dies mid-migration holds the lock this long
+	lockTTL      = 10 * time.Minute
+	lockRetry    = time.Second
+	lockDocument = "migrations"
+)
+
+var (
+	// ErrLocked is returned when another node holds the migration lock past
+	// the caller's deadline.
+	ErrLocked = errors.New("migrations: locked by another node")
+	// ErrBlocked marks a migration that can't apply until an operator fixes
+	// the data it found, such as duplicates under a new unique index.
+	ErrBlocked = errors.New("migrations: blocked by existing data")
+)
+
+// Run applies every pending migration in version order and returns the ones
+// it applied. Nodes starting together wait for each other. A blocked
+// migration stays pending and the rest still run, so no later migration may
+// depend on one that can block; Run then returns the blocked ones' errors,
+// which wrap ErrBlocked.
+func Run(ctx context.Context, db *mongo.Database) ([]Record, error) {
+	unlock, err := acquire(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	statuses, err := Statuses(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := []Record{}
+	var blocked []error
+	for _, s := range statuses {
+		if s.Applied != nil {
+			continue
+		}
+		m := s.Migration
+		start := time.Now()
+		if err := m.Up(ctx, db); err != nil {
+			err = fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+			if errors.Is(err, ErrBlocked) {
+				log.Printf("Skipped %v", err)
+				blocked = append(blocked, err)
+				continue
+			}
+			return applied, err
+		}
+		record := Record{Version: m.Version, Name: m.Name, AppliedAt: time.Now(), Took: time.Since(start)}
+		if _, err := db.Collection(recordsCollection).InsertOne(ctx, record); err != nil {
+			return applied, fmt.Errorf("recording migration %d %s: %w", m.Version, m.Name, err)
+		}
+		log.Printf("Applied migration %d %s in %s", m.Version, m.Name, record.Took.Round(time.Millisecond))
+		applied = append(applied, record)
+	}
+	return applied, errors.Join(blocked...)
+}
+
+// Statuses lists every known migration with when it was applied.
+func Statuses(ctx context.Context, db *mongo.Database) ([]Status, error) {
+	cursor, err := db.Collection(recordsCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Record, len(records))
+	for i := range records {
+		byVersion[records[i].Version] = &records[i]
+	}
+
+	statuses := make([]Status, 0, len(All))
+	for _, m := range All {
+		statuses = append(statuses, Status{Migration: m, Applied: byVersion[m.Version]})
+	}
+	return statuses, nil
+}
+
+// acquire takes the migration lock, waiting while another node holds it.
+func acquire(ctx context.Context, db *mongo.Database) (func(), error) {
+	locks := db.Collection(locksCollection)
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%s/%d/%d", host, os.Getpid(), time.Now().UnixNano())
+
+	for {
+		now := time.Now()
+		// a held lock doesn't match, so the upsert collides with it
+		_, err := locks.UpdateOne(ctx,
+			bson.M{"_id": lockDocument, "expires_at": bson.M{"$lt": now}},
+			bson.M{"$set": bson.M{"owner": owner, "expires_at": now.Add(lockTTL)}},
+			options.Update().SetUpsert(true),
+		)
+		if err == nil {
+			break
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ErrLocked
+		case <-time.After(lockRetry):
+		}
+	}
+
+	return func() {
+		mctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := locks.DeleteOne(mctx, bson.M{"_id": lockDocument, "owner": owner}); err != nil {
+			log.Printf("Failed to release migration lock: %v", err)
+		}
+	}, nil
+}
@@ -7,11 +7,12 @@ import (
 )
 
 type Clan struct {
-	ID          primitive.ObjectID `json:"id" bson:"_id"`            // Clan ID
-	AdminID     primitive.ObjectID `json:"admin_id" bson:"admin_id"` // User ID of clan admin
-	ClanDetails *ClanDetails       `json:"clan_details" bson:"clan_details"`
-	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
-	UpdatedAt   time.Time          `json:"updated_at" bson:"updated_at"`
+	ID          primitive.ObjectID   `json:"id" bson:"_id"`            // Clan ID
+	AdminID     primitive.ObjectID   `json:"admin_id" bson:"admin_id"` // User ID of clan admin
+	ClanDetails *ClanDetails         `json:"clan_details" bson:"clan_details"`
+	MemberIDs   []primitive.ObjectID `json:"member_ids" bson:"member_ids,omitempty"` // Users besides the admin who watch its devices
+	CreatedAt   time.Time            `json:"created_at" bson:"created_at"`
+	UpdatedAt   time.Time            `json:"updated_at" bson:"updated_at"`
 }
 
 type ClanDetails struct {
@@ -20,3 +21,10 @@ type ClanDetails struct {
 	Description *string   `json:"description" bson:"description"`
 	DeviceIDs   *[]string `json:"device_ids" bson:"device_ids"`
 }
+
+// MembersRequest adds and removes clan members by email.
+type MembersRequest struct {
+	ClanID primitive.ObjectID `json:"clan_id" binding:"required"`
+	Add    []string           `json:"add" binding:"dive,email"`
+	Remove []string           `json:"remove" binding:"dive,email"`
+}
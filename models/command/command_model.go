@@ -0,0 +1,60 @@
+package command_models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	StatusPending   = "pending"   // stored, car not reached yet
+	StatusDelivered = "delivered" // written to the car's socket, no ack yet
+	StatusAcked     = "acked"     // car confirmed it applied the command
+	StatusFailed    = "failed"    // car rejected the command
+	StatusExpired   = "expired"   // TTL ran out before an ack
+	StatusCancelled = "cancelled" // withdrawn by the server before an ack
+)
+
+// Command is a non-realtime instruction queued for a device until it acks.
+type Command struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id"`
+	DeviceID    primitive.ObjectID `json:"device_id" bson:"device_id"`
+	IssuedBy    primitive.ObjectID `json:"issued_by" bson:"issued_by"`
+	Command     string             `json:"command" bson:"command"`
+	Payload     interface{}        `json:"payload" bson:"payload"`
+	Status      string             `json:"status" bson:"status"`
+	Attempts    int                `json:"attempts" bson:"attempts"`
+	Result      interface{}        `json:"result" bson:"result"`
+	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
+	ExpiresAt   time.Time          `json:"expires_at" bson:"expires_at"`
+	DeliveredAt *time.Time         `json:"delivered_at" bson:"delivered_at"`
+	AckedAt     *time.Time         `json:"acked_at" bson:"acked_at"`
+}
+
+type EnqueueRequest struct {
+	DeviceID   string      `json:"device_id" binding:"required"`
+	Command    string      `json:"command" binding:"required,max=64"`
+	Payload    interface{} `json:"payload"`
+	TTLSeconds int64       `json:"ttl_seconds" binding:"omitempty,min=1,max=604800"`
+}
+
+// UserCommandMessage is the data of a "command" envelope sent by a user over
+// their control socket.
+type UserCommandMessage struct {
+	Command    string      `json:"command" validate:"required,max=64"`
+	Payload    interface{} `json:"payload"`
+	TTLSeconds int64       `json:"ttl_seconds" validate:"omitempty,min=1,max=604800"`
+}
+
+// DeviceCommandMessage is the data of a "command" envelope sent to a car.
+type DeviceCommandMessage struct {
+	Command   string      `json:"command"`
+	Payload   interface{} `json:"payload"`
+	ExpiresAt time.Time   `json:"expires_at"`
+}
+
+// DeviceAck is the data of a "command_ack" envelope sent by a car.
+type DeviceAck struct {
+	OK     bool        `json:"ok"`
+	Result interface{} `json:"result"`
+}
@@ -0,0 +1,25 @@
+package device_models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DeviceCert records a client certificate issued by the built-in CA.
+// The private key is never stored; it is handed to the admin once at issue time.
+type DeviceCert struct {
+	Serial    string             `json:"serial" bson:"_id"`
+	DeviceID  primitive.ObjectID `json:"device_id" bson:"device_id"`
+	AdminID   primitive.ObjectID `json:"admin_id" bson:"admin_id"`
+	CertPEM   string             `json:"certificate" bson:"cert_pem"`
+	NotBefore time.Time          `json:"not_before" bson:"not_before"`
+	NotAfter  time.Time          `json:"not_after" bson:"not_after"`
+	Revoked   bool               `json:"revoked" bson:"revoked"`
+	RevokedAt *time.Time         `json:"revoked_at" bson:"revoked_at"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+}
+
+type CertSerialRequest struct {
+	Serial string `json:"serial" binding:"required"`
+}
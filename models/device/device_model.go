@@ -16,6 +16,18 @@ type Device struct {
 	Access_Token  string             `json:"access_token" bson:"access_token"`
 	Refresh_Token string             `json:"refresh_token" bson:"refresh_token"`
 	Refresh_ID    time.Time          `json:"refresh_id" bson:"refresh_id"`
-	Created_At    time.Time          `json:"created_at" bson:"created_at"`
-	Updated_At    time.Time          `json:"updated_at" bson:"updated_at"`
+	Revoked       bool               `json:"revoked" bson:"revoked"`
+	// firmware the car last reported running, and the channel it follows
+	FirmwareID      primitive.ObjectID `json:"firmware_id" bson:"firmware_id,omitempty"`
+	FirmwareVersion string             `json:"firmware_version" bson:"firmware_version,omitempty"`
+	FirmwareChannel string             `json:"firmware_channel" bson:"firmware_channel,omitempty"`
+	Created_At      time.Time          `json:"created_at" bson:"created_at"`
+	Updated_At      time.Time          `json:"updated_at" bson:"updated_at"`
+
+	// generation of the presence record is_online was last derived from
+	PresenceGeneration int64 `json:"-" bson:"presence_generation,omitempty"`
+}
+
+type DeviceIDRequest struct {
+	ID primitive.ObjectID `json:"id" binding:"required"`
 }
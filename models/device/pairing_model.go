@@ -0,0 +1,27 @@
+package device_models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PairingCode is a short-lived, single-use code a car exchanges for its credential.
+type PairingCode struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	Code      string             `json:"code" bson:"code"`
+	ClanID    primitive.ObjectID `json:"clan_id" bson:"clan_id"`
+	AdminID   primitive.ObjectID `json:"admin_id" bson:"admin_id"`
+	Color     string             `json:"color" bson:"color"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+	ExpiresAt time.Time          `json:"expires_at" bson:"expires_at"`
+}
+
+type PairingRequest struct {
+	ClanID primitive.ObjectID `json:"clan_id" binding:"required"`
+	Color  string             `json:"color"`
+}
+
+type PairDeviceRequest struct {
+	Code string `json:"code" binding:"required"`
+}
@@ -0,0 +1,114 @@
+package firmware_models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ChannelStable = "stable"
+	ChannelBeta   = "beta"
+	ChannelDev    = "dev"
+)
+
+const (
+	ReleaseActive     = "active"
+	ReleaseRolledBack = "rolled_back"
+)
+
+// Per-device rollout states. The car reports everything after "offered".
+const (
+	RolloutOffered     = "offered"
+	RolloutDownloading = "downloading"
+	RolloutInstalling  = "installing"
+	RolloutSucceeded   = "succeeded"
+	RolloutFailed      = "failed"
+	RolloutRollingBack = "rolling_back"
+	RolloutRolledBack  = "rolled_back"
+	RolloutSkipped     = "skipped"
+)
+
+// Firmware is a signed binary stored in the object store.
+type Firmware struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id"`
+	ClanID     primitive.ObjectID `json:"clan_id" bson:"clan_id"`
+	Version    string             `json:"version" bson:"version"`
+	Notes      string             `json:"notes" bson:"notes"`
+	ObjectKey  string             `json:"object_key" bson:"object_key"`
+	Size       int64              `json:"size" bson:"size"`
+	SHA256     string             `json:"sha256" bson:"sha256"`
+	Signature  string             `json:"signature" bson:"signature"` // base64 ed25519 over the binary
+	UploadedBy primitive.ObjectID `json:"uploaded_by" bson:"uploaded_by"`
+	CreatedAt  time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// Release offers a firmware to the devices of a clan on one channel.
+type Release struct {
+	ID         primitive.ObjectID   `json:"id" bson:"_id"`
+	FirmwareID primitive.ObjectID   `json:"firmware_id" bson:"firmware_id"`
+	Version    string               `json:"version" bson:"version"`
+	ClanID     primitive.ObjectID   `json:"clan_id" bson:"clan_id"`
+	Channel    string               `json:"channel" bson:"channel"`
+	GroupID    primitive.ObjectID   `json:"group_id" bson:"group_id,omitempty"`
+	DeviceIDs  []primitive.ObjectID `json:"device_ids" bson:"device_ids"`
+	Status     string               `json:"status" bson:"status"`
+	CreatedBy  primitive.ObjectID   `json:"created_by" bson:"created_by"`
+	CreatedAt  time.Time            `json:"created_at" bson:"created_at"`
+	UpdatedAt  time.Time            `json:"updated_at" bson:"updated_at"`
+}
+
+// Rollout tracks one device's progress through a release.
+type Rollout struct {
+	ID             primitive.ObjectID `json:"id" bson:"_id"`
+	ReleaseID      primitive.ObjectID `json:"release_id" bson:"release_id"`
+	DeviceID       primitive.ObjectID `json:"device_id" bson:"device_id"`
+	FromFirmwareID primitive.ObjectID `json:"from_firmware_id" bson:"from_firmware_id,omitempty"`
+	CommandID      primitive.ObjectID `json:"command_id" bson:"command_id"`
+	Status         string             `json:"status" bson:"status"`
+	Error          string             `json:"error" bson:"error"`
+	UpdatedAt      time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+type CreateReleaseRequest struct {
+	FirmwareID primitive.ObjectID   `json:"firmware_id" binding:"required"`
+	Channel    string               `json:"channel" binding:"required,oneof=stable beta dev"`
+	DeviceIDs  []primitive.ObjectID `json:"device_ids"`
+}
+
+type ReleaseIDRequest struct {
+	ReleaseID primitive.ObjectID `json:"release_id" binding:"required"`
+}
+
+type SetChannelRequest struct {
+	DeviceID primitive.ObjectID `json:"device_id" binding:"required"`
+	Channel  string             `json:"channel" binding:"required,oneof=stable beta dev"`
+}
+
+// UpdateOffer is the payload of a "firmware_update" command sent to a car.
+type UpdateOffer struct {
+	ReleaseID  string `json:"release_id"`
+	FirmwareID string `json:"firmware_id"`
+	Version    string `json:"version"`
+	URL        string `json:"url"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+	Signature  string `json:"signature"`
+	Rollback   bool   `json:"rollback"`
+}
+
+// DeviceFirmware is the data of a "firmware_info" envelope a car sends on
+// connect naming the image it booted. FirmwareID is empty for images that
+// weren't installed through a release.
+type DeviceFirmware struct {
+	FirmwareID string `json:"firmware_id"`
+	Version    string `json:"version"`
+}
+
+// DeviceStatus is the data of a "firmware_status" envelope sent by a car.
+type DeviceStatus struct {
+	ReleaseID string `json:"release_id"`
+	Status    string `json:"status"`
+	Version   string `json:"version"`
+	Error     string `json:"error"`
+}
@@ -0,0 +1,53 @@
+package group_models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DeviceGroup is a named subset of a clan's devices.
+type DeviceGroup struct {
+	ID        primitive.ObjectID   `json:"id" bson:"_id"`
+	ClanID    primitive.ObjectID   `json:"clan_id" bson:"clan_id"`
+	Name      string               `json:"name" bson:"name"`
+	DeviceIDs []primitive.ObjectID `json:"device_ids" bson:"device_ids"`
+	CreatedBy primitive.ObjectID   `json:"created_by" bson:"created_by"`
+	CreatedAt time.Time            `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time            `json:"updated_at" bson:"updated_at"`
+}
+
+type CreateGroupRequest struct {
+	ClanID    primitive.ObjectID   `json:"clan_id" binding:"required"`
+	Name      string               `json:"name" binding:"required,min=1,max=48"`
+	DeviceIDs []primitive.ObjectID `json:"device_ids"`
+}
+
+type UpdateMembersRequest struct {
+	GroupID primitive.ObjectID   `json:"group_id" binding:"required"`
+	Add     []primitive.ObjectID `json:"add"`
+	Remove  []primitive.ObjectID `json:"remove"`
+}
+
+type GroupIDRequest struct {
+	GroupID primitive.ObjectID `json:"group_id" binding:"required"`
+}
+
+type BulkConfigureRequest struct {
+	GroupID primitive.ObjectID     `json:"group_id" binding:"required"`
+	Desired map[string]interface{} `json:"desired" binding:"required"`
+}
+
+type BulkFirmwareRequest struct {
+	GroupID    primitive.ObjectID `json:"group_id" binding:"required"`
+	FirmwareID primitive.ObjectID `json:"firmware_id" binding:"required"`
+}
+
+// DeviceResult is the outcome of a bulk operation on one device.
+type DeviceResult struct {
+	DeviceID string      `json:"device_id"`
+	OK       bool        `json:"ok"`
+	Status   string      `json:"status,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+}
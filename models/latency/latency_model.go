@@ -0,0 +1,54 @@
+package latency_models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Stats summarises one latency measure over a session, in milliseconds.
+type Stats struct {
+	Count int     `json:"count" bson:"count"`
+	Avg   float64 `json:"avg_ms" bson:"avg_ms"`
+	P50   float64 `json:"p50_ms" bson:"p50_ms"`
+	P95   float64 `json:"p95_ms" bson:"p95_ms"`
+	Max   float64 `json:"max_ms" bson:"max_ms"`
+}
+
+// Summary holds the three legs of the control loop.
+type Summary struct {
+	// UserToServer is half the websocket round trip to the driver
+	UserToServer Stats `json:"user_to_server" bson:"user_to_server"`
+	// ServerToDevice is half the websocket round trip to the car
+	ServerToDevice Stats `json:"server_to_device" bson:"server_to_device"`
+	// DeviceAck is from forwarding a control message to receiving its ack
+	DeviceAck Stats `json:"device_ack" bson:"device_ack"`
+}
+
+// ControlSession is the history record of one driver controlling one car.
+type ControlSession struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	DeviceID  primitive.ObjectID `json:"device_id" bson:"device_id"`
+	UserID    primitive.ObjectID `json:"user_id" bson:"user_id"`
+	StartedAt time.Time          `json:"started_at" bson:"started_at"`
+	EndedAt   time.Time          `json:"ended_at" bson:"ended_at"`
+	Messages  int                `json:"messages" bson:"messages"`
+	Acked     int                `json:"acked" bson:"acked"`
+	Latency   Summary            `json:"latency" bson:"latency"`
+}
+
+// Report is pushed to the driver when the car acks a stamped control message.
+// ClientTs is echoed so the client can measure its own full round trip.
+type Report struct {
+	Seq              uint64  `json:"seq"`
+	ClientTs         int64   `json:"client_ts,omitempty"`
+	UserToServerMs   float64 `json:"user_to_server_ms"`
+	ServerToDeviceMs float64 `json:"server_to_device_ms"`
+	DeviceAckMs      float64 `json:"device_ack_ms"`
+	EstimatedMs      float64 `json:"estimated_ms"`
+}
+
+// DeviceAck is the data of a control_ack sent by the car.
+type DeviceAck struct {
+	Seq uint64 `json:"seq"`
+}
@@ -0,0 +1,48 @@
+package presence_models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Streams a device may hold a connection on.
+const (
+	StreamControl = "control"
+	StreamCamera  = "camera"
+)
+
+// StreamDriver is the user driving the car. It isn't a device connection
+// and doesn't count towards the device being online.
+const StreamDriver = "driver"
+
+// Lease is one node's claim on a device stream. It must be renewed before
+// it expires or the stream is considered disconnected.
+type Lease struct {
+	Node        string    `json:"node" bson:"node"`
+	UserID      string    `json:"user_id,omitempty" bson:"user_id,omitempty"`
+	Generation  int64     `json:"generation" bson:"generation"`
+	ConnectedAt time.Time `json:"connected_at" bson:"connected_at"`
+	ExpiresAt   time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+// Presence records which node owns each of a device's connections.
+// Generation grows with every claim, release and expiry, and only the
+// holder of the current generation of a stream may change it.
+type Presence struct {
+	DeviceID   primitive.ObjectID `json:"device_id" bson:"_id"`
+	Generation int64              `json:"generation" bson:"generation"`
+	Control    *Lease             `json:"control,omitempty" bson:"control,omitempty"`
+	Camera     *Lease             `json:"camera,omitempty" bson:"camera,omitempty"`
+	Driver     *Lease             `json:"driver,omitempty" bson:"driver,omitempty"`
+}
+
+// Online reports whether any stream holds a live lease.
+func (p Presence) Online(now time.Time) bool {
+	for _, l := range []*Lease{p.Control, p.Camera} {
+		if l != nil && l.ExpiresAt.After(now) {
+			return true
+		}
+	}
+	return false
+}
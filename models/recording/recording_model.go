@@ -0,0 +1,30 @@
+package recording_models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	StatusRecording = "recording"
+	StatusUploading = "uploading"
+	StatusComplete  = "complete"
+	StatusFailed    = "failed"
+)
+
+// Recording describes one captured session of a device's control and camera streams.
+type Recording struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id"`
+	DeviceID      primitive.ObjectID `json:"device_id" bson:"device_id"`
+	UserID        primitive.ObjectID `json:"user_id" bson:"user_id"`
+	Status        string             `json:"status" bson:"status"`
+	ObjectKey     string             `json:"-" bson:"object_key"`
+	Size          int64              `json:"size" bson:"size"`
+	Frames        int                `json:"frames" bson:"frames"`
+	DurationMs    int64              `json:"duration_ms" bson:"duration_ms"`
+	DroppedFrames int                `json:"dropped_frames" bson:"dropped_frames"`
+	Error         string             `json:"error,omitempty" bson:"error,omitempty"`
+	StartedAt     time.Time          `json:"started_at" bson:"started_at"`
+	EndedAt       *time.Time         `json:"ended_at,omitempty" bson:"ended_at,omitempty"`
+}
@@ -0,0 +1,34 @@
+package shadow_models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Shadow holds what a car's settings should be (desired) next to what the
+// car last said they are (reported). Delta is computed, never stored.
+type Shadow struct {
+	DeviceID  primitive.ObjectID `json:"device_id" bson:"_id"`
+	Desired   bson.M             `json:"desired" bson:"desired"`
+	Reported  bson.M             `json:"reported" bson:"reported"`
+	Delta     bson.M             `json:"delta" bson:"-"`
+	Version   int64              `json:"version" bson:"version"`
+	UpdatedAt time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+// UpdateDesiredRequest patches the desired state. A null value removes the key.
+// Version, when set, must match the stored version or the update is rejected.
+type UpdateDesiredRequest struct {
+	DeviceID string                 `json:"device_id" binding:"required"`
+	Desired  map[string]interface{} `json:"desired" binding:"required"`
+	Version  *int64                 `json:"version"`
+}
+
+// DeviceShadowMessage is the data of a "shadow" envelope sent to a car.
+type DeviceShadowMessage struct {
+	Desired bson.M `json:"desired"`
+	Delta   bson.M `json:"delta"`
+	Version int64  `json:"version"`
+}
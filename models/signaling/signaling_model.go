@@ -0,0 +1,56 @@
+package signaling_models
+
+import "time"
+
+// Camera modes the car is told to switch between.
+const (
+	CameraModeRelay = "relay"
+	CameraModeP2P   = "p2p"
+)
+
+// Peer connection states reported in webrtc_state.
+const (
+	StateOffered      = "offered"
+	StateAnswered     = "answered"
+	StateConnected    = "connected"
+	StateFailed       = "failed"
+	StateDisconnected = "disconnected"
+	StateClosed       = "closed"
+)
+
+// ICEServer is handed to RTCPeerConnection as-is.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// SessionDescription carries an SDP offer or answer.
+type SessionDescription struct {
+	SDP        string      `json:"sdp" validate:"required,max=65536"`
+	ICEServers []ICEServer `json:"ice_servers,omitempty"`
+}
+
+// ICECandidate is a trickled candidate; an empty candidate ends gathering.
+type ICECandidate struct {
+	Candidate     string  `json:"candidate" validate:"max=4096"`
+	SDPMid        *string `json:"sdpMid,omitempty"`
+	SDPMLineIndex *int    `json:"sdpMLineIndex,omitempty"`
+}
+
+// StateReport is sent by either peer when its connection state changes,
+// and by the server to keep both sides in step.
+type StateReport struct {
+	State    string `json:"state" validate:"required,oneof=offered answered connected failed disconnected closed"`
+	Reason   string `json:"reason,omitempty"`
+	Fallback string `json:"fallback,omitempty"`
+}
+
+// Session is the in-progress peer connection for one device.
+type Session struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	DeviceID  string    `json:"device_id"`
+	State     string    `json:"state"`
+	StartedAt time.Time `json:"started_at"`
+}
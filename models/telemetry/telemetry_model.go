@@ -0,0 +1,51 @@
+package telemetry_models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Position struct {
+	Lat float64 `json:"lat" bson:"lat"`
+	Lng float64 `json:"lng" bson:"lng"`
+}
+
+// Sample is one telemetry reading. Every metric is optional so cars can
+// report whatever sensors they have.
+type Sample struct {
+	DeviceID  primitive.ObjectID `json:"device_id" bson:"device_id"`
+	Timestamp time.Time          `json:"ts" bson:"ts"`
+	Battery   *float64           `json:"battery,omitempty" bson:"battery,omitempty"`       // percent
+	Speed     *float64           `json:"speed,omitempty" bson:"speed,omitempty"`           // m/s
+	RSSI      *int               `json:"rssi,omitempty" bson:"rssi,omitempty"`             // dBm
+	MotorTemp *float64           `json:"motor_temp,omitempty" bson:"motor_temp,omitempty"` // °C
+	Position  *Position          `json:"position,omitempty" bson:"position,omitempty"`
+	// Backfilled marks samples the car buffered and sent more than
+	// backfillAfter late
+	Backfilled bool `json:"backfilled,omitempty" bson:"backfilled,omitempty"`
+}
+
+// DeviceSample is what a car sends in the data of a "telemetry" envelope.
+type DeviceSample struct {
+	TimestampMs int64     `json:"ts"`
+	Battery     *float64  `json:"battery" validate:"omitempty,min=0,max=100"`
+	Speed       *float64  `json:"speed" validate:"omitempty,min=0"`
+	RSSI        *int      `json:"rssi" validate:"omitempty,max=0"`
+	MotorTemp   *float64  `json:"motor_temp"`
+	Position    *Position `json:"position"`
+}
+
+// Bucket is one downsampled interval of a device's telemetry.
+type Bucket struct {
+	Start        time.Time `json:"start" bson:"_id"`
+	Count        int       `json:"count" bson:"count"`
+	AvgBattery   *float64  `json:"avg_battery" bson:"avg_battery"`
+	MinBattery   *float64  `json:"min_battery" bson:"min_battery"`
+	AvgSpeed     *float64  `json:"avg_speed" bson:"avg_speed"`
+	MaxSpeed     *float64  `json:"max_speed" bson:"max_speed"`
+	AvgRSSI      *float64  `json:"avg_rssi" bson:"avg_rssi"`
+	AvgMotorTemp *float64  `json:"avg_motor_temp" bson:"avg_motor_temp"`
+	MaxMotorTemp *float64  `json:"max_motor_temp" bson:"max_motor_temp"`
+	LastPosition *Position `json:"last_position" bson:"last_position"`
+}
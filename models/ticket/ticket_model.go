@@ -0,0 +1,34 @@
+package ticket_models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Streams a websocket ticket can be issued for. Control and camera tickets
+// are bound to one device, replay tickets to one recording.
+const (
+	StreamControl = "control"
+	StreamCamera  = "camera"
+	StreamReplay  = "replay"
+	StreamLobby   = "lobby"
+)
+
+// Ticket lets a browser open one websocket without an Authorization header.
+// Only a hash of the ticket is stored.
+type Ticket struct {
+	ID          string             `json:"-" bson:"_id"`
+	UserID      primitive.ObjectID `json:"user_id" bson:"user_id"`
+	DeviceID    primitive.ObjectID `json:"device_id,omitempty" bson:"device_id,omitempty"`
+	RecordingID primitive.ObjectID `json:"recording_id,omitempty" bson:"recording_id,omitempty"`
+	Stream      string             `json:"stream" bson:"stream"`
+	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
+	ExpiresAt   time.Time          `json:"expires_at" bson:"expires_at"`
+}
+
+type TicketRequest struct {
+	Stream      string `json:"stream" binding:"required"`
+	DeviceID    string `json:"device_id"`
+	RecordingID string `json:"recording_id"`
+}
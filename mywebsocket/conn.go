@@ -0,0 +1,65 @@
+package mywebsocket
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Conn wraps a websocket connection so several goroutines (relay loops,
+// REST handlers pushing to a device) can write to it safely. Reads stay
+// with the handler that owns the connection.
+type Conn struct {
+	*websocket.Conn
+	writeMu sync.Mutex
+}
+
+func NewConn(conn *websocket.Conn) *Conn {
+	return &Conn{Conn: conn}
+}
+
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+func (c *Conn) WriteJSON(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.WriteJSON(v)
+}
+
+// StartPinger pings the peer every interval and reports each round trip
+// to onRTT. It installs the connection's pong handler, so it must not be
+// combined with another one. Call stop when the connection closes.
+func (c *Conn) StartPinger(interval time.Duration, onRTT func(time.Duration)) (stop func()) {
+	c.SetPongHandler(func(appData string) error {
+		if sent, err := strconv.ParseInt(appData, 10, 64); err == nil {
+			onRTT(time.Since(time.Unix(0, sent)))
+		}
+		return nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				stamp := strconv.FormatInt(time.Now().UnixNano(), 10)
+				if err := c.WriteControl(websocket.PingMessage, []byte(stamp), time.Now().Add(5*time.Second)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
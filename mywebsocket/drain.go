@@ -0,0 +1,133 @@
+package mywebsocket
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ShutdownReason is sent in the going-away close frame when the server drains.
+const ShutdownReason = "server shutting down"
+
+var (
+	trackedMu sync.Mutex
+	// every upgraded socket whose handler hasn't returned yet
+	tracked = map[*websocket.Conn]struct{}{}
+)
+
+// Track registers an upgraded socket so Drain can close it and wait for its
+// handler. Defer the returned func right after the upgrade, so it runs after
+// the handler's other cleanup.
+func Track(conn *websocket.Conn) (untrack func()) {
+	trackedMu.Lock()
+	tracked[conn] = struct{}{}
+	trackedMu.Unlock()
+
+	return func() {
+		trackedMu.Lock()
+		delete(tracked, conn)
+		trackedMu.Unlock()
+	}
+}
+
+func trackedConns() []*websocket.Conn {
+	trackedMu.Lock()
+	defer trackedMu.Unlock()
+	out := make([]*websocket.Conn, 0, len(tracked))
+	for conn := range tracked {
+		out = append(out, conn)
+	}
+	return out
+}
+
+// DrivenDevices returns the devices driven through this node, mapped to
+// their driver: cars connected here that anyone controls, and cars
+// controlled by users connected here.
+func DrivenDevices() map[string]string {
+	out := map[string]string{}
+	for _, sm := range controlManagers() {
+		sm.mu.RLock()
+		for deviceID, userID := range sm.userByDevice {
+			out[deviceID] = userID
+		}
+		devices := make([]string, 0, len(sm.devices))
+		for deviceID := range sm.devices {
+			devices = append(devices, deviceID)
+		}
+		sm.mu.RUnlock()
+
+		for _, st := range Events.Snapshot(devices) {
+			if st.LeasedBy != "" {
+				out[st.DeviceID] = st.LeasedBy
+			}
+		}
+	}
+	return out
+}
+
+// Drain tells every user on this node that the server is going away, then
+// closes every socket with a going-away close frame, users first. It
+// returns once all the socket handlers have finished their cleanup, or
+// with ctx's error if they don't in time.
+func Drain(ctx context.Context) error {
+	managersMu.Lock()
+	all := append([]*SessionManager(nil), managers...)
+	managersMu.Unlock()
+
+	notice := map[string]interface{}{
+		"type": TypeServerShutdown,
+		"data": map[string]string{"reason": ShutdownReason},
+	}
+	for _, sm := range all {
+		sm.mu.RLock()
+		users := make([]*Session, 0, len(sm.users))
+		for _, s := range sm.users {
+			users = append(users, s)
+		}
+		sm.mu.RUnlock()
+
+		for _, s := range users {
+			_ = s.Conn.WriteJSON(notice)
+			closeConn(s.Conn, websocket.CloseGoingAway, ShutdownReason)
+		}
+	}
+	Frames.CloseAll()
+
+	for _, sm := range all {
+		sm.mu.RLock()
+		devices := make([]*Conn, 0, len(sm.devices))
+		for _, c := range sm.devices {
+			devices = append(devices, c)
+		}
+		sm.mu.RUnlock()
+
+		for _, c := range devices {
+			closeConn(c, websocket.CloseGoingAway, ShutdownReason)
+		}
+	}
+
+	// sockets outside the session managers, such as replays and the lobby
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, ShutdownReason)
+	for _, conn := range trackedConns() {
+		_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		_ = conn.Close()
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		trackedMu.Lock()
+		remaining := len(tracked)
+		trackedMu.Unlock()
+		if remaining == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
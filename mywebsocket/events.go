@@ -0,0 +1,187 @@
+package mywebsocket
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// EventType names a presence change published by the session managers.
+type EventType string
+
+const (
+	EventDeviceOnline  EventType = "device_online"
+	EventDeviceOffline EventType = "device_offline"
+	EventLeaseAcquired EventType = "lease_acquired"
+	EventLeaseReleased EventType = "lease_released"
+	EventViewerCount   EventType = "viewer_count"
+)
+
+// Event is a single presence change for a device.
+type Event struct {
+	Type     EventType `json:"type"`
+	DeviceID string    `json:"device_id"`
+	UserID   string    `json:"user_id,omitempty"`
+	Viewers  int       `json:"viewers"`
+	At       time.Time `json:"at"`
+	// Node is the server that published the event.
+	Node string `json:"node,omitempty"`
+}
+
+// DeviceState is the last known presence of a device as seen by the hub.
+type DeviceState struct {
+	DeviceID string `json:"device_id"`
+	IsOnline bool   `json:"is_online"`
+	LeasedBy string `json:"leased_by,omitempty"`
+	Viewers  int    `json:"viewers"`
+}
+
+// EventHub fans presence events out to every subscriber.
+// A subscriber too slow to keep up is dropped instead of blocking the
+// publisher: its channel is closed, and it should subscribe again and
+// take a fresh Snapshot rather than show state with events missing.
+type EventHub struct {
+	mu          sync.RWMutex
+	subscribers map[*subscription]struct{}
+
+	// deviceId -> current presence, folded from published events
+	state map[string]*DeviceState
+
+	// deviceId -> node -> viewers on that node
+	viewers map[string]map[string]int
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{
+		subscribers: make(map[*subscription]struct{}),
+		state:       make(map[string]*DeviceState),
+		viewers:     make(map[string]map[string]int),
+	}
+}
+
+// Events is the hub shared by all session managers in this process.
+var Events = NewEventHub()
+
+type subscription struct {
+	ch   chan Event
+	once sync.Once
+}
+
+func (s *subscription) close() {
+	s.once.Do(func() { close(s.ch) })
+}
+
+// Subscribe returns a channel of events and a func to stop receiving them.
+// The channel is closed if the subscriber falls behind.
+func (h *EventHub) Subscribe() (<-chan Event, func()) {
+	sub := &subscription{ch: make(chan Event, 64)}
+
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub.ch, func() {
+		h.mu.Lock()
+		delete(h.subscribers, sub)
+		h.mu.Unlock()
+		sub.close()
+	}
+}
+
+// Publish applies the event and forwards it to the other nodes.
+func (h *EventHub) Publish(ev Event) {
+	if ev.At.IsZero() {
+		ev.At = time.Now()
+	}
+	if ev.Node == "" {
+		ev.Node = NodeID()
+	}
+	h.publishLocal(ev)
+
+	if b := currentBroker(); b != nil {
+		if data, err := json.Marshal(ev); err == nil {
+			_ = b.Publish(eventsSubject, data)
+		}
+	}
+}
+
+// publishLocal applies the event without forwarding it.
+func (h *EventHub) publishLocal(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ev = h.apply(ev)
+	for sub := range h.subscribers {
+		select {
+		case sub.ch <- ev:
+		default:
+			delete(h.subscribers, sub)
+			sub.close()
+		}
+	}
+}
+
+// Snapshot returns the current presence of the given devices.
+// Devices the hub has never seen are reported offline.
+func (h *EventHub) Snapshot(deviceIDs []string) []DeviceState {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	out := make([]DeviceState, 0, len(deviceIDs))
+	for _, id := range deviceIDs {
+		if st, ok := h.state[id]; ok {
+			out = append(out, *st)
+			continue
+		}
+		out = append(out, DeviceState{DeviceID: id})
+	}
+	return out
+}
+
+// apply folds the event into the device state. Viewer counts are reported
+// per node, so the event is returned with the total across nodes.
+func (h *EventHub) apply(ev Event) Event {
+	st, ok := h.state[ev.DeviceID]
+	if !ok {
+		st = &DeviceState{DeviceID: ev.DeviceID}
+		h.state[ev.DeviceID] = st
+	}
+
+	switch ev.Type {
+	case EventDeviceOnline:
+		st.IsOnline = true
+	case EventDeviceOffline:
+		st.IsOnline = false
+		st.LeasedBy = ""
+	case EventLeaseAcquired:
+		st.LeasedBy = ev.UserID
+	case EventLeaseReleased:
+		if st.LeasedBy == ev.UserID {
+			st.LeasedBy = ""
+		}
+	case EventViewerCount:
+		byNode := h.viewers[ev.DeviceID]
+		if byNode == nil {
+			byNode = make(map[string]int)
+			h.viewers[ev.DeviceID] = byNode
+		}
+		if ev.Viewers > 0 {
+			byNode[ev.Node] = ev.Viewers
+		} else {
+			delete(byNode, ev.Node)
+		}
+		total := 0
+		for _, n := range byNode {
+			total += n
+		}
+		if total == 0 {
+			delete(h.viewers, ev.DeviceID)
+		}
+		st.Viewers = total
+		ev.Viewers = total
+	}
+
+	if !st.IsOnline && st.LeasedBy == "" && st.Viewers == 0 {
+		delete(h.state, ev.DeviceID)
+	}
+	return ev
+}
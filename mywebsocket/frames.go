@@ -0,0 +1,259 @@
+package mywebsocket
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chtan/miniworld/broker"
+)
+
+// viewerQueueSize is how many frames a viewer may fall behind before frames
+// are dropped for it.
+const viewerQueueSize = 8
+
+// Frame is one camera frame as received from the car.
+type Frame struct {
+	Data []byte
+	At   time.Time
+}
+
+// Viewer is one subscriber to a device's camera frames.
+type Viewer struct {
+	C <-chan Frame
+
+	ch       chan Frame
+	hub      *FrameHub
+	deviceID string
+	once     sync.Once
+
+	dropped atomic.Uint64
+	rtt     atomic.Int64
+}
+
+// ViewerStats is a point-in-time view of how well a viewer keeps up.
+type ViewerStats struct {
+	Queue    int           `json:"queue"`
+	Capacity int           `json:"capacity"`
+	Dropped  uint64        `json:"dropped"`
+	RTT      time.Duration `json:"rtt"`
+}
+
+// SetRTT records the latest round trip measured on the viewer's connection.
+func (v *Viewer) SetRTT(d time.Duration) { v.rtt.Store(int64(d)) }
+
+func (v *Viewer) Stats() ViewerStats {
+	return ViewerStats{
+		Queue:    len(v.ch),
+		Capacity: cap(v.ch),
+		Dropped:  v.dropped.Load(),
+		RTT:      time.Duration(v.rtt.Load()),
+	}
+}
+
+// Close stops delivery and closes C.
+func (v *Viewer) Close() {
+	v.once.Do(func() {
+		h := v.hub
+		h.mu.Lock()
+		delete(h.viewers[v.deviceID], v)
+		var feed *remoteFeed
+		if len(h.viewers[v.deviceID]) == 0 {
+			delete(h.viewers, v.deviceID)
+			feed = h.remote[v.deviceID]
+			delete(h.remote, v.deviceID)
+		}
+		h.mu.Unlock()
+		close(v.ch)
+		if feed != nil {
+			feed.stop()
+		}
+	})
+}
+
+// FrameHub fans camera frames out to every viewer and keeps the latest
+// frame of each device for snapshots. Slow viewers skip frames rather
+// than holding up the camera socket.
+//
+// With a broker, viewers on other nodes get the frames too: their node
+// announces interest in the device and the camera's node forwards its frames
+// for as long as the interest is renewed.
+type FrameHub struct {
+	mu      sync.RWMutex
+	viewers map[string]map[*Viewer]struct{}
+	latest  map[string]Frame
+
+	// deviceId -> frames subscription while this node has viewers
+	remote map[string]*remoteFeed
+	// deviceId -> last time another node asked for its frames
+	interest map[string]time.Time
+}
+
+func NewFrameHub() *FrameHub {
+	return &FrameHub{
+		viewers:  make(map[string]map[*Viewer]struct{}),
+		latest:   make(map[string]Frame),
+		remote:   make(map[string]*remoteFeed),
+		interest: make(map[string]time.Time),
+	}
+}
+
+// remoteFeed receives a device's frames from the camera's node.
+type remoteFeed struct {
+	sub  broker.Subscription
+	done chan struct{}
+}
+
+func (f *remoteFeed) stop() {
+	close(f.done)
+	_ = f.sub.Unsubscribe()
+}
+
+// Frames is the hub fed by the camera socket handlers in this process.
+var Frames = NewFrameHub()
+
+// Subscribe starts delivering the device's frames to a new viewer.
+// The caller must Close it.
+func (h *FrameHub) Subscribe(deviceID string) *Viewer {
+	ch := make(chan Frame, viewerQueueSize)
+	v := &Viewer{C: ch, ch: ch, hub: h, deviceID: deviceID}
+
+	h.mu.Lock()
+	first := h.viewers[deviceID] == nil
+	if first {
+		h.viewers[deviceID] = make(map[*Viewer]struct{})
+	}
+	h.viewers[deviceID][v] = struct{}{}
+	h.mu.Unlock()
+
+	if first {
+		h.followRemote(deviceID)
+	}
+	return v
+}
+
+// followRemote subscribes to the device's frames from other nodes and keeps
+// announcing interest until the last viewer here closes.
+func (h *FrameHub) followRemote(deviceID string) {
+	b := currentBroker()
+	if b == nil {
+		return
+	}
+	sub, err := b.Subscribe(subject("camera", deviceID, "frames"), func(msg *broker.Msg) {
+		origin, data, ok := decodeOrigin(msg.Data)
+		if !ok || origin == NodeID() {
+			return
+		}
+		h.deliver(deviceID, data)
+	})
+	if err != nil {
+		log.Printf("Failed to follow camera %s: %v", deviceID, err)
+		return
+	}
+	feed := &remoteFeed{sub: sub, done: make(chan struct{})}
+
+	h.mu.Lock()
+	if h.viewers[deviceID] == nil || h.remote[deviceID] != nil {
+		h.mu.Unlock()
+		_ = sub.Unsubscribe()
+		return
+	}
+	h.remote[deviceID] = feed
+	h.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interestInterval)
+		defer ticker.Stop()
+		for {
+			_ = b.Publish(subject("camera", deviceID, "interest"), encodeOrigin(nil))
+			select {
+			case <-feed.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// noteInterest records that another node has viewers for the device.
+func (h *FrameHub) noteInterest(deviceID string) {
+	h.mu.Lock()
+	h.interest[deviceID] = time.Now()
+	h.mu.Unlock()
+}
+
+// Publish records the frame as the device's latest and hands it to every
+// viewer, here and on nodes that asked for it. The data must not be modified
+// afterwards.
+func (h *FrameHub) Publish(deviceID string, data []byte) {
+	h.deliver(deviceID, data)
+
+	h.mu.RLock()
+	seen, ok := h.interest[deviceID]
+	h.mu.RUnlock()
+	if !ok || time.Since(seen) > interestTTL {
+		return
+	}
+	if b := currentBroker(); b != nil {
+		_ = b.Publish(subject("camera", deviceID, "frames"), encodeOrigin(data))
+	}
+}
+
+func (h *FrameHub) deliver(deviceID string, data []byte) {
+	f := Frame{Data: data, At: time.Now()}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.latest[deviceID] = f
+	for v := range h.viewers[deviceID] {
+		select {
+		case v.ch <- f:
+		default:
+			v.dropped.Add(1)
+		}
+	}
+}
+
+// Viewers returns the viewers currently attached to the device.
+func (h *FrameHub) Viewers(deviceID string) []*Viewer {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make([]*Viewer, 0, len(h.viewers[deviceID]))
+	for v := range h.viewers[deviceID] {
+		out = append(out, v)
+	}
+	return out
+}
+
+// Latest returns the device's most recent frame, if any.
+func (h *FrameHub) Latest(deviceID string) (Frame, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	f, ok := h.latest[deviceID]
+	return f, ok
+}
+
+// CloseAll closes every viewer, ending their streams.
+func (h *FrameHub) CloseAll() {
+	h.mu.RLock()
+	var all []*Viewer
+	for _, viewers := range h.viewers {
+		for v := range viewers {
+			all = append(all, v)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, v := range all {
+		v.Close()
+	}
+}
+
+// Forget drops the cached frame once the camera disconnects.
+func (h *FrameHub) Forget(deviceID string) {
+	h.mu.Lock()
+	delete(h.latest, deviceID)
+	delete(h.interest, deviceID)
+	h.mu.Unlock()
+}
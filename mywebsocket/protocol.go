@@ -0,0 +1,69 @@
+package mywebsocket
+
+import "encoding/json"
+
+// Envelope is the JSON framing for typed text messages on device and user
+// sockets. Anything that doesn't parse as an envelope is relayed untouched.
+type Envelope struct {
+	Type string          `json:"type"`
+	ID   string          `json:"id,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+
+	// Seq and Ts are set by drivers on control messages they want timed;
+	// Ts is the client's clock in unix milliseconds
+	Seq uint64 `json:"seq,omitempty"`
+	Ts  int64  `json:"ts,omitempty"`
+}
+
+const (
+	TypeTelemetry      = "telemetry"
+	TypeShadow         = "shadow"
+	TypeShadowReported = "shadow_reported"
+	TypeCommand        = "command"
+	TypeCommandAck     = "command_ack"
+	TypeCommandQueued  = "command_queued"
+	TypeError          = "error"
+	TypeFirmwareStatus = "firmware_status"
+	TypeFirmwareInfo   = "firmware_info"
+
+	// replay sockets; the client sends the first four, the server the rest
+	TypeReplaySeek   = "replay_seek"
+	TypeReplaySpeed  = "replay_speed"
+	TypeReplayPause  = "replay_pause"
+	TypeReplayResume = "replay_resume"
+	TypeReplayInfo   = "replay_info"
+	TypeReplayEnd    = "replay_end"
+
+	// WebRTC signaling between a driver and their car
+	TypeWebRTCOffer  = "webrtc_offer"
+	TypeWebRTCAnswer = "webrtc_answer"
+	TypeWebRTCICE    = "webrtc_ice"
+	TypeWebRTCHangup = "webrtc_hangup"
+	TypeWebRTCState  = "webrtc_state"
+	TypeCameraMode   = "camera_mode"
+
+	// sent to the camera socket when viewers need a different stream quality
+	TypeCameraQuality = "camera_quality"
+
+	// latency measurement on the control loop
+	TypeControlAck = "control_ack"
+	TypeLatency    = "latency"
+
+	// sent to users just before the server closes their socket on shutdown
+	TypeServerShutdown = "server_shutdown"
+
+	// sent to a driver whose messages were dropped by the relay's rate limits
+	TypeRateLimited = "rate_limited"
+)
+
+// ParseEnvelope decodes a text frame, reporting false for untyped messages.
+func ParseEnvelope(data []byte) (Envelope, bool) {
+	var env Envelope
+	if len(data) == 0 || data[0] != '{' {
+		return env, false
+	}
+	if err := json.Unmarshal(data, &env); err != nil || env.Type == "" {
+		return env, false
+	}
+	return env, true
+}
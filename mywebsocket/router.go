@@ -0,0 +1,233 @@
+package mywebsocket
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/chtan/miniworld/broker"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Sessions of one device and its users may live on different nodes. Each
+// node subscribes to the subjects of the sockets it holds, and anything that
+// can't be delivered locally is handed to the broker:
+//
+//	miniworld.<kind>.<deviceId>.send        frame for the device socket
+//	miniworld.<kind>.<deviceId>.user        frame for the controlling user
+//	miniworld.<kind>.<deviceId>.alive       request answered by the device's node
+//	miniworld.<kind>.<deviceId>.disconnect  close the device socket
+//	miniworld.camera.<deviceId>.frames      camera frames for remote viewers
+//	miniworld.camera.<deviceId>.interest    heartbeat from nodes with viewers
+//	miniworld.events                        presence events
+//
+// kind is "control" or "camera".
+
+const (
+	requestTimeout   = 2 * time.Second
+	interestInterval = 5 * time.Second
+	interestTTL      = 3 * interestInterval
+
+	eventsSubject = "miniworld.events"
+)
+
+var (
+	routerMu sync.RWMutex
+	bus      broker.Broker
+	nodeID   = defaultNodeID()
+)
+
+func defaultNodeID() string {
+	host, _ := os.Hostname()
+	return host + "-" + primitive.NewObjectID().Hex()[16:]
+}
+
+// UseBroker routes messages for sockets held by other nodes through b.
+// node identifies this process and must be unique among the nodes.
+func UseBroker(b broker.Broker, node string) error {
+	if node != "" {
+		routerMu.Lock()
+		nodeID = node
+		routerMu.Unlock()
+	}
+	if _, err := b.Subscribe(eventsSubject, func(msg *broker.Msg) {
+		var ev Event
+		if err := json.Unmarshal(msg.Data, &ev); err != nil || ev.Node == NodeID() {
+			return
+		}
+		Events.publishLocal(ev)
+	}); err != nil {
+		return err
+	}
+
+	routerMu.Lock()
+	bus = b
+	routerMu.Unlock()
+	return nil
+}
+
+// NodeID identifies this process among the nodes sharing the broker.
+func NodeID() string {
+	routerMu.RLock()
+	defer routerMu.RUnlock()
+	return nodeID
+}
+
+func currentBroker() broker.Broker {
+	routerMu.RLock()
+	defer routerMu.RUnlock()
+	return bus
+}
+
+func subject(kind, deviceID, op string) string {
+	return "miniworld." + kind + "." + deviceID + "." + op
+}
+
+func (sm *SessionManager) kind() string {
+	if sm.camera {
+		return "camera"
+	}
+	return "control"
+}
+
+// A routed websocket frame is its message type followed by the payload.
+func encodeFrame(messageType int, data []byte) []byte {
+	out := make([]byte, 1+len(data))
+	out[0] = byte(messageType)
+	copy(out[1:], data)
+	return out
+}
+
+func decodeFrame(b []byte) (int, []byte, bool) {
+	if len(b) == 0 {
+		return 0, nil, false
+	}
+	return int(b[0]), b[1:], true
+}
+
+// Payloads that must not loop back to their sender carry the origin node.
+func encodeOrigin(data []byte) []byte {
+	node := NodeID()
+	out := make([]byte, 1+len(node)+len(data))
+	out[0] = byte(len(node))
+	copy(out[1:], node)
+	copy(out[1+len(node):], data)
+	return out
+}
+
+func decodeOrigin(b []byte) (string, []byte, bool) {
+	if len(b) == 0 || len(b) < 1+int(b[0]) {
+		return "", nil, false
+	}
+	n := int(b[0])
+	return string(b[1 : 1+n]), b[1+n:], true
+}
+
+var (
+	replyOK   = []byte{1}
+	replyFail = []byte{0}
+)
+
+type disconnectRequest struct {
+	Origin string `json:"origin"`
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// subscribeDevice makes the device socket reachable from other nodes.
+func (sm *SessionManager) subscribeDevice(deviceID string, c *Conn) []broker.Subscription {
+	b := currentBroker()
+	if b == nil {
+		return nil
+	}
+	kind := sm.kind()
+	var subs []broker.Subscription
+	add := func(op string, h broker.Handler) {
+		sub, err := b.Subscribe(subject(kind, deviceID, op), h)
+		if err != nil {
+			log.Printf("Failed to subscribe %s for %s: %v", op, deviceID, err)
+			return
+		}
+		subs = append(subs, sub)
+	}
+
+	add("send", func(msg *broker.Msg) {
+		messageType, data, ok := decodeFrame(msg.Data)
+		if ok && c.WriteMessage(messageType, data) == nil {
+			msg.Respond(replyOK)
+			return
+		}
+		msg.Respond(replyFail)
+	})
+	add("alive", func(msg *broker.Msg) {
+		msg.Respond(replyOK)
+	})
+	add("disconnect", func(msg *broker.Msg) {
+		var req disconnectRequest
+		if json.Unmarshal(msg.Data, &req) != nil || req.Origin == NodeID() {
+			return
+		}
+		closeConn(c, req.Code, req.Reason)
+	})
+	if sm.camera {
+		add("interest", func(msg *broker.Msg) {
+			if origin, _, ok := decodeOrigin(msg.Data); ok && origin != NodeID() {
+				Frames.noteInterest(deviceID)
+			}
+		})
+	}
+	return subs
+}
+
+// subscribeUser makes the controlling user reachable from the device's node.
+// A user who lost control of the device stops answering.
+func (sm *SessionManager) subscribeUser(userID, deviceID string, c *Conn) []broker.Subscription {
+	b := currentBroker()
+	if b == nil || sm.camera {
+		return nil
+	}
+	sub, err := b.Subscribe(subject(sm.kind(), deviceID, "user"), func(msg *broker.Msg) {
+		sm.mu.RLock()
+		controlling := sm.userByDevice[deviceID] == userID
+		sm.mu.RUnlock()
+		if !controlling {
+			return
+		}
+		messageType, data, ok := decodeFrame(msg.Data)
+		if ok && c.WriteMessage(messageType, data) == nil {
+			msg.Respond(replyOK)
+			return
+		}
+		msg.Respond(replyFail)
+	})
+	if err != nil {
+		log.Printf("Failed to subscribe user for %s: %v", deviceID, err)
+		return nil
+	}
+	return []broker.Subscription{sub}
+}
+
+func unsubscribeAll(subs []broker.Subscription) {
+	for _, sub := range subs {
+		_ = sub.Unsubscribe()
+	}
+}
+
+// request delivers a frame to whichever node answers on the subject.
+func request(subj string, messageType int, data []byte) bool {
+	b := currentBroker()
+	if b == nil {
+		return false
+	}
+	reply, err := b.Request(subj, encodeFrame(messageType, data), requestTimeout)
+	return err == nil && len(reply) == 1 && reply[0] == 1
+}
+
+// publish hands a frame to the broker without waiting for delivery.
+func publish(subj string, messageType int, data []byte) {
+	if b := currentBroker(); b != nil {
+		_ = b.Publish(subj, encodeFrame(messageType, data))
+	}
+}
@@ -1,16 +1,27 @@
 package mywebsocket
 
 import (
+	"encoding/json"
 	"sync"
+	"time"
 
+	"github.com/chtan/miniworld/broker"
 	"github.com/gorilla/websocket"
 )
 
+// CloseCredentialsRevoked is sent to a device whose credentials were rotated or revoked.
+const CloseCredentialsRevoked = 4001
+
+var (
+	managersMu sync.Mutex
+	managers   []*SessionManager
+)
+
 // Session represents a single user WebSocket session that is controlling a device.
 type Session struct {
 	UserID   string
 	DeviceID string
-	Conn     *websocket.Conn
+	Conn     *Conn
 }
 
 // SessionManager manages all active device + user sessions in memory.
@@ -18,72 +29,260 @@ type SessionManager struct {
 	mu sync.RWMutex
 
 	// deviceId -> device websocket connection
-	devices map[string]*websocket.Conn
+	devices map[string]*Conn
 
 	// userId -> user session
 	users map[string]*Session
 
 	// deviceId -> userId (who controls this device)
 	userByDevice map[string]string
+
+	// "device:<id>" or "user:<id>" -> broker subscriptions for that socket
+	routes map[string][]broker.Subscription
+
+	// camera managers report viewer counts instead of presence and leases
+	camera bool
+	events *EventHub
 }
 
 func NewSessionManager() *SessionManager {
-	return &SessionManager{
-		devices:      make(map[string]*websocket.Conn),
+	sm := &SessionManager{
+		devices:      make(map[string]*Conn),
 		users:        make(map[string]*Session),
 		userByDevice: make(map[string]string),
+		routes:       make(map[string][]broker.Subscription),
+		events:       Events,
 	}
+
+	managersMu.Lock()
+	managers = append(managers, sm)
+	managersMu.Unlock()
+	return sm
+}
+
+// NewCamSessionManager returns a manager for camera streams.
+// It publishes viewer count changes rather than device presence.
+func NewCamSessionManager() *SessionManager {
+	sm := NewSessionManager()
+	sm.camera = true
+	return sm
 }
 
 // ========== Devices ==========
 
-func (sm *SessionManager) AddDevice(deviceID string, conn *websocket.Conn) {
+// AddDevice registers the device socket and returns the wrapper that all
+// writes to it must go through.
+func (sm *SessionManager) AddDevice(deviceID string, conn *websocket.Conn) *Conn {
+	c := NewConn(conn)
+	subs := sm.subscribeDevice(deviceID, c)
+
 	sm.mu.Lock()
-	defer sm.mu.Unlock()
-	sm.devices[deviceID] = conn
+	sm.devices[deviceID] = c
+	previous := sm.routes["device:"+deviceID]
+	sm.routes["device:"+deviceID] = subs
+	sm.mu.Unlock()
+	unsubscribeAll(previous)
+
+	if !sm.camera {
+		sm.events.Publish(Event{Type: EventDeviceOnline, DeviceID: deviceID})
+	}
+	return c
 }
 
-func (sm *SessionManager) RemoveDevice(deviceID string) {
+// RemoveDevice unregisters the device socket. It does nothing if the device
+// has since reconnected with a different socket.
+func (sm *SessionManager) RemoveDevice(deviceID string, c *Conn) {
 	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	if sm.devices[deviceID] != c {
+		sm.mu.Unlock()
+		return
+	}
 	delete(sm.devices, deviceID)
 	delete(sm.userByDevice, deviceID)
 	// NOTE: we do NOT delete userByDevice here,
 	// because user might reconnect their device later.
 	// If you want strict cleanup, you can also delete(sm.userByDevice, deviceID).
+	subs := sm.routes["device:"+deviceID]
+	delete(sm.routes, "device:"+deviceID)
+	sm.mu.Unlock()
+	unsubscribeAll(subs)
+
+	if !sm.camera {
+		sm.events.Publish(Event{Type: EventDeviceOffline, DeviceID: deviceID})
+	}
 }
 
-func (sm *SessionManager) GetDeviceConn(deviceID string) *websocket.Conn {
+func (sm *SessionManager) GetDeviceConn(deviceID string) *Conn {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 	return sm.devices[deviceID]
 }
 
+func closeConn(conn *Conn, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	_ = conn.Close()
+}
+
+// SendToDevice writes a frame to the device's socket, on whichever node it
+// is connected. Frames for a device on another node are not acknowledged.
+func (sm *SessionManager) SendToDevice(deviceID string, messageType int, data []byte) error {
+	if conn := sm.GetDeviceConn(deviceID); conn != nil {
+		return conn.WriteMessage(messageType, data)
+	}
+	publish(subject(sm.kind(), deviceID, "send"), messageType, data)
+	return nil
+}
+
+// SendToUser writes a frame to the user controlling the device, on whichever
+// node they are connected.
+func (sm *SessionManager) SendToUser(deviceID string, messageType int, data []byte) error {
+	if s := sm.GetUserByDevice(deviceID); s != nil {
+		return s.Conn.WriteMessage(messageType, data)
+	}
+	publish(subject(sm.kind(), deviceID, "user"), messageType, data)
+	return nil
+}
+
+func controlManagers() []*SessionManager {
+	managersMu.Lock()
+	defer managersMu.Unlock()
+	out := make([]*SessionManager, 0, len(managers))
+	for _, sm := range managers {
+		if !sm.camera {
+			out = append(out, sm)
+		}
+	}
+	return out
+}
+
+// DisconnectDevice closes the device's sockets on every node. The handlers'
+// read loops then run their normal cleanup.
+func DisconnectDevice(deviceID string, code int, reason string) {
+	managersMu.Lock()
+	all := append([]*SessionManager(nil), managers...)
+	managersMu.Unlock()
+
+	for _, sm := range all {
+		if conn := sm.GetDeviceConn(deviceID); conn != nil {
+			closeConn(conn, code, reason)
+		}
+	}
+
+	if b := currentBroker(); b != nil {
+		data, _ := json.Marshal(disconnectRequest{Origin: NodeID(), Code: code, Reason: reason})
+		for _, kind := range []string{"control", "camera"} {
+			_ = b.Publish(subject(kind, deviceID, "disconnect"), data)
+		}
+	}
+}
+
+// SendDeviceJSON writes a JSON message to the device's control socket,
+// on whichever node it is connected. It reports false when the device is
+// not connected or the write fails.
+func SendDeviceJSON(deviceID string, v interface{}) bool {
+	for _, sm := range controlManagers() {
+		if conn := sm.GetDeviceConn(deviceID); conn != nil {
+			return conn.WriteJSON(v) == nil
+		}
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return false
+	}
+	return request(subject("control", deviceID, "send"), websocket.TextMessage, data)
+}
+
+// SendUserJSON writes a JSON message to the user driving the device over
+// the control socket. It reports false when nobody is driving it.
+func SendUserJSON(deviceID string, v interface{}) bool {
+	for _, sm := range controlManagers() {
+		if s := sm.GetUserByDevice(deviceID); s != nil {
+			return s.Conn.WriteJSON(v) == nil
+		}
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return false
+	}
+	return request(subject("control", deviceID, "user"), websocket.TextMessage, data)
+}
+
+// LocalDevices returns the devices whose control socket is open on this node.
+func LocalDevices() []string {
+	var ids []string
+	for _, sm := range controlManagers() {
+		ids = append(ids, sm.OnlineDevices()...)
+	}
+	return ids
+}
+
+// DeviceConnected reports whether the device's control socket is open on any node.
+func DeviceConnected(deviceID string) bool {
+	for _, sm := range controlManagers() {
+		if sm.GetDeviceConn(deviceID) != nil {
+			return true
+		}
+	}
+	return request(subject("control", deviceID, "alive"), websocket.TextMessage, nil)
+}
+
 // ========== Users ==========
 
-func (sm *SessionManager) AddUser(userID, deviceID string, conn *websocket.Conn) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+// AddUser registers the user socket and returns the wrapper that all
+// writes to it must go through.
+func (sm *SessionManager) AddUser(userID, deviceID string, conn *websocket.Conn) *Conn {
+	c := NewConn(conn)
+	subs := sm.subscribeUser(userID, deviceID, c)
 
+	sm.mu.Lock()
+	previous := sm.routes["user:"+userID]
+	sm.routes["user:"+userID] = subs
 	sm.users[userID] = &Session{
 		UserID:   userID,
 		DeviceID: deviceID,
-		Conn:     conn,
+		Conn:     c,
 	}
 
 	// 1 device -> 1 controlling user
 	sm.userByDevice[deviceID] = userID
+	viewers := sm.viewerCountLocked(deviceID)
+	sm.mu.Unlock()
+	unsubscribeAll(previous)
+
+	if sm.camera {
+		sm.events.Publish(Event{Type: EventViewerCount, DeviceID: deviceID, Viewers: viewers})
+	} else {
+		sm.events.Publish(Event{Type: EventLeaseAcquired, DeviceID: deviceID, UserID: userID})
+	}
+	return c
 }
 
-func (sm *SessionManager) RemoveUser(userID string) {
+// RemoveUser drops the user's session if c is still its connection. A
+// newer connection of the same user has replaced it otherwise, and is kept.
+func (sm *SessionManager) RemoveUser(userID string, c *Conn) {
 	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	if s, ok := sm.users[userID]; ok {
-		// Remove mapping device -> user
+	s, ok := sm.users[userID]
+	if !ok || s.Conn != c {
+		sm.mu.Unlock()
+		return
+	}
+	// Remove mapping device -> user, unless another user has the car now
+	if sm.userByDevice[s.DeviceID] == userID {
 		delete(sm.userByDevice, s.DeviceID)
 	}
 	delete(sm.users, userID)
+	viewers := sm.viewerCountLocked(s.DeviceID)
+	subs := sm.routes["user:"+userID]
+	delete(sm.routes, "user:"+userID)
+	sm.mu.Unlock()
+	unsubscribeAll(subs)
+
+	if sm.camera {
+		sm.events.Publish(Event{Type: EventViewerCount, DeviceID: s.DeviceID, Viewers: viewers})
+	} else {
+		sm.events.Publish(Event{Type: EventLeaseReleased, DeviceID: s.DeviceID, UserID: userID})
+	}
 }
 
 func (sm *SessionManager) GetUser(userID string) *Session {
@@ -106,3 +305,34 @@ func (sm *SessionManager) GetUserByDevice(deviceID string) *Session {
 	}
 	return sm.users[userID]
 }
+
+// ========== Presence snapshot ==========
+
+// OnlineDevices returns the IDs of every connected device.
+func (sm *SessionManager) OnlineDevices() []string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	ids := make([]string, 0, len(sm.devices))
+	for id := range sm.devices {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// ViewerCount returns how many user sessions are attached to the device.
+func (sm *SessionManager) ViewerCount(deviceID string) int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.viewerCountLocked(deviceID)
+}
+
+func (sm *SessionManager) viewerCountLocked(deviceID string) int {
+	n := 0
+	for _, s := range sm.users {
+		if s.DeviceID == deviceID {
+			n++
+		}
+	}
+	return n
+}
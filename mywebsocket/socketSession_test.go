@@ -0,0 +1,35 @@
+package mywebsocket
+
+import "testing"
+
+func TestRemoveUserKeepsTakeover(t *testing.T) {
+	sm := NewSessionManager()
+	const userID, deviceID = "user", "car"
+
+	old := sm.AddUser(userID, deviceID, nil)
+	current := sm.AddUser(userID, deviceID, nil)
+
+	// the old handler's cleanup runs after the same user reconnected
+	sm.RemoveUser(userID, old)
+	if s := sm.GetUserByDevice(deviceID); s == nil || s.Conn != current {
+		t.Fatalf("takeover session removed by the old connection: %+v", s)
+	}
+
+	sm.RemoveUser(userID, current)
+	if s := sm.GetUserByDevice(deviceID); s != nil {
+		t.Errorf("session kept after its own connection left: %+v", s)
+	}
+}
+
+func TestRemoveUserKeepsOtherDriver(t *testing.T) {
+	sm := NewSessionManager()
+	const deviceID = "car"
+
+	first := sm.AddUser("first", deviceID, nil)
+	sm.AddUser("second", deviceID, nil)
+
+	sm.RemoveUser("first", first)
+	if s := sm.GetUserByDevice(deviceID); s == nil || s.UserID != "second" {
+		t.Errorf("car controlled by %+v, want the second driver", s)
+	}
+}
@@ -0,0 +1,294 @@
+package pki
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/chtan/miniworld/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	caDocumentID     = "device_ca"
+	caValidity       = 10 * 365 * 24 * time.Hour
+	DeviceCertExpiry = 365 * 24 * time.Hour
+	crlValidity      = 24 * time.Hour
+)
+
+// CA is the built-in certificate authority that signs device client certificates.
+type CA struct {
+	Cert    *x509.Certificate
+	Key     *ecdsa.PrivateKey
+	CertPEM []byte
+}
+
+// caDocument is how the CA is persisted so every replica shares it. The
+// private key is sealed with DEVICE_CA_KEY, so reading the database is
+// not enough to mint device certificates.
+type caDocument struct {
+	ID      string `bson:"_id"`
+	CertPEM string `bson:"cert_pem"`
+	// EncryptedKey is an AES-GCM nonce followed by the sealed EC key DER
+	EncryptedKey []byte `bson:"encrypted_key,omitempty"`
+	// KeyPEM is the plaintext key written by older servers; it is
+	// encrypted and removed the next time the CA loads
+	KeyPEM    string    `bson:"key_pem,omitempty"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// ErrNoCAKey is returned when DEVICE_CA_KEY isn't configured.
+var ErrNoCAKey = errors.New("DEVICE_CA_KEY is not set")
+
+var (
+	caMu     sync.Mutex
+	deviceCA *CA
+)
+
+// DeviceCA returns the device CA, loading it from MongoDB or creating it on first use.
+func DeviceCA(app *config.AppConfig) (*CA, error) {
+	caMu.Lock()
+	defer caMu.Unlock()
+	if deviceCA != nil {
+		return deviceCA, nil
+	}
+
+	key, err := app.Settings.Server.CAKey()
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, ErrNoCAKey
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	coll := app.Client.Database("miniworld").Collection("pki")
+
+	var doc caDocument
+	err = coll.FindOne(ctx, bson.M{"_id": caDocumentID}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		doc, err = newCADocument(aead)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = coll.InsertOne(ctx, doc); mongo.IsDuplicateKeyError(err) {
+			// another replica won the race; use its CA
+			err = coll.FindOne(ctx, bson.M{"_id": caDocumentID}).Decode(&doc)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load device CA: %v", err)
+	}
+
+	if doc.EncryptedKey == nil {
+		if err := sealLegacyKey(ctx, coll, aead, &doc); err != nil {
+			return nil, fmt.Errorf("failed to encrypt device CA key: %v", err)
+		}
+	}
+
+	ca, err := parseCA(doc, aead)
+	if err != nil {
+		return nil, err
+	}
+	deviceCA = ca
+	return deviceCA, nil
+}
+
+// sealLegacyKey replaces a plaintext CA key with its encrypted form.
+func sealLegacyKey(ctx context.Context, coll *mongo.Collection, aead cipher.AEAD, doc *caDocument) error {
+	block, _ := pem.Decode([]byte(doc.KeyPEM))
+	if block == nil {
+		return errors.New("device CA has no key")
+	}
+	sealed, err := seal(aead, block.Bytes)
+	if err != nil {
+		return err
+	}
+	_, err = coll.UpdateOne(ctx, bson.M{"_id": doc.ID}, bson.M{
+		"$set":   bson.M{"encrypted_key": sealed},
+		"$unset": bson.M{"key_pem": ""},
+	})
+	if err != nil {
+		return err
+	}
+	log.Println("Encrypted the stored device CA key")
+	doc.EncryptedKey, doc.KeyPEM = sealed, ""
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext bound to the CA document, prefixed with its nonce.
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(caDocumentID)), nil
+}
+
+func unseal(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("device CA key is truncated")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(caDocumentID))
+	if err != nil {
+		return nil, errors.New("device CA key does not decrypt; is DEVICE_CA_KEY right?")
+	}
+	return plaintext, nil
+}
+
+func newCADocument(aead cipher.AEAD) (caDocument, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return caDocument{}, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return caDocument{}, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "miniworld device CA", Organization: []string{"miniworld"}},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return caDocument{}, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return caDocument{}, err
+	}
+	sealed, err := seal(aead, keyDER)
+	if err != nil {
+		return caDocument{}, err
+	}
+
+	return caDocument{
+		ID:           caDocumentID,
+		CertPEM:      string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		EncryptedKey: sealed,
+		CreatedAt:    time.Now(),
+	}, nil
+}
+
+func parseCA(doc caDocument, aead cipher.AEAD) (*CA, error) {
+	certBlock, _ := pem.Decode([]byte(doc.CertPEM))
+	if certBlock == nil {
+		return nil, errors.New("device CA is not valid PEM")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := unseal(aead, doc.EncryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyDER)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Cert: cert, Key: key, CertPEM: []byte(doc.CertPEM)}, nil
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// Pool returns a cert pool containing only this CA, for tls.Config.ClientCAs.
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	return pool
+}
+
+// IssueDeviceCert signs a new client certificate whose CommonName is the device ID.
+func (ca *CA) IssueDeviceCert(deviceID string) (*x509.Certificate, []byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: deviceID, Organization: []string{"miniworld"}, OrganizationalUnit: []string{"device"}},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(DeviceCertExpiry),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, &key.PublicKey, ca.Key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return cert, certPEM, keyPEM, nil
+}
+
+// RevocationList signs a PEM CRL listing the given serials.
+func (ca *CA) RevocationList(revoked []x509.RevocationListEntry) ([]byte, error) {
+	number := big.NewInt(time.Now().Unix())
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    number,
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(crlValidity),
+		RevokedCertificateEntries: revoked,
+	}, ca.Cert, ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), nil
+}
+
+// SerialHex is the form serials are stored and looked up in.
+func SerialHex(serial *big.Int) string {
+	return fmt.Sprintf("%x", serial)
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket: it holds up to Burst tokens and refills at Rate
+// tokens per second. A zero Rate means unlimited.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket.
+func NewBucket(rate, burst float64) *Bucket {
+	if burst < rate {
+		burst = rate
+	}
+	return &Bucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Unlimited reports whether the bucket lets everything through.
+func (b *Bucket) Unlimited() bool { return b == nil || b.rate <= 0 }
+
+// Burst is the most tokens a single call can take.
+func (b *Bucket) Burst() float64 { return b.burst }
+
+// Allow takes n tokens if they are available.
+func (b *Bucket) Allow(n float64) bool {
+	ok, _ := b.Reserve(n)
+	return ok
+}
+
+// Reserve takes n tokens if they are available. Otherwise it takes nothing
+// and reports how long until n tokens will be.
+func (b *Bucket) Reserve(n float64) (bool, time.Duration) {
+	if b.Unlimited() {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens >= n {
+		b.tokens -= n
+		return true, 0
+	}
+	wait := time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+	return false, wait
+}
+
+// Refund returns n tokens taken by a call whose work was not done after all.
+func (b *Bucket) Refund(n float64) {
+	if b.Unlimited() {
+		return
+	}
+	b.mu.Lock()
+	b.tokens += n
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.mu.Unlock()
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// age pretends d passed since the bucket was last refilled.
+func age(b *Bucket, d time.Duration) {
+	b.mu.Lock()
+	b.last = b.last.Add(-d)
+	b.mu.Unlock()
+}
+
+func TestBurst(t *testing.T) {
+	b := NewBucket(10, 20)
+	for i := 0; i < 20; i++ {
+		if !b.Allow(1) {
+			t.Fatalf("call %d refused within the burst", i)
+		}
+	}
+	ok, wait := b.Reserve(1)
+	if ok {
+		t.Fatal("call allowed past the burst")
+	}
+	if wait <= 0 || wait > 100*time.Millisecond {
+		t.Errorf("wait = %v, want about 100ms for one token at 10/s", wait)
+	}
+}
+
+func TestBurstIsAtLeastRate(t *testing.T) {
+	b := NewBucket(5, 1)
+	if b.Burst() != 5 {
+		t.Errorf("Burst = %v, want the rate", b.Burst())
+	}
+}
+
+func TestRefill(t *testing.T) {
+	b := NewBucket(10, 20)
+	if !b.Allow(20) {
+		t.Fatal("full bucket refused its burst")
+	}
+	if b.Allow(1) {
+		t.Fatal("empty bucket allowed a call")
+	}
+
+	age(b, 500*time.Millisecond)
+	if !b.Allow(5) {
+		t.Error("half a second at 10/s didn't refill 5 tokens")
+	}
+	if b.Allow(1) {
+		t.Error("refilled more than elapsed time allows")
+	}
+
+	// refilling stops at the burst
+	age(b, time.Hour)
+	if !b.Allow(20) {
+		t.Error("long idle bucket refused its burst")
+	}
+	if b.Allow(1) {
+		t.Error("idle bucket refilled past its burst")
+	}
+}
+
+func TestReserveTakesNothingWhenRefused(t *testing.T) {
+	b := NewBucket(1, 3)
+	if ok, _ := b.Reserve(4); ok {
+		t.Fatal("took more than the burst")
+	}
+	if !b.Allow(3) {
+		t.Error("refused call took tokens")
+	}
+}
+
+func TestRefund(t *testing.T) {
+	b := NewBucket(1, 3)
+	b.Allow(3)
+	b.Refund(2)
+	if !b.Allow(2) {
+		t.Error("refunded tokens not available")
+	}
+	b.Refund(10)
+	if b.Allow(4) {
+		t.Error("refund filled past the burst")
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	var nilBucket *Bucket
+	for _, b := range []*Bucket{NewBucket(0, 0), nilBucket} {
+		if !b.Unlimited() {
+			t.Fatal("zero rate bucket is limited")
+		}
+		for i := 0; i < 1000; i++ {
+			if !b.Allow(1e6) {
+				t.Fatal("unlimited bucket refused a call")
+			}
+		}
+		b.Refund(1)
+	}
+}
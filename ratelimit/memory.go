@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps limits in this process only.
+type MemoryStore struct {
+	mu       sync.Mutex
+	buckets  map[string]*memoryBucket
+	failures map[string]*memoryFailures
+	sweptAt  time.Time
+}
+
+type memoryBucket struct {
+	bucket  *Bucket
+	expires time.Time
+}
+
+type memoryFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+	expires     time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:  make(map[string]*memoryBucket),
+		failures: make(map[string]*memoryFailures),
+		sweptAt:  time.Now(),
+	}
+}
+
+// sweepLocked drops idle entries, at most once a minute.
+func (s *MemoryStore) sweepLocked(now time.Time) {
+	if now.Sub(s.sweptAt) < time.Minute {
+		return
+	}
+	s.sweptAt = now
+	for key, b := range s.buckets {
+		if now.After(b.expires) {
+			delete(s.buckets, key)
+		}
+	}
+	for key, f := range s.failures {
+		if now.After(f.expires) {
+			delete(s.failures, key)
+		}
+	}
+}
+
+func (s *MemoryStore) Take(_ context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	now := time.Now()
+	s.mu.Lock()
+	s.sweepLocked(now)
+	b := s.buckets[key]
+	if b == nil {
+		b = &memoryBucket{bucket: NewBucket(limit.Rate, limit.Burst)}
+		s.buckets[key] = b
+	}
+	b.expires = now.Add(bucketTTL(limit))
+	s.mu.Unlock()
+
+	ok, wait := b.bucket.Reserve(1)
+	return ok, wait, nil
+}
+
+func (s *MemoryStore) Fail(_ context.Context, key string, policy Lockout) (time.Duration, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweepLocked(now)
+
+	f := s.failures[key]
+	if f == nil {
+		f = &memoryFailures{}
+		s.failures[key] = f
+	} else if now.Sub(f.last) > policy.Window {
+		f.count = 0
+	}
+	f.count++
+	f.last = now
+
+	lock := policy.Duration(f.count)
+	if until := now.Add(lock); lock > 0 && until.After(f.lockedUntil) {
+		f.lockedUntil = until
+	}
+	f.expires = now.Add(policy.Window + policy.Max)
+	return lock, nil
+}
+
+func (s *MemoryStore) Succeed(_ context.Context, key string) error {
+	s.mu.Lock()
+	delete(s.failures, key)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) Locked(_ context.Context, key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.failures[key]
+	if f == nil {
+		return 0, nil
+	}
+	if left := time.Until(f.lockedUntil); left > 0 {
+		return left, nil
+	}
+	return 0, nil
+}
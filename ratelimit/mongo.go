@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoStore keeps limits in a collection shared by every node. Each update
+// is a single atomic pipeline, so concurrent requests can't overspend a bucket.
+type MongoStore struct {
+	coll *mongo.Collection
+}
+
+// NewMongoStore uses coll, whose idle entries expire by the TTL index on
+// expires_at that the migrations create.
+func NewMongoStore(coll *mongo.Collection) *MongoStore {
+	return &MongoStore{coll: coll}
+}
+
+func (s *MongoStore) Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	if limit.Rate <= 0 {
+		return true, 0, nil
+	}
+	now := time.Now()
+	elapsed := bson.M{"$divide": bson.A{
+		bson.M{"$subtract": bson.A{now, bson.M{"$ifNull": bson.A{"$updated_at", now}}}},
+		1000,
+	}}
+	refilled := bson.M{"$min": bson.A{limit.Burst, bson.M{"$add": bson.A{
+		bson.M{"$ifNull": bson.A{"$tokens", limit.Burst}},
+		bson.M{"$multiply": bson.A{limit.Rate, elapsed}},
+	}}}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"tokens": refilled, "updated_at": now, "expires_at": now.Add(bucketTTL(limit))}}},
+		{{Key: "$set", Value: bson.M{"allowed": bson.M{"$gte": bson.A{"$tokens", 1}}}}},
+		{{Key: "$set", Value: bson.M{"tokens": bson.M{"$cond": bson.A{
+			"$allowed", bson.M{"$subtract": bson.A{"$tokens", 1}}, "$tokens",
+		}}}}},
+	}
+
+	var doc struct {
+		Tokens  float64 `bson:"tokens"`
+		Allowed bool    `bson:"allowed"`
+	}
+	err := s.coll.FindOneAndUpdate(ctx, bson.M{"_id": "bucket:" + key}, pipeline,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&doc)
+	if err != nil {
+		return false, 0, err
+	}
+	if doc.Allowed {
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - doc.Tokens) / limit.Rate * float64(time.Second)), nil
+}
+
+func (s *MongoStore) Fail(ctx context.Context, key string, policy Lockout) (time.Duration, error) {
+	now := time.Now()
+	id := "failures:" + key
+	stale := bson.M{"$gt": bson.A{
+		bson.M{"$subtract": bson.A{now, bson.M{"$ifNull": bson.A{"$last", time.Time{}}}}},
+		policy.Window.Milliseconds(),
+	}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"count": bson.M{"$cond": bson.A{
+				stale, 1, bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$count", 0}}, 1}},
+			}},
+			"last":       now,
+			"expires_at": now.Add(policy.Window + policy.Max),
+		}}},
+	}
+
+	var doc struct {
+		Count int `bson:"count"`
+	}
+	err := s.coll.FindOneAndUpdate(ctx, bson.M{"_id": id}, pipeline,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&doc)
+	if err != nil {
+		return 0, err
+	}
+
+	lock := policy.Duration(doc.Count)
+	if lock == 0 {
+		return 0, nil
+	}
+	until := now.Add(lock)
+	_, err = s.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+		"$or": []bson.M{
+			{"locked_until": bson.M{"$exists": false}},
+			{"locked_until": bson.M{"$lt": until}},
+		},
+	}, bson.M{"$set": bson.M{"locked_until": until}})
+	return lock, err
+}
+
+func (s *MongoStore) Succeed(ctx context.Context, key string) error {
+	_, err := s.coll.DeleteOne(ctx, bson.M{"_id": "failures:" + key})
+	return err
+}
+
+func (s *MongoStore) Locked(ctx context.Context, key string) (time.Duration, error) {
+	var doc struct {
+		LockedUntil time.Time `bson:"locked_until"`
+	}
+	err := s.coll.FindOne(ctx, bson.M{"_id": "failures:" + key}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if left := time.Until(doc.LockedUntil); left > 0 {
+		return left, nil
+	}
+	return 0, nil
+}
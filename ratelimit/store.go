@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Limit is a token bucket refilled at Rate tokens per second up to Burst.
+type Limit struct {
+	Rate  float64
+	Burst float64
+}
+
+// PerMinute allows n requests a minute, all of them at once if need be.
+func PerMinute(n int) Limit {
+	return Limit{Rate: float64(n) / 60, Burst: float64(n)}
+}
+
+// Lockout locks a key out after Threshold failures within Window. The lock
+// lasts Base and doubles with every further failure, up to Max.
+type Lockout struct {
+	Threshold int
+	Window    time.Duration
+	Base      time.Duration
+	Max       time.Duration
+}
+
+// Duration is how long a key with the given number of recent failures is
+// locked out.
+func (l Lockout) Duration(failures int) time.Duration {
+	if failures < l.Threshold {
+		return 0
+	}
+	d := l.Base
+	for i := l.Threshold; i < failures && d < l.Max; i++ {
+		d *= 2
+	}
+	if d > l.Max {
+		d = l.Max
+	}
+	return d
+}
+
+// Store keeps buckets and failure counts by key. A shared store lets every
+// node enforce the same limits.
+type Store interface {
+	// Take takes one token from key's bucket. When none is left it reports
+	// how long until one will be.
+	Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error)
+	// Fail records a failed attempt for key and returns the lockout it
+	// triggered, if any.
+	Fail(ctx context.Context, key string, policy Lockout) (time.Duration, error)
+	// Succeed clears key's failures.
+	Succeed(ctx context.Context, key string) error
+	// Locked returns how much longer key is locked out.
+	Locked(ctx context.Context, key string) (time.Duration, error)
+}
+
+// bucketTTL is how long an idle bucket or failure count is kept.
+func bucketTTL(limit Limit) time.Duration {
+	if limit.Rate <= 0 {
+		return time.Minute
+	}
+	return time.Duration(limit.Burst/limit.Rate*float64(time.Second)) + time.Minute
+}
@@ -0,0 +1,285 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// A recording file is
+//
+//	header | record* | index | footer
+//
+// Every record carries its offset from the start of the session, and the
+// index maps each IndexInterval of session time to the first record at or
+// after it, so a reader can seek without scanning. A file cut short by a crash
+// has no footer but its records can still be read in order.
+
+const (
+	headerSize       = 32
+	recordHeaderSize = 12
+	indexEntrySize   = 12
+	footerSize       = 32
+
+	IndexInterval = time.Second
+
+	// MaxPayload caps a single frame; bigger frames are dropped by the writer.
+	MaxPayload = 8 << 20
+)
+
+var (
+	headerMagic = [8]byte{'M', 'W', 'R', 'E', 'C', 0, 0, 1}
+	footerMagic = [8]byte{'M', 'W', 'R', 'I', 'D', 'X', 0, 1}
+
+	ErrBadHeader = errors.New("recording: not a recording file")
+	ErrNoIndex   = errors.New("recording: file has no index")
+)
+
+// Stream identifies which websocket channel a record was captured from.
+type Stream uint8
+
+const (
+	StreamControl Stream = 1
+	StreamCamera  Stream = 2
+)
+
+// Direction is which way the frame was travelling.
+type Direction uint8
+
+const (
+	FromDevice Direction = 0
+	FromUser   Direction = 1
+)
+
+// Record is one captured websocket frame.
+type Record struct {
+	Offset      time.Duration
+	Stream      Stream
+	Direction   Direction
+	MessageType int // websocket.TextMessage or websocket.BinaryMessage
+	Data        []byte
+}
+
+type indexEntry struct {
+	offsetMs uint32
+	pos      uint64
+}
+
+// Writer appends records to a recording. It is not safe for concurrent use.
+type Writer struct {
+	w       *bufio.Writer
+	start   time.Time
+	pos     uint64
+	count   uint32
+	lastMs  uint32
+	index   []indexEntry
+	nextIdx uint32
+}
+
+// NewWriter writes the header and returns a writer whose offsets are
+// measured from start.
+func NewWriter(w io.Writer, start time.Time, deviceID [12]byte) (*Writer, error) {
+	var hdr [headerSize]byte
+	copy(hdr[0:8], headerMagic[:])
+	binary.BigEndian.PutUint64(hdr[8:16], uint64(start.UnixMilli()))
+	copy(hdr[16:28], deviceID[:])
+
+	bw := bufio.NewWriterSize(w, 64<<10)
+	if _, err := bw.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &Writer{w: bw, start: start, pos: headerSize}, nil
+}
+
+// Write appends a record captured at the given time.
+func (rw *Writer) Write(at time.Time, stream Stream, dir Direction, messageType int, data []byte) error {
+	if len(data) > MaxPayload {
+		return fmt.Errorf("recording: frame of %d bytes exceeds limit", len(data))
+	}
+	ms := uint32(0)
+	if d := at.Sub(rw.start); d > 0 {
+		ms = uint32(d / time.Millisecond)
+	}
+	// frames from two sockets can race; keep offsets monotonic for seeking
+	if ms < rw.lastMs {
+		ms = rw.lastMs
+	}
+	rw.lastMs = ms
+
+	intervalMs := uint32(IndexInterval / time.Millisecond)
+	for ms >= rw.nextIdx {
+		rw.index = append(rw.index, indexEntry{offsetMs: rw.nextIdx, pos: rw.pos})
+		rw.nextIdx += intervalMs
+	}
+
+	var hdr [recordHeaderSize]byte
+	binary.BigEndian.PutUint32(hdr[0:4], ms)
+	hdr[4] = byte(stream)
+	hdr[5] = byte(dir)
+	hdr[6] = byte(messageType)
+	binary.BigEndian.PutUint32(hdr[8:12], uint32(len(data)))
+	if _, err := rw.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := rw.w.Write(data); err != nil {
+		return err
+	}
+	rw.pos += uint64(recordHeaderSize + len(data))
+	rw.count++
+	return nil
+}
+
+// Size is the number of bytes written so far.
+func (rw *Writer) Size() int64 { return int64(rw.pos) }
+
+// Count is the number of records written so far.
+func (rw *Writer) Count() int { return int(rw.count) }
+
+// Duration is the offset of the last record.
+func (rw *Writer) Duration() time.Duration {
+	return time.Duration(rw.lastMs) * time.Millisecond
+}
+
+// Close writes the index and footer. The underlying writer is not closed.
+func (rw *Writer) Close() error {
+	indexPos := rw.pos
+	var entry [indexEntrySize]byte
+	for _, e := range rw.index {
+		binary.BigEndian.PutUint32(entry[0:4], e.offsetMs)
+		binary.BigEndian.PutUint64(entry[4:12], e.pos)
+		if _, err := rw.w.Write(entry[:]); err != nil {
+			return err
+		}
+	}
+
+	var ftr [footerSize]byte
+	binary.BigEndian.PutUint64(ftr[0:8], indexPos)
+	binary.BigEndian.PutUint32(ftr[8:12], uint32(len(rw.index)))
+	binary.BigEndian.PutUint32(ftr[12:16], rw.count)
+	binary.BigEndian.PutUint32(ftr[16:20], rw.lastMs)
+	copy(ftr[24:32], footerMagic[:])
+	if _, err := rw.w.Write(ftr[:]); err != nil {
+		return err
+	}
+	return rw.w.Flush()
+}
+
+// Reader reads a recording from random-access storage.
+type Reader struct {
+	r        io.ReaderAt
+	size     int64
+	Start    time.Time
+	DeviceID [12]byte
+	Count    int
+	Duration time.Duration
+
+	end   int64 // first byte after the last record
+	index []indexEntry
+}
+
+// NewReader parses the header and, when present, the index and footer.
+// A truncated file is readable in order but Seek returns ErrNoIndex.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	var hdr [headerSize]byte
+	if size < headerSize {
+		return nil, ErrBadHeader
+	}
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return nil, err
+	}
+	if [8]byte(hdr[0:8]) != headerMagic {
+		return nil, ErrBadHeader
+	}
+	rr := &Reader{
+		r:     r,
+		size:  size,
+		Start: time.UnixMilli(int64(binary.BigEndian.Uint64(hdr[8:16]))),
+		end:   size,
+	}
+	copy(rr.DeviceID[:], hdr[16:28])
+
+	if size < headerSize+footerSize {
+		return rr, nil
+	}
+	var ftr [footerSize]byte
+	if _, err := r.ReadAt(ftr[:], size-footerSize); err != nil {
+		return nil, err
+	}
+	if [8]byte(ftr[24:32]) != footerMagic {
+		return rr, nil
+	}
+	indexPos := int64(binary.BigEndian.Uint64(ftr[0:8]))
+	n := int64(binary.BigEndian.Uint32(ftr[8:12]))
+	if indexPos < headerSize || indexPos+n*indexEntrySize != size-footerSize {
+		return nil, fmt.Errorf("recording: corrupt footer")
+	}
+	buf := make([]byte, n*indexEntrySize)
+	if _, err := r.ReadAt(buf, indexPos); err != nil {
+		return nil, err
+	}
+	rr.index = make([]indexEntry, n)
+	for i := range rr.index {
+		e := buf[i*indexEntrySize:]
+		rr.index[i] = indexEntry{
+			offsetMs: binary.BigEndian.Uint32(e[0:4]),
+			pos:      binary.BigEndian.Uint64(e[4:12]),
+		}
+	}
+	rr.end = indexPos
+	rr.Count = int(binary.BigEndian.Uint32(ftr[12:16]))
+	rr.Duration = time.Duration(binary.BigEndian.Uint32(ftr[16:20])) * time.Millisecond
+	return rr, nil
+}
+
+// Indexed reports whether the file was closed cleanly and supports Seek.
+func (rr *Reader) Indexed() bool { return rr.index != nil }
+
+// First is the position of the first record.
+func (rr *Reader) First() int64 { return headerSize }
+
+// Seek returns the position of the first record at or after offset.
+// The record found may be up to IndexInterval earlier than offset.
+func (rr *Reader) Seek(offset time.Duration) (int64, error) {
+	if rr.index == nil {
+		return 0, ErrNoIndex
+	}
+	if offset <= 0 || len(rr.index) == 0 {
+		return headerSize, nil
+	}
+	i := int(offset / IndexInterval)
+	if i >= len(rr.index) {
+		return rr.end, nil
+	}
+	return int64(rr.index[i].pos), nil
+}
+
+// ReadAt reads the record at pos and returns the position of the next one.
+// It returns io.EOF at the end of the records; a truncated final record
+// also reads as io.EOF.
+func (rr *Reader) ReadAt(pos int64) (Record, int64, error) {
+	if pos+recordHeaderSize > rr.end {
+		return Record{}, pos, io.EOF
+	}
+	var hdr [recordHeaderSize]byte
+	if _, err := rr.r.ReadAt(hdr[:], pos); err != nil {
+		return Record{}, pos, err
+	}
+	n := int64(binary.BigEndian.Uint32(hdr[8:12]))
+	if n > MaxPayload || pos+recordHeaderSize+n > rr.end {
+		return Record{}, pos, io.EOF
+	}
+	data := make([]byte, n)
+	if _, err := rr.r.ReadAt(data, pos+recordHeaderSize); err != nil {
+		return Record{}, pos, err
+	}
+	return Record{
+		Offset:      time.Duration(binary.BigEndian.Uint32(hdr[0:4])) * time.Millisecond,
+		Stream:      Stream(hdr[4]),
+		Direction:   Direction(hdr[5]),
+		MessageType: int(hdr[6]),
+		Data:        data,
+	}, pos + recordHeaderSize + n, nil
+}
@@ -0,0 +1,221 @@
+package recording
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+var testDevice = [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+
+// frame is what the tests write: an offset from the session start and a payload.
+type frame struct {
+	at   time.Duration
+	data string
+}
+
+func writeRecording(t *testing.T, start time.Time, frames []frame, close bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, start, testDevice)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	for i, f := range frames {
+		stream, dir := StreamControl, FromUser
+		if i%2 == 1 {
+			stream, dir = StreamCamera, FromDevice
+		}
+		if err := w.Write(start.Add(f.at), stream, dir, 1+i%2, []byte(f.data)); err != nil {
+			t.Fatalf("Write %d: %v", i, err)
+		}
+	}
+	if close {
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	} else if err := w.w.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func openRecording(t *testing.T, b []byte) *Reader {
+	t.Helper()
+	r, err := NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	return r
+}
+
+func readAll(t *testing.T, r *Reader, pos int64) []Record {
+	t.Helper()
+	var out []Record
+	for {
+		rec, next, err := r.ReadAt(pos)
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatalf("ReadAt %d: %v", pos, err)
+		}
+		out = append(out, rec)
+		pos = next
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	start := time.UnixMilli(1700000000000)
+	frames := []frame{
+		{0, "hello"},
+		{250 * time.Millisecond, ""},
+		{1500 * time.Millisecond, "camera"},
+		{4200 * time.Millisecond, "last"},
+	}
+	r := openRecording(t, writeRecording(t, start, frames, true))
+
+	if !r.Indexed() {
+		t.Fatal("closed recording has no index")
+	}
+	if !r.Start.Equal(start) {
+		t.Errorf("Start = %v, want %v", r.Start, start)
+	}
+	if r.DeviceID != testDevice {
+		t.Errorf("DeviceID = %v, want %v", r.DeviceID, testDevice)
+	}
+	if r.Count != len(frames) {
+		t.Errorf("Count = %d, want %d", r.Count, len(frames))
+	}
+	if r.Duration != 4200*time.Millisecond {
+		t.Errorf("Duration = %v, want 4.2s", r.Duration)
+	}
+
+	records := readAll(t, r, r.First())
+	if len(records) != len(frames) {
+		t.Fatalf("read %d records, want %d", len(records), len(frames))
+	}
+	for i, rec := range records {
+		if rec.Offset != frames[i].at {
+			t.Errorf("record %d offset = %v, want %v", i, rec.Offset, frames[i].at)
+		}
+		if string(rec.Data) != frames[i].data {
+			t.Errorf("record %d data = %q, want %q", i, rec.Data, frames[i].data)
+		}
+		wantStream, wantDir := StreamControl, FromUser
+		if i%2 == 1 {
+			wantStream, wantDir = StreamCamera, FromDevice
+		}
+		if rec.Stream != wantStream || rec.Direction != wantDir || rec.MessageType != 1+i%2 {
+			t.Errorf("record %d = %v/%v/%d, want %v/%v/%d", i, rec.Stream, rec.Direction, rec.MessageType, wantStream, wantDir, 1+i%2)
+		}
+	}
+}
+
+func TestSeek(t *testing.T) {
+	start := time.Now()
+	frames := []frame{
+		{100 * time.Millisecond, "a"},
+		{1100 * time.Millisecond, "b"},
+		{1900 * time.Millisecond, "c"},
+		// a gap: the index entries for 3s and 4s point at "d"
+		{5300 * time.Millisecond, "d"},
+		{6000 * time.Millisecond, "e"},
+	}
+	r := openRecording(t, writeRecording(t, start, frames, true))
+
+	tests := []struct {
+		offset time.Duration
+		want   string // first record read after seeking; "" for the end
+	}{
+		{0, "a"},
+		{-time.Second, "a"},
+		{500 * time.Millisecond, "a"},
+		{time.Second, "b"},
+		{1500 * time.Millisecond, "b"},
+		{2 * time.Second, "d"},
+		{4 * time.Second, "d"},
+		{5 * time.Second, "d"},
+		{6 * time.Second, "e"},
+		{time.Minute, ""},
+	}
+	for _, tt := range tests {
+		pos, err := r.Seek(tt.offset)
+		if err != nil {
+			t.Fatalf("Seek(%v): %v", tt.offset, err)
+		}
+		rec, _, err := r.ReadAt(pos)
+		if tt.want == "" {
+			if err != io.EOF {
+				t.Errorf("Seek(%v) read %q, want EOF", tt.offset, rec.Data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("ReadAt after Seek(%v): %v", tt.offset, err)
+		}
+		if string(rec.Data) != tt.want {
+			t.Errorf("Seek(%v) read %q, want %q", tt.offset, rec.Data, tt.want)
+		}
+	}
+}
+
+func TestOffsetsStayMonotonic(t *testing.T) {
+	start := time.Now()
+	frames := []frame{
+		{2 * time.Second, "late"},
+		{time.Second, "early socket"},
+		{-time.Second, "before start"},
+	}
+	r := openRecording(t, writeRecording(t, start, frames, true))
+	records := readAll(t, r, r.First())
+	for i, rec := range records {
+		if rec.Offset != 2*time.Second {
+			t.Errorf("record %d offset = %v, want 2s", i, rec.Offset)
+		}
+	}
+}
+
+func TestTruncatedRecording(t *testing.T) {
+	frames := []frame{{0, "one"}, {time.Second, "two"}, {2 * time.Second, "three"}}
+	b := writeRecording(t, time.Now(), frames, false)
+
+	// cut the final record short, as a crash mid-write would
+	r := openRecording(t, b[:len(b)-2])
+	if r.Indexed() {
+		t.Fatal("truncated recording claims an index")
+	}
+	if _, err := r.Seek(time.Second); !errors.Is(err, ErrNoIndex) {
+		t.Errorf("Seek err = %v, want ErrNoIndex", err)
+	}
+	records := readAll(t, r, r.First())
+	if len(records) != 2 || string(records[1].Data) != "two" {
+		t.Errorf("read %d records, want the 2 complete ones", len(records))
+	}
+}
+
+func TestBadHeader(t *testing.T) {
+	b := writeRecording(t, time.Now(), []frame{{0, "x"}}, true)
+	b[0] = 'X'
+	if _, err := NewReader(bytes.NewReader(b), int64(len(b))); !errors.Is(err, ErrBadHeader) {
+		t.Errorf("err = %v, want ErrBadHeader", err)
+	}
+	if _, err := NewReader(bytes.NewReader(b[:10]), 10); !errors.Is(err, ErrBadHeader) {
+		t.Errorf("short file err = %v, want ErrBadHeader", err)
+	}
+}
+
+func TestWriteRejectsOversizedFrame(t *testing.T) {
+	w, err := NewWriter(io.Discard, time.Now(), testDevice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(time.Now(), StreamCamera, FromDevice, 2, make([]byte, MaxPayload+1)); err == nil {
+		t.Error("oversized frame was written")
+	}
+	if w.Count() != 0 {
+		t.Errorf("Count = %d after rejected write", w.Count())
+	}
+}
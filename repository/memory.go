@@ -0,0 +1,474 @@
+package repository
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	auth_models "github.com/chtan/miniworld/models/auth"
+	clan_models "github.com/chtan/miniworld/models/clan"
+	device_models "github.com/chtan/miniworld/models/device"
+	firmware_models "github.com/chtan/miniworld/models/firmware"
+	ticket_models "github.com/chtan/miniworld/models/ticket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryDB holds every repository's records so that sessions see the same
+// users and devices as the other repositories.
+type memoryDB struct {
+	mu      sync.Mutex
+	users   map[primitive.ObjectID]auth_models.SetSignUpModel
+	devices map[primitive.ObjectID]device_models.Device
+	clans   map[primitive.ObjectID]clan_models.Clan
+	signups map[primitive.ObjectID]auth_models.GetSignUpModel
+	tickets map[string]ticket_models.Ticket
+}
+
+// NewMemory keeps everything in this process, for tests.
+func NewMemory() *Repositories {
+	db := &memoryDB{
+		users:   make(map[primitive.ObjectID]auth_models.SetSignUpModel),
+		devices: make(map[primitive.ObjectID]device_models.Device),
+		clans:   make(map[primitive.ObjectID]clan_models.Clan),
+		signups: make(map[primitive.ObjectID]auth_models.GetSignUpModel),
+		tickets: make(map[string]ticket_models.Ticket),
+	}
+	return &Repositories{
+		Users:       memoryUsers{db},
+		Devices:     memoryDevices{db},
+		Clans:       memoryClans{db},
+		Sessions:    memorySessions{db},
+		TempSignups: memoryTempSignups{db},
+		Tickets:     memoryTickets{db},
+	}
+}
+
+// ===================== USERS =====================
+
+type memoryUsers struct{ db *memoryDB }
+
+func (r memoryUsers) Create(ctx context.Context, user auth_models.SetSignUpModel) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	if _, ok := r.db.users[user.ID]; ok {
+		return ErrDuplicate
+	}
+	for _, u := range r.db.users {
+		if u.Email == user.Email {
+			return ErrDuplicate
+		}
+	}
+	r.db.users[user.ID] = user
+	return nil
+}
+
+func (r memoryUsers) Get(ctx context.Context, id primitive.ObjectID) (auth_models.SetSignUpModel, error) {
+	return r.find(func(u auth_models.SetSignUpModel) bool { return u.ID == id })
+}
+
+func (r memoryUsers) ByEmail(ctx context.Context, email string) (auth_models.SetSignUpModel, error) {
+	return r.find(func(u auth_models.SetSignUpModel) bool { return u.Email == email })
+}
+
+func (r memoryUsers) ByAccessToken(ctx context.Context, token string) (auth_models.SetSignUpModel, error) {
+	return r.find(func(u auth_models.SetSignUpModel) bool { return token != "" && u.Access_Token == token })
+}
+
+func (r memoryUsers) EmailTaken(ctx context.Context, email string) (bool, error) {
+	_, err := r.ByEmail(ctx, email)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r memoryUsers) find(match func(auth_models.SetSignUpModel) bool) (auth_models.SetSignUpModel, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	for _, u := range r.db.users {
+		if match(u) {
+			return u, nil
+		}
+	}
+	return auth_models.SetSignUpModel{}, ErrNotFound
+}
+
+// ===================== DEVICES =====================
+
+type memoryDevices struct{ db *memoryDB }
+
+func (r memoryDevices) Create(ctx context.Context, device device_models.Device) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	if _, ok := r.db.devices[device.ID]; ok {
+		return ErrDuplicate
+	}
+	r.db.devices[device.ID] = device
+	return nil
+}
+
+func (r memoryDevices) Get(ctx context.Context, id primitive.ObjectID) (device_models.Device, error) {
+	return r.find(func(d device_models.Device) bool { return d.ID == id })
+}
+
+func (r memoryDevices) GetOwned(ctx context.Context, id, adminID primitive.ObjectID) (device_models.Device, error) {
+	return r.find(func(d device_models.Device) bool { return d.ID == id && d.AdminID == adminID })
+}
+
+func (r memoryDevices) ByAccessToken(ctx context.Context, token string) (device_models.Device, error) {
+	return r.find(func(d device_models.Device) bool { return token != "" && d.Access_Token == token && !d.Revoked })
+}
+
+func (r memoryDevices) ByRefreshToken(ctx context.Context, token string) (device_models.Device, error) {
+	return r.find(func(d device_models.Device) bool { return token != "" && d.Refresh_Token == token && !d.Revoked })
+}
+
+func (r memoryDevices) ListByClans(ctx context.Context, clanIDs []primitive.ObjectID) ([]device_models.Device, error) {
+	return r.list(func(d device_models.Device) bool { return slices.Contains(clanIDs, d.ClanID) }), nil
+}
+
+func (r memoryDevices) ListInClan(ctx context.Context, clanID primitive.ObjectID, ids []primitive.ObjectID) ([]device_models.Device, error) {
+	return r.list(func(d device_models.Device) bool { return d.ClanID == clanID && slices.Contains(ids, d.ID) }), nil
+}
+
+func (r memoryDevices) CountInClan(ctx context.Context, clanID primitive.ObjectID, ids []primitive.ObjectID) (int, error) {
+	devices, err := r.ListInClan(ctx, clanID, ids)
+	return len(devices), err
+}
+
+func (r memoryDevices) SetPassword(ctx context.Context, id primitive.ObjectID, hash string) error {
+	return r.update(id, func(d *device_models.Device) {
+		d.Password = hash
+		d.Access_Token, d.Refresh_Token = "", ""
+		d.Revoked = false
+	})
+}
+
+func (r memoryDevices) SyncPresence(ctx context.Context, id primitive.ObjectID, online bool, generation int64) error {
+	err := r.update(id, func(d *device_models.Device) {
+		if d.PresenceGeneration < generation {
+			d.IsOnline = online
+			d.PresenceGeneration = generation
+		}
+	})
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (r memoryDevices) ListOnChannel(ctx context.Context, clanID primitive.ObjectID, channel string, ids []primitive.ObjectID) ([]device_models.Device, error) {
+	return r.list(func(d device_models.Device) bool {
+		following := d.FirmwareChannel
+		if following == "" {
+			following = firmware_models.ChannelStable
+		}
+		return d.ClanID == clanID && following == channel && !d.Revoked &&
+			(len(ids) == 0 || slices.Contains(ids, d.ID))
+	}), nil
+}
+
+func (r memoryDevices) SetFirmwareChannel(ctx context.Context, id primitive.ObjectID, channel string) error {
+	return r.update(id, func(d *device_models.Device) { d.FirmwareChannel = channel })
+}
+
+func (r memoryDevices) SetFirmware(ctx context.Context, id, firmwareID primitive.ObjectID, version string) error {
+	return r.update(id, func(d *device_models.Device) {
+		d.FirmwareID = firmwareID
+		d.FirmwareVersion = version
+	})
+}
+
+func (r memoryDevices) find(match func(device_models.Device) bool) (device_models.Device, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	for _, d := range r.db.devices {
+		if match(d) {
+			return d, nil
+		}
+	}
+	return device_models.Device{}, ErrNotFound
+}
+
+func (r memoryDevices) list(match func(device_models.Device) bool) []device_models.Device {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	devices := []device_models.Device{}
+	for _, d := range r.db.devices {
+		if match(d) {
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+func (r memoryDevices) update(id primitive.ObjectID, change func(*device_models.Device)) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	d, ok := r.db.devices[id]
+	if !ok {
+		return ErrNotFound
+	}
+	change(&d)
+	d.Updated_At = time.Now()
+	r.db.devices[id] = d
+	return nil
+}
+
+// ===================== CLANS =====================
+
+type memoryClans struct{ db *memoryDB }
+
+func (r memoryClans) Create(ctx context.Context, clan clan_models.Clan) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	if _, ok := r.db.clans[clan.ID]; ok {
+		return ErrDuplicate
+	}
+	if clan.ClanDetails != nil {
+		for _, c := range r.db.clans {
+			if c.ClanDetails == nil {
+				continue
+			}
+			if strings.EqualFold(c.ClanDetails.Name, clan.ClanDetails.Name) || c.ClanDetails.Tag == clan.ClanDetails.Tag {
+				return ErrDuplicate
+			}
+		}
+	}
+	r.db.clans[clan.ID] = clan
+	return nil
+}
+
+func (r memoryClans) GetOwned(ctx context.Context, id, adminID primitive.ObjectID) (clan_models.Clan, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	c, ok := r.db.clans[id]
+	if !ok || c.AdminID != adminID {
+		return clan_models.Clan{}, ErrNotFound
+	}
+	return c, nil
+}
+
+func (r memoryClans) ListByAdmin(ctx context.Context, adminID primitive.ObjectID) ([]clan_models.Clan, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	clans := []clan_models.Clan{}
+	for _, c := range r.db.clans {
+		if c.AdminID == adminID {
+			clans = append(clans, c)
+		}
+	}
+	return clans, nil
+}
+
+func (r memoryClans) ListForUser(ctx context.Context, userID primitive.ObjectID) ([]clan_models.Clan, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	clans := []clan_models.Clan{}
+	for _, c := range r.db.clans {
+		if c.AdminID == userID || slices.Contains(c.MemberIDs, userID) {
+			clans = append(clans, c)
+		}
+	}
+	return clans, nil
+}
+
+func (r memoryClans) AddMembers(ctx context.Context, id, adminID primitive.ObjectID, userIDs []primitive.ObjectID) error {
+	return r.update(id, adminID, func(c *clan_models.Clan) {
+		for _, u := range userIDs {
+			if !slices.Contains(c.MemberIDs, u) {
+				c.MemberIDs = append(c.MemberIDs, u)
+			}
+		}
+	})
+}
+
+func (r memoryClans) RemoveMembers(ctx context.Context, id, adminID primitive.ObjectID, userIDs []primitive.ObjectID) error {
+	return r.update(id, adminID, func(c *clan_models.Clan) {
+		c.MemberIDs = slices.DeleteFunc(c.MemberIDs, func(u primitive.ObjectID) bool {
+			return slices.Contains(userIDs, u)
+		})
+	})
+}
+
+func (r memoryClans) update(id, adminID primitive.ObjectID, fn func(*clan_models.Clan)) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	c, ok := r.db.clans[id]
+	if !ok || c.AdminID != adminID {
+		return ErrNotFound
+	}
+	fn(&c)
+	c.UpdatedAt = time.Now()
+	r.db.clans[id] = c
+	return nil
+}
+
+// ===================== SESSIONS =====================
+
+type memorySessions struct{ db *memoryDB }
+
+// session is the token state shared by users and devices.
+type session struct {
+	access, refresh *string
+	revoked         *bool
+}
+
+// each calls fn with the session of every record of the kind until fn
+// returns true, writing back the record it stopped at. The caller holds mu.
+func (r memorySessions) each(kind SessionKind, fn func(id primitive.ObjectID, s session) bool) bool {
+	switch kind {
+	case UserSessions:
+		for id, u := range r.db.users {
+			if fn(id, session{&u.Access_Token, &u.Refresh_Token, &u.Revoked}) {
+				u.Updated_At = time.Now()
+				r.db.users[id] = u
+				return true
+			}
+		}
+	case DeviceSessions:
+		for id, d := range r.db.devices {
+			if fn(id, session{&d.Access_Token, &d.Refresh_Token, &d.Revoked}) {
+				d.Updated_At = time.Now()
+				r.db.devices[id] = d
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r memorySessions) Issue(ctx context.Context, kind SessionKind, id primitive.ObjectID, pair auth_models.TokenPair) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	found := r.each(kind, func(sid primitive.ObjectID, s session) bool {
+		if sid != id {
+			return false
+		}
+		*s.access, *s.refresh, *s.revoked = pair.AccessToken, pair.RefreshToken, false
+		return true
+	})
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r memorySessions) Check(ctx context.Context, kind SessionKind, id primitive.ObjectID, accessToken string) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	err := ErrNotFound
+	r.each(kind, func(sid primitive.ObjectID, s session) bool {
+		if sid == id && accessToken != "" && *s.access == accessToken {
+			err = nil
+			if *s.revoked {
+				err = ErrRevoked
+			}
+		}
+		return false
+	})
+	return err
+}
+
+func (r memorySessions) Rotate(ctx context.Context, kind SessionKind, refreshToken string, pair auth_models.TokenPair) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	found := r.each(kind, func(_ primitive.ObjectID, s session) bool {
+		if refreshToken == "" || *s.refresh != refreshToken || *s.revoked {
+			return false
+		}
+		*s.access, *s.refresh = pair.AccessToken, pair.RefreshToken
+		return true
+	})
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r memorySessions) Revoke(ctx context.Context, kind SessionKind, id primitive.ObjectID) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	found := r.each(kind, func(sid primitive.ObjectID, s session) bool {
+		if sid != id {
+			return false
+		}
+		*s.access, *s.refresh, *s.revoked = "", "", true
+		return true
+	})
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ===================== TEMP SIGNUPS =====================
+
+type memoryTempSignups struct{ db *memoryDB }
+
+func (r memoryTempSignups) Put(ctx context.Context, signup auth_models.GetSignUpModel) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	if _, ok := r.db.signups[signup.ID]; ok {
+		return ErrDuplicate
+	}
+	r.db.signups[signup.ID] = signup
+	return nil
+}
+
+func (r memoryTempSignups) Get(ctx context.Context, id primitive.ObjectID) (auth_models.GetSignUpModel, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	s, ok := r.db.signups[id]
+	if !ok || !s.Expires_At.After(time.Now()) {
+		delete(r.db.signups, id)
+		return auth_models.GetSignUpModel{}, ErrNotFound
+	}
+	return s, nil
+}
+
+func (r memoryTempSignups) FailAttempt(ctx context.Context, id primitive.ObjectID) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	s, ok := r.db.signups[id]
+	if !ok {
+		return ErrNotFound
+	}
+	s.Count++
+	r.db.signups[id] = s
+	return nil
+}
+
+func (r memoryTempSignups) Delete(ctx context.Context, id primitive.ObjectID) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	delete(r.db.signups, id)
+	return nil
+}
+
+// ===================== TICKETS =====================
+
+type memoryTickets struct{ db *memoryDB }
+
+func (r memoryTickets) Put(ctx context.Context, ticket ticket_models.Ticket) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	if _, ok := r.db.tickets[ticket.ID]; ok {
+		return ErrDuplicate
+	}
+	r.db.tickets[ticket.ID] = ticket
+	return nil
+}
+
+func (r memoryTickets) Take(ctx context.Context, id string) (ticket_models.Ticket, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	t, ok := r.db.tickets[id]
+	delete(r.db.tickets, id)
+	if !ok || !t.ExpiresAt.After(time.Now()) {
+		return ticket_models.Ticket{}, ErrNotFound
+	}
+	return t, nil
+}
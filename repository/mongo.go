@@ -0,0 +1,337 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	auth_models "github.com/chtan/miniworld/models/auth"
+	clan_models "github.com/chtan/miniworld/models/clan"
+	device_models "github.com/chtan/miniworld/models/device"
+	firmware_models "github.com/chtan/miniworld/models/firmware"
+	ticket_models "github.com/chtan/miniworld/models/ticket"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewMongo keeps each repository in its collection of db.
+func NewMongo(db *mongo.Database) *Repositories {
+	return &Repositories{
+		Users:       mongoUsers{db.Collection("users")},
+		Devices:     mongoDevices{db.Collection("devices")},
+		Clans:       mongoClans{db.Collection("clans")},
+		Sessions:    mongoSessions{db},
+		TempSignups: mongoTempSignups{db.Collection("tempData")},
+		Tickets:     mongoTickets{db.Collection("wsTickets")},
+	}
+}
+
+// mongoErr maps driver errors onto the repository's.
+func mongoErr(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return ErrNotFound
+	case mongo.IsDuplicateKeyError(err):
+		return ErrDuplicate
+	}
+	return err
+}
+
+func findOne[T any](ctx context.Context, coll *mongo.Collection, filter bson.M) (T, error) {
+	var doc T
+	err := coll.FindOne(ctx, filter).Decode(&doc)
+	return doc, mongoErr(err)
+}
+
+func findAll[T any](ctx context.Context, coll *mongo.Collection, filter bson.M) ([]T, error) {
+	cursor, err := coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	docs := []T{}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// updateOne is UpdateOne that reports a missing document as ErrNotFound.
+func updateOne(ctx context.Context, coll *mongo.Collection, filter, update bson.M) error {
+	result, err := coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return mongoErr(err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+var notRevoked = bson.M{"$ne": true}
+
+// ===================== USERS =====================
+
+type mongoUsers struct{ coll *mongo.Collection }
+
+func (r mongoUsers) Create(ctx context.Context, user auth_models.SetSignUpModel) error {
+	_, err := r.coll.InsertOne(ctx, user)
+	return mongoErr(err)
+}
+
+func (r mongoUsers) Get(ctx context.Context, id primitive.ObjectID) (auth_models.SetSignUpModel, error) {
+	return findOne[auth_models.SetSignUpModel](ctx, r.coll, bson.M{"_id": id})
+}
+
+func (r mongoUsers) ByEmail(ctx context.Context, email string) (auth_models.SetSignUpModel, error) {
+	return findOne[auth_models.SetSignUpModel](ctx, r.coll, bson.M{"email": email})
+}
+
+func (r mongoUsers) ByAccessToken(ctx context.Context, token string) (auth_models.SetSignUpModel, error) {
+	return findOne[auth_models.SetSignUpModel](ctx, r.coll, bson.M{"access_token": token})
+}
+
+func (r mongoUsers) EmailTaken(ctx context.Context, email string) (bool, error) {
+	count, err := r.coll.CountDocuments(ctx, bson.M{"email": email}, options.Count().SetLimit(1))
+	return count > 0, err
+}
+
+// ===================== DEVICES =====================
+
+type mongoDevices struct{ coll *mongo.Collection }
+
+func (r mongoDevices) Create(ctx context.Context, device device_models.Device) error {
+	_, err := r.coll.InsertOne(ctx, device)
+	return mongoErr(err)
+}
+
+func (r mongoDevices) Get(ctx context.Context, id primitive.ObjectID) (device_models.Device, error) {
+	return findOne[device_models.Device](ctx, r.coll, bson.M{"_id": id})
+}
+
+func (r mongoDevices) GetOwned(ctx context.Context, id, adminID primitive.ObjectID) (device_models.Device, error) {
+	return findOne[device_models.Device](ctx, r.coll, bson.M{"_id": id, "admin_id": adminID})
+}
+
+func (r mongoDevices) ByAccessToken(ctx context.Context, token string) (device_models.Device, error) {
+	return findOne[device_models.Device](ctx, r.coll, bson.M{"access_token": token, "revoked": notRevoked})
+}
+
+func (r mongoDevices) ByRefreshToken(ctx context.Context, token string) (device_models.Device, error) {
+	return findOne[device_models.Device](ctx, r.coll, bson.M{"refresh_token": token, "revoked": notRevoked})
+}
+
+func (r mongoDevices) ListByClans(ctx context.Context, clanIDs []primitive.ObjectID) ([]device_models.Device, error) {
+	if len(clanIDs) == 0 {
+		return []device_models.Device{}, nil
+	}
+	return findAll[device_models.Device](ctx, r.coll, bson.M{"clan_id": bson.M{"$in": clanIDs}})
+}
+
+func (r mongoDevices) ListInClan(ctx context.Context, clanID primitive.ObjectID, ids []primitive.ObjectID) ([]device_models.Device, error) {
+	return findAll[device_models.Device](ctx, r.coll, bson.M{"_id": bson.M{"$in": ids}, "clan_id": clanID})
+}
+
+func (r mongoDevices) CountInClan(ctx context.Context, clanID primitive.ObjectID, ids []primitive.ObjectID) (int, error) {
+	count, err := r.coll.CountDocuments(ctx, bson.M{"_id": bson.M{"$in": ids}, "clan_id": clanID})
+	return int(count), err
+}
+
+func (r mongoDevices) SetPassword(ctx context.Context, id primitive.ObjectID, hash string) error {
+	return updateOne(ctx, r.coll, bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"password":      hash,
+		"access_token":  "",
+		"refresh_token": "",
+		"revoked":       false,
+		"updated_at":    time.Now(),
+	}})
+}
+
+func (r mongoDevices) SyncPresence(ctx context.Context, id primitive.ObjectID, online bool, generation int64) error {
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+		"$or": []bson.M{
+			{"presence_generation": bson.M{"$exists": false}},
+			{"presence_generation": bson.M{"$lt": generation}},
+		},
+	}, bson.M{"$set": bson.M{
+		"is_online":           online,
+		"presence_generation": generation,
+		"updated_at":          time.Now(),
+	}})
+	return err
+}
+
+func (r mongoDevices) ListOnChannel(ctx context.Context, clanID primitive.ObjectID, channel string, ids []primitive.ObjectID) ([]device_models.Device, error) {
+	onChannel := bson.M{"$eq": channel}
+	if channel == firmware_models.ChannelStable {
+		onChannel = bson.M{"$in": bson.A{channel, nil, ""}}
+	}
+	filter := bson.M{
+		"clan_id":          clanID,
+		"firmware_channel": onChannel,
+		"revoked":          notRevoked,
+	}
+	if len(ids) > 0 {
+		filter["_id"] = bson.M{"$in": ids}
+	}
+	return findAll[device_models.Device](ctx, r.coll, filter)
+}
+
+func (r mongoDevices) SetFirmwareChannel(ctx context.Context, id primitive.ObjectID, channel string) error {
+	return updateOne(ctx, r.coll, bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"firmware_channel": channel,
+		"updated_at":       time.Now(),
+	}})
+}
+
+func (r mongoDevices) SetFirmware(ctx context.Context, id, firmwareID primitive.ObjectID, version string) error {
+	update := bson.M{"$set": bson.M{
+		"firmware_id":      firmwareID,
+		"firmware_version": version,
+		"updated_at":       time.Now(),
+	}}
+	if firmwareID.IsZero() {
+		update = bson.M{
+			"$set":   bson.M{"firmware_version": version, "updated_at": time.Now()},
+			"$unset": bson.M{"firmware_id": ""},
+		}
+	}
+	return updateOne(ctx, r.coll, bson.M{"_id": id}, update)
+}
+
+// ===================== CLANS =====================
+
+type mongoClans struct{ coll *mongo.Collection }
+
+func (r mongoClans) Create(ctx context.Context, clan clan_models.Clan) error {
+	_, err := r.coll.InsertOne(ctx, clan)
+	return mongoErr(err)
+}
+
+func (r mongoClans) GetOwned(ctx context.Context, id, adminID primitive.ObjectID) (clan_models.Clan, error) {
+	return findOne[clan_models.Clan](ctx, r.coll, bson.M{"_id": id, "admin_id": adminID})
+}
+
+func (r mongoClans) ListByAdmin(ctx context.Context, adminID primitive.ObjectID) ([]clan_models.Clan, error) {
+	return findAll[clan_models.Clan](ctx, r.coll, bson.M{"admin_id": adminID})
+}
+
+func (r mongoClans) ListForUser(ctx context.Context, userID primitive.ObjectID) ([]clan_models.Clan, error) {
+	return findAll[clan_models.Clan](ctx, r.coll, bson.M{"$or": bson.A{
+		bson.M{"admin_id": userID},
+		bson.M{"member_ids": userID},
+	}})
+}
+
+func (r mongoClans) AddMembers(ctx context.Context, id, adminID primitive.ObjectID, userIDs []primitive.ObjectID) error {
+	return updateOne(ctx, r.coll, bson.M{"_id": id, "admin_id": adminID}, bson.M{
+		"$addToSet": bson.M{"member_ids": bson.M{"$each": userIDs}},
+		"$set":      bson.M{"updated_at": time.Now()},
+	})
+}
+
+func (r mongoClans) RemoveMembers(ctx context.Context, id, adminID primitive.ObjectID, userIDs []primitive.ObjectID) error {
+	return updateOne(ctx, r.coll, bson.M{"_id": id, "admin_id": adminID}, bson.M{
+		"$pull": bson.M{"member_ids": bson.M{"$in": userIDs}},
+		"$set":  bson.M{"updated_at": time.Now()},
+	})
+}
+
+// ===================== SESSIONS =====================
+
+// mongoSessions keeps tokens on the user and device documents; a
+// SessionKind names the collection.
+type mongoSessions struct{ db *mongo.Database }
+
+func (r mongoSessions) Issue(ctx context.Context, kind SessionKind, id primitive.ObjectID, pair auth_models.TokenPair) error {
+	return updateOne(ctx, r.db.Collection(string(kind)), bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"access_token":  pair.AccessToken,
+		"refresh_token": pair.RefreshToken,
+		"revoked":       false,
+		"updated_at":    time.Now(),
+	}})
+}
+
+func (r mongoSessions) Check(ctx context.Context, kind SessionKind, id primitive.ObjectID, accessToken string) error {
+	var doc struct {
+		Revoked bool `bson:"revoked"`
+	}
+	err := r.db.Collection(string(kind)).FindOne(ctx,
+		bson.M{"_id": id, "access_token": accessToken},
+		options.FindOne().SetProjection(bson.M{"revoked": 1}),
+	).Decode(&doc)
+	if err != nil {
+		return mongoErr(err)
+	}
+	if doc.Revoked {
+		return ErrRevoked
+	}
+	return nil
+}
+
+func (r mongoSessions) Rotate(ctx context.Context, kind SessionKind, refreshToken string, pair auth_models.TokenPair) error {
+	// filtering on the old refresh token makes concurrent refreshes race safely
+	return updateOne(ctx, r.db.Collection(string(kind)), bson.M{
+		"refresh_token": refreshToken,
+		"revoked":       notRevoked,
+	}, bson.M{"$set": bson.M{
+		"access_token":  pair.AccessToken,
+		"refresh_token": pair.RefreshToken,
+		"updated_at":    time.Now(),
+	}})
+}
+
+func (r mongoSessions) Revoke(ctx context.Context, kind SessionKind, id primitive.ObjectID) error {
+	return updateOne(ctx, r.db.Collection(string(kind)), bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"access_token":  "",
+		"refresh_token": "",
+		"revoked":       true,
+		"updated_at":    time.Now(),
+	}})
+}
+
+// ===================== TEMP SIGNUPS =====================
+
+type mongoTempSignups struct{ coll *mongo.Collection }
+
+func (r mongoTempSignups) Put(ctx context.Context, signup auth_models.GetSignUpModel) error {
+	_, err := r.coll.InsertOne(ctx, signup)
+	return mongoErr(err)
+}
+
+func (r mongoTempSignups) Get(ctx context.Context, id primitive.ObjectID) (auth_models.GetSignUpModel, error) {
+	// the TTL monitor only runs once a minute
+	return findOne[auth_models.GetSignUpModel](ctx, r.coll, bson.M{"_id": id, "expires_at": bson.M{"$gt": time.Now()}})
+}
+
+func (r mongoTempSignups) FailAttempt(ctx context.Context, id primitive.ObjectID) error {
+	return updateOne(ctx, r.coll, bson.M{"_id": id}, bson.M{"$inc": bson.M{"count": 1}})
+}
+
+func (r mongoTempSignups) Delete(ctx context.Context, id primitive.ObjectID) error {
+	_, err := r.coll.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// ===================== TICKETS =====================
+
+type mongoTickets struct{ coll *mongo.Collection }
+
+func (r mongoTickets) Put(ctx context.Context, ticket ticket_models.Ticket) error {
+	_, err := r.coll.InsertOne(ctx, ticket)
+	return mongoErr(err)
+}
+
+func (r mongoTickets) Take(ctx context.Context, id string) (ticket_models.Ticket, error) {
+	var ticket ticket_models.Ticket
+	// deleting as it is read makes a ticket good for one socket only
+	err := r.coll.FindOneAndDelete(ctx, bson.M{
+		"_id":        id,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&ticket)
+	return ticket, mongoErr(err)
+}
@@ -0,0 +1,125 @@
+// Package repository is the storage layer for users, devices, clans, login
+// sessions, pending signups and websocket tickets. Controllers reach it through
+// AppConfig.Repos; NewMongo backs it with the miniworld database and
+// NewMemory with maps, for tests that run without one.
+package repository
+
+import (
+	"context"
+	"errors"
+
+	auth_models "github.com/chtan/miniworld/models/auth"
+	clan_models "github.com/chtan/miniworld/models/clan"
+	device_models "github.com/chtan/miniworld/models/device"
+	ticket_models "github.com/chtan/miniworld/models/ticket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	ErrNotFound  = errors.New("repository: not found")
+	ErrDuplicate = errors.New("repository: already exists")
+	ErrRevoked   = errors.New("repository: session revoked")
+)
+
+// Repositories bundles one implementation of each repository.
+type Repositories struct {
+	Users       Users
+	Devices     Devices
+	Clans       Clans
+	Sessions    Sessions
+	TempSignups TempSignups
+	Tickets     Tickets
+}
+
+// Users are accounts that completed signup.
+type Users interface {
+	// Create returns ErrDuplicate if the email is taken.
+	Create(ctx context.Context, user auth_models.SetSignUpModel) error
+	Get(ctx context.Context, id primitive.ObjectID) (auth_models.SetSignUpModel, error)
+	ByEmail(ctx context.Context, email string) (auth_models.SetSignUpModel, error)
+	// ByAccessToken finds the user the token was last issued to, revoked or not.
+	ByAccessToken(ctx context.Context, token string) (auth_models.SetSignUpModel, error)
+	EmailTaken(ctx context.Context, email string) (bool, error)
+}
+
+// Devices are the cars. Lookups by token skip revoked devices.
+type Devices interface {
+	Create(ctx context.Context, device device_models.Device) error
+	Get(ctx context.Context, id primitive.ObjectID) (device_models.Device, error)
+	// GetOwned finds the device only if adminID is its admin.
+	GetOwned(ctx context.Context, id, adminID primitive.ObjectID) (device_models.Device, error)
+	ByAccessToken(ctx context.Context, token string) (device_models.Device, error)
+	ByRefreshToken(ctx context.Context, token string) (device_models.Device, error)
+	ListByClans(ctx context.Context, clanIDs []primitive.ObjectID) ([]device_models.Device, error)
+	// ListInClan returns those of ids that belong to the clan.
+	ListInClan(ctx context.Context, clanID primitive.ObjectID, ids []primitive.ObjectID) ([]device_models.Device, error)
+	CountInClan(ctx context.Context, clanID primitive.ObjectID, ids []primitive.ObjectID) (int, error)
+	// SetPassword replaces the device's password, ends its sessions and
+	// lifts a revocation.
+	SetPassword(ctx context.Context, id primitive.ObjectID, hash string) error
+	// SyncPresence sets is_online as derived from presence generation; it
+	// is skipped if a newer generation was already written.
+	SyncPresence(ctx context.Context, id primitive.ObjectID, online bool, generation int64) error
+	// ListOnChannel returns the clan's devices that follow the firmware
+	// channel and aren't revoked, narrowed to ids when any are given.
+	// Devices that never picked a channel follow stable.
+	ListOnChannel(ctx context.Context, clanID primitive.ObjectID, channel string, ids []primitive.ObjectID) ([]device_models.Device, error)
+	SetFirmwareChannel(ctx context.Context, id primitive.ObjectID, channel string) error
+	// SetFirmware records the firmware the car runs; a nil firmwareID
+	// clears it, for images that weren't uploaded here.
+	SetFirmware(ctx context.Context, id, firmwareID primitive.ObjectID, version string) error
+}
+
+type Clans interface {
+	// Create returns ErrDuplicate if the name or tag is taken.
+	Create(ctx context.Context, clan clan_models.Clan) error
+	// GetOwned finds the clan only if adminID is its admin.
+	GetOwned(ctx context.Context, id, adminID primitive.ObjectID) (clan_models.Clan, error)
+	ListByAdmin(ctx context.Context, adminID primitive.ObjectID) ([]clan_models.Clan, error)
+	// ListForUser returns the clans the user administers or is a member of.
+	ListForUser(ctx context.Context, userID primitive.ObjectID) ([]clan_models.Clan, error)
+	// AddMembers and RemoveMembers return ErrNotFound unless adminID is
+	// the clan's admin.
+	AddMembers(ctx context.Context, id, adminID primitive.ObjectID, userIDs []primitive.ObjectID) error
+	RemoveMembers(ctx context.Context, id, adminID primitive.ObjectID, userIDs []primitive.ObjectID) error
+}
+
+// SessionKind says whose tokens a session holds.
+type SessionKind string
+
+const (
+	UserSessions   SessionKind = "users"
+	DeviceSessions SessionKind = "devices"
+)
+
+// Sessions are the access and refresh tokens issued to a user or device.
+type Sessions interface {
+	// Issue stores a new token pair and lifts a revocation.
+	Issue(ctx context.Context, kind SessionKind, id primitive.ObjectID, pair auth_models.TokenPair) error
+	// Check returns ErrNotFound unless accessToken is id's current token,
+	// and ErrRevoked if the session was revoked.
+	Check(ctx context.Context, kind SessionKind, id primitive.ObjectID, accessToken string) error
+	// Rotate replaces the pair holding refreshToken. Each refresh token
+	// works once: a second use, or a revoked session, is ErrNotFound.
+	Rotate(ctx context.Context, kind SessionKind, refreshToken string, pair auth_models.TokenPair) error
+	// Revoke clears the tokens and blocks new ones until the next Issue.
+	Revoke(ctx context.Context, kind SessionKind, id primitive.ObjectID) error
+}
+
+// TempSignups hold signups waiting for their OTP. They expire at Expires_At.
+type TempSignups interface {
+	Put(ctx context.Context, signup auth_models.GetSignUpModel) error
+	// Get returns ErrNotFound once the signup has expired.
+	Get(ctx context.Context, id primitive.ObjectID) (auth_models.GetSignUpModel, error)
+	// FailAttempt counts a wrong OTP.
+	FailAttempt(ctx context.Context, id primitive.ObjectID) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+// Tickets are single-use websocket tickets, keyed by a hash of the secret.
+type Tickets interface {
+	Put(ctx context.Context, ticket ticket_models.Ticket) error
+	// Take removes the ticket and returns it. It returns ErrNotFound once
+	// the ticket has been taken or has expired.
+	Take(ctx context.Context, id string) (ticket_models.Ticket, error)
+}
@@ -4,9 +4,19 @@ import (
 	"github.com/chtan/miniworld/config"
 	"github.com/chtan/miniworld/controllers"
 	clan_controllers "github.com/chtan/miniworld/controllers/clan"
+	command_controllers "github.com/chtan/miniworld/controllers/command"
 	device_controllers "github.com/chtan/miniworld/controllers/device"
+	firmware_controllers "github.com/chtan/miniworld/controllers/firmware"
+	group_controllers "github.com/chtan/miniworld/controllers/group"
+	latency_controllers "github.com/chtan/miniworld/controllers/latency"
+	recording_controllers "github.com/chtan/miniworld/controllers/recording"
+	shadow_controllers "github.com/chtan/miniworld/controllers/shadow"
+	signaling_controllers "github.com/chtan/miniworld/controllers/signaling"
+	telemetry_controllers "github.com/chtan/miniworld/controllers/telemetry"
+	ticket_controllers "github.com/chtan/miniworld/controllers/ticket"
 	user_controllers "github.com/chtan/miniworld/controllers/user"
 	websocket_controllers "github.com/chtan/miniworld/controllers/websocket"
+	"github.com/chtan/miniworld/middleware"
 	"github.com/gin-gonic/gin"
 )
 
@@ -15,7 +25,11 @@ func UserRoutes(incomingRoutes *gin.RouterGroup, app *config.AppConfig) {
 }
 
 func DevicePublicRoutes(incomingRoutes *gin.Engine, app *config.AppConfig) {
-	incomingRoutes.POST("/dlogin", device_controllers.LogIn(app))
+	incomingRoutes.POST("/dlogin", middleware.RateLimit(app, "dlogin", "id"), device_controllers.LogIn(app))
+	incomingRoutes.POST("/dpair", device_controllers.PairDevice(app))
+	incomingRoutes.POST("/drefresh", device_controllers.RefreshToken(app))
+	incomingRoutes.GET("/pki/ca", device_controllers.GetDeviceCA(app))
+	incomingRoutes.GET("/pki/crl", device_controllers.GetDeviceCRL(app))
 	incomingRoutes.GET("/api/ws/device", controllers.HandleDeviceWS(app))
 	incomingRoutes.GET("/api/ws/devicecam", websocket_controllers.HandleDeviceWSCam(app))
 
@@ -24,18 +38,85 @@ func DevicePublicRoutes(incomingRoutes *gin.Engine, app *config.AppConfig) {
 func ClanRoutes(incomingRoutes *gin.RouterGroup, app *config.AppConfig) {
 	incomingRoutes.POST("/createclan", clan_controllers.CreateClan(app))
 	incomingRoutes.POST("/adddevice", clan_controllers.AddDevice(app))
+	incomingRoutes.POST("/pairingcode", clan_controllers.CreatePairingCode(app))
+	incomingRoutes.POST("/clanmembers", clan_controllers.UpdateMembers(app))
+	incomingRoutes.POST("/rotatedevice", device_controllers.RotateCredentials(app))
+	incomingRoutes.POST("/revokedevice", device_controllers.RevokeDevice(app))
+	incomingRoutes.POST("/issuedevicecert", device_controllers.IssueDeviceCert(app))
+	incomingRoutes.GET("/devicecerts", device_controllers.ListDeviceCerts(app))
+	incomingRoutes.GET("/devicecert", device_controllers.DownloadDeviceCert(app))
+	incomingRoutes.POST("/revokedevicecert", device_controllers.RevokeDeviceCert(app))
 }
 
 func UserPublicRoutes(incomingRoutes *gin.Engine, app *config.AppConfig) {
 	// incomingRoutes.POST("/imageverification", controllers.ImageVarification(app))
 	incomingRoutes.POST("/usignup", user_controllers.SignUp(app))
-	incomingRoutes.POST("/usignin", user_controllers.SignIn(app))
-	incomingRoutes.POST("/uvalidateotp", user_controllers.ValidateOtpAndSaveUser(app))
+	incomingRoutes.POST("/usignin", middleware.RateLimit(app, "usignin", "email"), user_controllers.SignIn(app))
+	incomingRoutes.POST("/uvalidateotp", middleware.RateLimit(app, "uvalidateotp", "_id"), user_controllers.ValidateOtpAndSaveUser(app))
 
 }
 
+// UserWebSocketRoutes sit outside the authorized group: browsers can't send
+// an Authorization header with the handshake, so they present a ticket.
+func UserWebSocketRoutes(incomingRoutes *gin.Engine, app *config.AppConfig) {
+	incomingRoutes.GET("/api/ws/user", controllers.HandleUserWS(app))
+	incomingRoutes.GET("/api/ws/usercam", websocket_controllers.HandleUserWSCam(app))
+	incomingRoutes.GET("/api/ws/lobby", websocket_controllers.HandleLobbyWS(app))
+	incomingRoutes.GET("/api/ws/replay", websocket_controllers.HandleReplayWS(app))
+}
+
 func WebSocketRoutes(incomingRoutes *gin.RouterGroup, app *config.AppConfig) {
-	incomingRoutes.GET("/ws/user", controllers.HandleUserWS(app))
-	incomingRoutes.GET("/ws/usercam", websocket_controllers.HandleUserWSCam(app))
+	incomingRoutes.GET("/camera/mjpeg", websocket_controllers.GetCameraMJPEG(app))
+	incomingRoutes.GET("/camera/snapshot", websocket_controllers.GetCameraSnapshot(app))
+	incomingRoutes.GET("/webrtc/config", signaling_controllers.GetICEServers(app))
+
+}
+
+func TicketRoutes(incomingRoutes *gin.RouterGroup, app *config.AppConfig) {
+	incomingRoutes.POST("/wsticket", ticket_controllers.IssueTicket(app))
+}
+
+func TelemetryRoutes(incomingRoutes *gin.RouterGroup, app *config.AppConfig) {
+	incomingRoutes.GET("/telemetry", telemetry_controllers.GetTelemetry(app))
+	incomingRoutes.GET("/telemetry/aggregate", telemetry_controllers.GetTelemetryAggregate(app))
+}
+
+func ShadowRoutes(incomingRoutes *gin.RouterGroup, app *config.AppConfig) {
+	incomingRoutes.GET("/shadow", shadow_controllers.GetShadow(app))
+	incomingRoutes.POST("/shadow/desired", shadow_controllers.UpdateDesired(app))
+}
+
+func CommandRoutes(incomingRoutes *gin.RouterGroup, app *config.AppConfig) {
+	incomingRoutes.POST("/commands", command_controllers.EnqueueCommand(app))
+	incomingRoutes.GET("/commands", command_controllers.ListCommands(app))
+}
+
+func FirmwareRoutes(incomingRoutes *gin.RouterGroup, app *config.AppConfig) {
+	incomingRoutes.POST("/firmware", firmware_controllers.UploadFirmware(app))
+	incomingRoutes.GET("/firmware", firmware_controllers.ListFirmware(app))
+	incomingRoutes.POST("/firmware/channel", firmware_controllers.SetDeviceChannel(app))
+	incomingRoutes.POST("/firmware/release", firmware_controllers.CreateRelease(app))
+	incomingRoutes.GET("/firmware/rollout", firmware_controllers.GetRollout(app))
+	incomingRoutes.POST("/firmware/rollback", firmware_controllers.RollbackRelease(app))
+}
+
+func GroupRoutes(incomingRoutes *gin.RouterGroup, app *config.AppConfig) {
+	incomingRoutes.POST("/groups", group_controllers.CreateGroup(app))
+	incomingRoutes.GET("/groups", group_controllers.ListGroups(app))
+	incomingRoutes.POST("/groups/members", group_controllers.UpdateMembers(app))
+	incomingRoutes.POST("/groups/delete", group_controllers.DeleteGroup(app))
+	incomingRoutes.POST("/groups/stop", group_controllers.BulkStop(app))
+	incomingRoutes.POST("/groups/configure", group_controllers.BulkConfigure(app))
+	incomingRoutes.POST("/groups/rotate", group_controllers.BulkRotateCredentials(app))
+	incomingRoutes.POST("/groups/firmware", group_controllers.BulkAssignFirmware(app))
+}
+
+func RecordingRoutes(incomingRoutes *gin.RouterGroup, app *config.AppConfig) {
+	incomingRoutes.GET("/recordings", recording_controllers.ListRecordings(app))
+	incomingRoutes.GET("/recording", recording_controllers.DownloadRecording(app))
+}
 
+func LatencyRoutes(incomingRoutes *gin.RouterGroup, app *config.AppConfig) {
+	incomingRoutes.GET("/latency", latency_controllers.GetLatency(app))
+	incomingRoutes.GET("/controlsessions", latency_controllers.ListControlSessions(app))
 }
@@ -10,10 +10,9 @@ import (
 
 	"github.com/chtan/miniworld/config"
 	models "github.com/chtan/miniworld/models/auth"
+	"github.com/chtan/miniworld/repository"
 	"github.com/golang-jwt/jwt/v4"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // GenerateTokenPair creates a new access and refresh token pair
@@ -23,7 +22,7 @@ func GenerateTokenPair(email string, uid primitive.ObjectID, app *config.AppConf
 		Email: email,
 		UID:   uid,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(60 * time.Minute)), // 15 minutes
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(app.Settings.JWT.AccessTTL.Std())),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Issuer:    "myWork",
 		},
@@ -41,7 +40,7 @@ func GenerateTokenPair(email string, uid primitive.ObjectID, app *config.AppConf
 	refreshClaims := &models.SigningDetails{
 		UID: uid, // Include UID for validation
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(30 * 24 * time.Hour)), // 30 days
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(app.Settings.JWT.RefreshTTL.Std())),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Issuer:    "myWork",
 			ID:        refreshID, // Unique identifier (jti)
@@ -95,22 +94,11 @@ func RefreshTokens(refreshTokenString string, app *config.AppConfig) (models.Tok
 		return models.TokenPair{}, errors.New("invalid or expired refresh token")
 	}
 
-	// Optionally check if the refresh token is revoked in the database
 	mctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	filter := bson.M{
-		"_id":           claims.UID,
-		"refresh_token": refreshTokenString,
-	}
-	count, err := app.Client.Database("talkmore").Collection("users").CountDocuments(mctx, filter)
-	if err != nil || count == 0 {
-		return models.TokenPair{}, errors.New("refresh token not found or revoked")
-	}
 
-	// Generate a new token pair
-	// Note: Email isn’t in the refresh token, so fetch it from DB or omit it
-	var user models.SetSignUpModel
-	err = app.Client.Database("talkmore").Collection("users").FindOne(mctx, bson.M{"user_id": claims.UID}).Decode(&user)
+	// Email isn't in the refresh token, so fetch it from the user
+	user, err := app.Repos.Users.Get(mctx, claims.UID)
 	if err != nil {
 		return models.TokenPair{}, errors.New("user not found")
 	}
@@ -120,16 +108,11 @@ func RefreshTokens(refreshTokenString string, app *config.AppConfig) (models.Tok
 		return models.TokenPair{}, err
 	}
 
-	// Update the user's tokens in the database
-	_, err = app.Client.Database("talkmore").Collection("users").UpdateOne(
-		mctx,
-		bson.M{"user_id": claims.UID},
-		bson.M{"$set": bson.M{
-			"token":         newTokenPair.AccessToken,
-			"refresh_token": newTokenPair.RefreshToken,
-			"updated_at":    time.Now(),
-		}},
-	)
+	// Only the current, unrevoked refresh token can be swapped, and only once
+	err = app.Repos.Sessions.Rotate(mctx, repository.UserSessions, refreshTokenString, newTokenPair)
+	if err == repository.ErrNotFound {
+		return models.TokenPair{}, errors.New("refresh token not found or revoked")
+	}
 	if err != nil {
 		log.Printf("Failed to update tokens: %v", err)
 		return models.TokenPair{}, errors.New("failed to update tokens")
@@ -147,29 +130,3 @@ func generateRandomID(length int) string {
 	}
 	return hex.EncodeToString(b)
 }
-
-// updateTokens stores tokens in MongoDB
-func updateTokens(accessToken, refreshToken, refreshID, userID string, app *config.AppConfig) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	updateObj := bson.D{
-		{Key: "token", Value: accessToken},
-		{Key: "refresh_token", Value: refreshToken},
-		{Key: "refresh_id", Value: refreshID}, // Store for revocation
-		{Key: "updated_at", Value: time.Now()},
-	}
-
-	upsert := true
-	filter := bson.M{"user_id": userID}
-	opts := options.UpdateOptions{Upsert: &upsert}
-
-	_, err := app.Client.Database("talkmore").Collection("users").UpdateOne(ctx, filter, bson.D{
-		{Key: "$set", Value: updateObj},
-	}, &opts)
-	if err != nil {
-		log.Printf("Failed to update tokens: %v", err)
-		return err
-	}
-	return nil
-}